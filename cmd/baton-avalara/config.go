@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
 	"github.com/conductorone/baton-sdk/pkg/field"
 	"github.com/spf13/viper"
 )
@@ -12,23 +17,135 @@ var (
 	UsernameField = field.StringField(
 		"username",
 		field.WithDescription("The Avalara username used to connect to the Avalara API"),
-		field.WithRequired(true),
 	)
 	PasswordField = field.StringField(
 		"password",
 		field.WithDescription("The Avalara password used to connect to the Avalara API"),
-		field.WithRequired(true),
+	)
+	TenantsFileField = field.StringField(
+		"tenants-file",
+		field.WithDescription("Path to a JSON file listing named Avalara credentials to sync into one c1z, in place of username and password"),
 	)
 	EnvironmentField = field.StringField(
 		"environment",
-		field.WithDescription("The Avalara environment to connect to (production or sandbox)"),
+		field.WithDescription("The Avalara environment to connect to (production, sandbox or test)"),
 		field.WithDefaultValue("production"),
 	)
+	BaseURLField = field.StringField(
+		"base-url",
+		field.WithDescription("The Avalara API URL to connect to instead of the environment's, such as a regional or proxied endpoint. HTTPS is required except for loopback hosts"),
+	)
+	AccountIDField = field.IntField(
+		"account-id",
+		field.WithDescription("The Avalara account to sync. Defaults to the account the credentials belong to"),
+	)
+	DryRunField = field.BoolField(
+		"dry-run",
+		field.WithDescription("Log provisioning requests instead of sending them to the Avalara API"),
+	)
+	UserSyncStatePathField = field.StringField(
+		"user-sync-state-path",
+		field.WithDescription("Path to a file that keeps user sync state between runs. Setting it enables incremental user sync"),
+	)
+	FullSyncIntervalField = field.IntField(
+		"full-sync-interval",
+		field.WithDescription("Hours between full user syncs when incremental user sync is enabled"),
+		field.WithDefaultValue(24),
+	)
+	EntitlementConcurrencyField = field.IntField(
+		"entitlement-concurrency",
+		field.WithDescription("Maximum number of user entitlement requests sent to the Avalara API in parallel"),
+		field.WithDefaultValue(8),
+	)
+	PageSizeField = field.IntField(
+		"page-size",
+		field.WithDescription("Number of records requested per page from the Avalara API, up to 1000"),
+		field.WithDefaultValue(100),
+	)
+	AdaptivePageSizeField = field.BoolField(
+		"adaptive-page-size",
+		field.WithDescription("Shrink the page size after timeouts and server errors, and grow it back on healthy responses"),
+	)
+	AllowedHostsField = field.StringSliceField(
+		"allowed-hosts",
+		field.WithDescription("Hosts other than the Avalara API host that next links may point at, such as a proxy, as host or host:port; a host without a port allows only the default port"),
+	)
+	ProxyURLField = field.StringField(
+		"proxy-url",
+		field.WithDescription("HTTP, HTTPS or SOCKS5 proxy to reach the Avalara API through, instead of the proxy set in the environment"),
+	)
+	CABundlePathField = field.StringField(
+		"ca-bundle-path",
+		field.WithDescription("Path to a PEM file of CA certificates to trust in addition to the system roots, such as an inspecting proxy's"),
+	)
+	ClientCertPathField = field.StringField(
+		"client-cert-path",
+		field.WithDescription("Path to a PEM client certificate presented for mutual TLS"),
+	)
+	ClientKeyPathField = field.StringField(
+		"client-key-path",
+		field.WithDescription("Path to the PEM private key of the client certificate"),
+	)
+	IncludeAccountIDsField = field.StringSliceField(
+		"include-account-ids",
+		field.WithDescription("Only sync users of these Avalara account IDs"),
+	)
+	ExcludeAccountIDsField = field.StringSliceField(
+		"exclude-account-ids",
+		field.WithDescription("Skip users of these Avalara account IDs"),
+	)
+	IncludeCompanyIDsField = field.StringSliceField(
+		"include-company-ids",
+		field.WithDescription("Only sync users of these Avalara company IDs"),
+	)
+	ExcludeCompanyIDsField = field.StringSliceField(
+		"exclude-company-ids",
+		field.WithDescription("Skip users of these Avalara company IDs"),
+	)
+	SyncInactiveUsersField = field.BoolField(
+		"sync-inactive-users",
+		field.WithDescription("Sync users that are not active"),
+		field.WithDefaultValue(true),
+	)
+	SyncDeletedUsersField = field.BoolField(
+		"sync-deleted-users",
+		field.WithDescription("Sync users that are marked as deleted"),
+	)
+
+	// environments are the values accepted by the environment field.
+	environments = []string{"production", "sandbox", "test"}
 
 	ConfigurationFields = []field.SchemaField{
 		UsernameField,
 		PasswordField,
+		TenantsFileField,
 		EnvironmentField,
+		BaseURLField,
+		AccountIDField,
+		DryRunField,
+		UserSyncStatePathField,
+		FullSyncIntervalField,
+		EntitlementConcurrencyField,
+		PageSizeField,
+		AdaptivePageSizeField,
+		AllowedHostsField,
+		ProxyURLField,
+		CABundlePathField,
+		ClientCertPathField,
+		ClientKeyPathField,
+		IncludeAccountIDsField,
+		ExcludeAccountIDsField,
+		IncludeCompanyIDsField,
+		ExcludeCompanyIDsField,
+		SyncInactiveUsersField,
+		SyncDeletedUsersField,
+	}
+
+	idListFields = []field.SchemaField{
+		IncludeAccountIDsField,
+		ExcludeAccountIDsField,
+		IncludeCompanyIDsField,
+		ExcludeCompanyIDsField,
 	}
 
 	FieldRelationships = []field.SchemaFieldRelationship{
@@ -36,6 +153,18 @@ var (
 			UsernameField,
 			PasswordField,
 		),
+		field.FieldsMutuallyExclusive(
+			UsernameField,
+			TenantsFileField,
+		),
+		field.FieldsRequiredTogether(
+			ClientCertPathField,
+			ClientKeyPathField,
+		),
+		field.FieldsAtLeastOneUsed(
+			UsernameField,
+			TenantsFileField,
+		),
 	}
 )
 
@@ -43,16 +172,136 @@ var (
 func ValidateConfig(v *viper.Viper) error {
 	username := v.GetString(UsernameField.FieldName)
 	password := v.GetString(PasswordField.FieldName)
+	tenantsFile := v.GetString(TenantsFileField.FieldName)
 	environment := v.GetString(EnvironmentField.FieldName)
 
-	if username == "" || password == "" {
+	if tenantsFile != "" {
+		if username != "" || password != "" {
+			return fmt.Errorf("username and password cannot be used with tenants-file")
+		}
+
+		_, err := loadTenants(tenantsFile)
+		if err != nil {
+			return fmt.Errorf("invalid tenants-file: %w", err)
+		}
+	} else if username == "" || password == "" {
 		return fmt.Errorf("both username and password are required")
 	}
 
-	environment = strings.ToLower(environment)
-	if environment != "production" && environment != "sandbox" {
-		return fmt.Errorf("invalid environment: must be either 'production' or 'sandbox'")
+	if environment != "" && !slices.Contains(environments, strings.ToLower(environment)) {
+		return fmt.Errorf("invalid environment: must be one of %s", strings.Join(environments, ", "))
+	}
+
+	if baseURL := v.GetString(BaseURLField.FieldName); baseURL != "" {
+		err := validateBaseURL(baseURL)
+		if err != nil {
+			return fmt.Errorf("invalid base-url: %w", err)
+		}
+	}
+
+	if v.GetInt(AccountIDField.FieldName) < 0 {
+		return fmt.Errorf("invalid account-id: must not be negative")
+	}
+
+	if v.GetInt(FullSyncIntervalField.FieldName) < 0 {
+		return fmt.Errorf("invalid full-sync-interval: must not be negative")
+	}
+
+	if v.IsSet(EntitlementConcurrencyField.FieldName) && v.GetInt(EntitlementConcurrencyField.FieldName) < 1 {
+		return fmt.Errorf("invalid entitlement-concurrency: must be at least 1")
+	}
+
+	if v.IsSet(PageSizeField.FieldName) && v.GetInt(PageSizeField.FieldName) < 1 {
+		return fmt.Errorf("invalid page-size: must be at least 1")
+	}
+
+	err := validateTransport(transportConfig(v))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range idListFields {
+		_, err := parseIDs(v.GetStringSlice(f.FieldName))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", f.FieldName, err)
+		}
+	}
+
+	return nil
+}
+
+func transportConfig(v *viper.Viper) avalaraclient.TransportConfig {
+	return avalaraclient.TransportConfig{
+		ProxyURL:       v.GetString(ProxyURLField.FieldName),
+		CABundlePath:   v.GetString(CABundlePathField.FieldName),
+		ClientCertPath: v.GetString(ClientCertPathField.FieldName),
+		ClientKeyPath:  v.GetString(ClientKeyPathField.FieldName),
+	}
+}
+
+// validateTransport checks the proxy URL, and that the CA bundle and client certificate can be loaded.
+func validateTransport(transport avalaraclient.TransportConfig) error {
+	_, err := transport.Proxy()
+	if err != nil {
+		return fmt.Errorf("invalid proxy-url: %w", err)
+	}
+
+	_, err = transport.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
 	}
 
 	return nil
 }
+
+// validateBaseURL requires an absolute URL, served over HTTPS unless the host is a loopback address.
+func validateBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", baseURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%q must not have a query or fragment", baseURL)
+	}
+
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if isLoopback(u.Hostname()) {
+			return nil
+		}
+		return fmt.Errorf("%q must use https unless the host is a loopback address", baseURL)
+	default:
+		return fmt.Errorf("%q must use https", baseURL)
+	}
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseIDs converts a list of Avalara IDs from the configuration into integers.
+func parseIDs(values []string) ([]int, error) {
+	var ids []int
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("%q is not a valid ID", value)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -1,7 +1,17 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/conductorone/baton-sdk/pkg/field"
 	"github.com/conductorone/baton-sdk/pkg/test"
@@ -13,9 +23,280 @@ func TestConfigs(t *testing.T) {
 		FieldRelationships...,
 	)
 
+	credentials := func(configs map[string]string) map[string]string {
+		configs["username"] = "testuser"
+		configs["password"] = "testpass"
+		return configs
+	}
+
+	tenantsFile := func(contents string) string {
+		path := filepath.Join(t.TempDir(), "tenants.json")
+		err := os.WriteFile(path, []byte(contents), 0o600)
+		if err != nil {
+			t.Fatalf("Expected to write tenants file, got %v", err)
+		}
+		return path
+	}
+
+	t.Setenv("SUBSIDIARY_PASSWORD", "subsidiarypass")
+
+	certPath, keyPath := writeCertificate(t)
+
 	testCases := []test.TestCase{
-		// Add test cases here.
+		{
+			Configs: map[string]string{},
+			IsValid: false,
+			Message: "missing credentials",
+		},
+		{
+			Configs: credentials(map[string]string{}),
+			IsValid: true,
+			Message: "default environment",
+		},
+		{
+			Configs: credentials(map[string]string{"environment": "production"}),
+			IsValid: true,
+			Message: "production environment",
+		},
+		{
+			Configs: credentials(map[string]string{"environment": "sandbox"}),
+			IsValid: true,
+			Message: "sandbox environment",
+		},
+		{
+			Configs: credentials(map[string]string{"environment": "test"}),
+			IsValid: true,
+			Message: "test environment",
+		},
+		{
+			Configs: credentials(map[string]string{"environment": "Sandbox"}),
+			IsValid: true,
+			Message: "environment is case insensitive",
+		},
+		{
+			Configs: credentials(map[string]string{"environment": "staging"}),
+			IsValid: false,
+			Message: "unknown environment",
+		},
+		{
+			Configs: credentials(map[string]string{"environment": "https://rest.avatax.com"}),
+			IsValid: false,
+			Message: "URL as environment",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "https://eu.rest.avatax.com"}),
+			IsValid: true,
+			Message: "https base URL",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "https://proxy.example.com:8443/avatax/"}),
+			IsValid: true,
+			Message: "https base URL with port and path",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "http://localhost:8080"}),
+			IsValid: true,
+			Message: "http base URL on localhost",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "http://127.0.0.1:8080"}),
+			IsValid: true,
+			Message: "http base URL on IPv4 loopback",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "http://[::1]:8080"}),
+			IsValid: true,
+			Message: "http base URL on IPv6 loopback",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "http://rest.avatax.com"}),
+			IsValid: false,
+			Message: "http base URL on a remote host",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "ftp://rest.avatax.com"}),
+			IsValid: false,
+			Message: "unsupported base URL scheme",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "rest.avatax.com"}),
+			IsValid: false,
+			Message: "base URL without scheme",
+		},
+		{
+			Configs: credentials(map[string]string{"base-url": "https://rest.avatax.com?debug=true"}),
+			IsValid: false,
+			Message: "base URL with query",
+		},
+		{
+			Configs: credentials(map[string]string{"account-id": "123456789"}),
+			IsValid: true,
+			Message: "account ID override",
+		},
+		{
+			Configs: credentials(map[string]string{"account-id": "-1"}),
+			IsValid: false,
+			Message: "negative account ID",
+		},
+		{
+			Configs: credentials(map[string]string{"page-size": "0"}),
+			IsValid: false,
+			Message: "zero page size",
+		},
+		{
+			Configs: credentials(map[string]string{"entitlement-concurrency": "0"}),
+			IsValid: false,
+			Message: "zero entitlement concurrency",
+		},
+		{
+			Configs: credentials(map[string]string{"full-sync-interval": "-1"}),
+			IsValid: false,
+			Message: "negative full sync interval",
+		},
+		{
+			Configs: credentials(map[string]string{"include-account-ids": "123456789"}),
+			IsValid: true,
+			Message: "account ID scope",
+		},
+		{
+			Configs: credentials(map[string]string{"exclude-company-ids": "abc"}),
+			IsValid: false,
+			Message: "non-numeric company ID",
+		},
+		{
+			Configs: map[string]string{"tenants-file": tenantsFile(`[
+				{"name": "parent", "username": "parentuser", "password": "parentpass"},
+				{"name": "subsidiary", "environment": "sandbox", "username": "subuser", "passwordEnv": "SUBSIDIARY_PASSWORD"}
+			]`)},
+			IsValid: true,
+			Message: "tenants file",
+		},
+		{
+			Configs: credentials(map[string]string{"tenants-file": tenantsFile(`[{"name": "parent", "username": "u", "password": "p"}]`)}),
+			IsValid: false,
+			Message: "tenants file with credentials",
+		},
+		{
+			Configs: map[string]string{"tenants-file": filepath.Join(t.TempDir(), "missing.json")},
+			IsValid: false,
+			Message: "missing tenants file",
+		},
+		{
+			Configs: map[string]string{"tenants-file": tenantsFile(`[]`)},
+			IsValid: false,
+			Message: "empty tenants file",
+		},
+		{
+			Configs: map[string]string{"tenants-file": tenantsFile(`[
+				{"name": "parent", "username": "u", "password": "p"},
+				{"name": "parent", "username": "u2", "password": "p2"}
+			]`)},
+			IsValid: false,
+			Message: "duplicate tenant names",
+		},
+		{
+			Configs: map[string]string{"tenants-file": tenantsFile(`[{"name": "a/b", "username": "u", "password": "p"}]`)},
+			IsValid: false,
+			Message: "tenant name with slash",
+		},
+		{
+			Configs: map[string]string{"tenants-file": tenantsFile(`[{"name": "parent", "username": "u", "passwordEnv": "UNSET_PASSWORD"}]`)},
+			IsValid: false,
+			Message: "tenant password variable unset",
+		},
+		{
+			Configs: map[string]string{"tenants-file": tenantsFile(`[{"name": "parent", "environment": "staging", "username": "u", "password": "p"}]`)},
+			IsValid: false,
+			Message: "unknown tenant environment",
+		},
+		{
+			Configs: map[string]string{"tenants-file": tenantsFile(`[{"name": "parent", "baseUrl": "http://rest.avatax.com", "username": "u", "password": "p"}]`)},
+			IsValid: false,
+			Message: "tenant base URL on a remote host",
+		},
+		{
+			Configs: credentials(map[string]string{"proxy-url": "http://proxy.example.com:3128"}),
+			IsValid: true,
+			Message: "http proxy",
+		},
+		{
+			Configs: credentials(map[string]string{"proxy-url": "ftp://proxy.example.com"}),
+			IsValid: false,
+			Message: "unsupported proxy scheme",
+		},
+		{
+			Configs: credentials(map[string]string{"ca-bundle-path": certPath}),
+			IsValid: true,
+			Message: "CA bundle",
+		},
+		{
+			Configs: credentials(map[string]string{"ca-bundle-path": filepath.Join(t.TempDir(), "missing.pem")}),
+			IsValid: false,
+			Message: "unreadable CA bundle",
+		},
+		{
+			Configs: credentials(map[string]string{"ca-bundle-path": keyPath}),
+			IsValid: false,
+			Message: "CA bundle without certificates",
+		},
+		{
+			Configs: credentials(map[string]string{"client-cert-path": certPath, "client-key-path": keyPath}),
+			IsValid: true,
+			Message: "client certificate",
+		},
+		{
+			Configs: credentials(map[string]string{"client-cert-path": certPath}),
+			IsValid: false,
+			Message: "client certificate without key",
+		},
+		{
+			Configs: credentials(map[string]string{"client-cert-path": keyPath, "client-key-path": certPath}),
+			IsValid: false,
+			Message: "swapped client certificate and key",
+		},
 	}
 
 	test.ExerciseTestCases(t, configurationSchema, ValidateConfig, testCases)
 }
+
+// writeCertificate writes a self-signed certificate and its key as PEM files.
+func writeCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected to generate a key, got %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "baton-avalara"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Expected to create a certificate, got %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Expected to marshal the key, got %v", err)
+	}
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatalf("Expected to write the certificate, got %v", err)
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatalf("Expected to write the key, got %v", err)
+	}
+
+	return certPath, keyPath
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/conductorone/baton-avalara/pkg/connector"
+	"github.com/conductorone/baton-sdk/pkg/field"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// newDoctorCommand returns the doctor subcommand, which checks the configured credentials
+// against every Avalara API endpoint the connector uses.
+func newDoctorCommand(ctx context.Context, v *viper.Viper) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose credentials and Avalara API permissions",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := v.BindPFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+
+			connectorConfig, err := newConnectorConfig(v)
+			if err != nil {
+				return err
+			}
+
+			cb, err := connector.New(ctx, connectorConfig)
+			if err != nil {
+				return err
+			}
+
+			diagnoses := cb.Diagnose(ctx)
+			err = printDiagnoses(cmd.OutOrStdout(), diagnoses)
+			if err != nil {
+				return err
+			}
+
+			for _, diagnosis := range diagnoses {
+				for _, check := range diagnosis.Checks {
+					if check.Result != connector.CheckOK {
+						return fmt.Errorf("some Avalara API endpoints cannot be used with the configured credentials")
+					}
+				}
+			}
+			return nil
+		},
+	}
+
+	err := addConfigurationFlags(cmd, ConfigurationFields)
+	if err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+// addConfigurationFlags registers a flag for each configuration field, as the SDK does for its own subcommands.
+func addConfigurationFlags(cmd *cobra.Command, fields []field.SchemaField) error {
+	for _, f := range fields {
+		switch f.GetType() {
+		case reflect.Bool:
+			value, err := f.Bool()
+			if err != nil {
+				return err
+			}
+			cmd.Flags().Bool(f.FieldName, value, f.GetDescription())
+		case reflect.Int:
+			value, err := f.Int()
+			if err != nil {
+				return err
+			}
+			cmd.Flags().Int(f.FieldName, value, f.GetDescription())
+		case reflect.String:
+			value, err := f.String()
+			if err != nil {
+				return err
+			}
+			cmd.Flags().String(f.FieldName, value, f.GetDescription())
+		case reflect.Slice:
+			value, err := f.StringSlice()
+			if err != nil {
+				return err
+			}
+			cmd.Flags().StringSlice(f.FieldName, value, f.GetDescription())
+		default:
+			return fmt.Errorf("field %s, %s is not supported", f.FieldName, f.GetType())
+		}
+	}
+	return nil
+}
+
+func printDiagnoses(out io.Writer, diagnoses []*connector.Diagnosis) error {
+	for i, diagnosis := range diagnoses {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+
+		fmt.Fprintf(out, "Tenant:        %s\n", diagnosis.Tenant)
+		fmt.Fprintf(out, "Account:       %s\n", valueOrUnknown(strconv.Itoa(diagnosis.AccountID), diagnosis.AccountID != 0))
+		fmt.Fprintf(out, "User:          %s\n", valueOrUnknown(diagnosis.UserName, diagnosis.UserName != ""))
+		fmt.Fprintf(out, "Security role: %s\n", valueOrUnknown(diagnosis.SecurityRole, diagnosis.SecurityRole != ""))
+		fmt.Fprintf(out, "Access level:  %s\n\n", valueOrUnknown(diagnosis.AccessLevel, diagnosis.AccessLevel != ""))
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ENDPOINT\tRESULT\tSTATUS\tCORRELATION ID\tDETAIL")
+		for _, check := range diagnosis.Checks {
+			status := "-"
+			if check.StatusCode != 0 {
+				status = strconv.Itoa(check.StatusCode)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", check.Endpoint, check.Result, status, valueOrDash(check.CorrelationID), valueOrDash(check.Detail))
+		}
+		err := w.Flush()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "\nRecommendation: %s\n", diagnosis.Recommendation)
+	}
+	return nil
+}
+
+func valueOrUnknown(value string, known bool) string {
+	if !known {
+		return "unknown"
+	}
+	return value
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
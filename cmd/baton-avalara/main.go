@@ -4,14 +4,18 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/conductorone/baton-avalara/pkg/connector"
 	"github.com/conductorone/baton-sdk/pkg/config"
 	"github.com/conductorone/baton-sdk/pkg/connectorbuilder"
 	"github.com/conductorone/baton-sdk/pkg/field"
+	"github.com/conductorone/baton-sdk/pkg/metrics"
 	"github.com/conductorone/baton-sdk/pkg/types"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 )
 
@@ -20,7 +24,7 @@ var version = "dev"
 func main() {
 	ctx := context.Background()
 
-	_, cmd, err := config.DefineConfiguration(
+	v, cmd, err := config.DefineConfiguration(
 		ctx,
 		"baton-avalara",
 		getConnector,
@@ -35,6 +39,13 @@ func main() {
 
 	cmd.Version = version
 
+	doctorCmd, err := newDoctorCommand(ctx, v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	cmd.AddCommand(doctorCmd)
+
 	err = cmd.Execute()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -45,22 +56,22 @@ func main() {
 func getConnector(ctx context.Context, cfg *viper.Viper) (types.ConnectorServer, error) {
 	l := ctxzap.Extract(ctx)
 
-	environment := cfg.GetString("environment")
-	username := cfg.GetString("username")
-	password := cfg.GetString("password")
+	connectorConfig, err := newConnectorConfig(cfg)
+	if err != nil {
+		l.Error("invalid configuration", zap.Error(err))
+		return nil, err
+	}
 
-	cb, err := connector.New(
-		ctx,
-		environment,
-		username,
-		password,
-	)
+	metricsHandler := metrics.NewOtelHandler(ctx, otel.GetMeterProvider(), "baton-avalara")
+	connectorConfig.MetricsHandler = metricsHandler
+
+	cb, err := connector.New(ctx, connectorConfig)
 	if err != nil {
 		l.Error("error creating connector", zap.Error(err))
 		return nil, err
 	}
 
-	connector, err := connectorbuilder.NewConnector(ctx, cb)
+	connector, err := connectorbuilder.NewConnector(ctx, cb, connectorbuilder.WithMetricsHandler(metricsHandler))
 	if err != nil {
 		l.Error("error creating connector", zap.Error(err))
 		return nil, err
@@ -68,3 +79,54 @@ func getConnector(ctx context.Context, cfg *viper.Viper) (types.ConnectorServer,
 
 	return connector, nil
 }
+
+// newConnectorConfig validates the configuration and converts it into the connector's settings.
+func newConnectorConfig(cfg *viper.Viper) (connector.Config, error) {
+	err := ValidateConfig(cfg)
+	if err != nil {
+		return connector.Config{}, err
+	}
+
+	ids := make(map[string][]int)
+	for _, f := range idListFields {
+		parsed, err := parseIDs(cfg.GetStringSlice(f.FieldName))
+		if err != nil {
+			return connector.Config{}, fmt.Errorf("invalid %s: %w", f.FieldName, err)
+		}
+		ids[f.FieldName] = parsed
+	}
+
+	var tenants []connector.TenantConfig
+	if tenantsFile := cfg.GetString("tenants-file"); tenantsFile != "" {
+		tenants, err = loadTenants(tenantsFile)
+		if err != nil {
+			return connector.Config{}, fmt.Errorf("invalid tenants-file: %w", err)
+		}
+	}
+
+	return connector.Config{
+		Environment:            strings.ToLower(cfg.GetString("environment")),
+		BaseURL:                cfg.GetString("base-url"),
+		AccountID:              cfg.GetInt("account-id"),
+		Username:               cfg.GetString("username"),
+		Password:               cfg.GetString("password"),
+		DryRun:                 cfg.GetBool("dry-run"),
+		UserSyncStatePath:      cfg.GetString("user-sync-state-path"),
+		FullSyncInterval:       time.Duration(cfg.GetInt("full-sync-interval")) * time.Hour,
+		EntitlementConcurrency: cfg.GetInt("entitlement-concurrency"),
+		PageSize:               cfg.GetInt("page-size"),
+		AdaptivePageSize:       cfg.GetBool("adaptive-page-size"),
+		AllowedHosts:           cfg.GetStringSlice("allowed-hosts"),
+		ProxyURL:               cfg.GetString("proxy-url"),
+		CABundlePath:           cfg.GetString("ca-bundle-path"),
+		ClientCertPath:         cfg.GetString("client-cert-path"),
+		ClientKeyPath:          cfg.GetString("client-key-path"),
+		IncludeAccountIDs:      ids[IncludeAccountIDsField.FieldName],
+		ExcludeAccountIDs:      ids[ExcludeAccountIDsField.FieldName],
+		IncludeCompanyIDs:      ids[IncludeCompanyIDsField.FieldName],
+		ExcludeCompanyIDs:      ids[ExcludeCompanyIDsField.FieldName],
+		SyncInactiveUsers:      cfg.GetBool("sync-inactive-users"),
+		SyncDeletedUsers:       cfg.GetBool("sync-deleted-users"),
+		Tenants:                tenants,
+	}, nil
+}
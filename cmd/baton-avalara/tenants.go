@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/conductorone/baton-avalara/pkg/connector"
+)
+
+// tenantFileEntry is one named set of credentials in the tenants file.
+type tenantFileEntry struct {
+	Name        string `json:"name"`
+	Environment string `json:"environment"`
+	BaseURL     string `json:"baseUrl"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	// PasswordEnv names an environment variable to read the password from, keeping it out of the file.
+	PasswordEnv string `json:"passwordEnv"`
+	AccountID   int    `json:"accountId"`
+}
+
+// loadTenants reads and validates the tenants file.
+func loadTenants(path string) ([]connector.TenantConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []tenantFileEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a JSON list of tenants: %w", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s lists no tenants", path)
+	}
+
+	tenants := make([]connector.TenantConfig, 0, len(entries))
+	names := make(map[string]bool, len(entries))
+	for i, entry := range entries {
+		tenant, err := entry.tenantConfig()
+		if err != nil {
+			return nil, fmt.Errorf("tenant %d: %w", i+1, err)
+		}
+		if names[tenant.Name] {
+			return nil, fmt.Errorf("tenant %d: duplicate name %q", i+1, tenant.Name)
+		}
+		names[tenant.Name] = true
+		tenants = append(tenants, tenant)
+	}
+
+	return tenants, nil
+}
+
+func (e *tenantFileEntry) tenantConfig() (connector.TenantConfig, error) {
+	name := strings.TrimSpace(e.Name)
+	if name == "" {
+		return connector.TenantConfig{}, fmt.Errorf("name is required")
+	}
+	// Tenant names prefix resource IDs, separated by a slash.
+	if strings.Contains(name, "/") {
+		return connector.TenantConfig{}, fmt.Errorf("name %q must not contain a slash", name)
+	}
+
+	password := e.Password
+	if e.PasswordEnv != "" {
+		password = os.Getenv(e.PasswordEnv)
+	}
+	if e.Username == "" || password == "" {
+		return connector.TenantConfig{}, fmt.Errorf("%s: both username and password are required", name)
+	}
+
+	environment := strings.ToLower(e.Environment)
+	if environment == "" {
+		environment = "production"
+	}
+	if !slices.Contains(environments, environment) {
+		return connector.TenantConfig{}, fmt.Errorf("%s: invalid environment: must be one of %s", name, strings.Join(environments, ", "))
+	}
+
+	if e.BaseURL != "" {
+		err := validateBaseURL(e.BaseURL)
+		if err != nil {
+			return connector.TenantConfig{}, fmt.Errorf("%s: invalid baseUrl: %w", name, err)
+		}
+	}
+
+	if e.AccountID < 0 {
+		return connector.TenantConfig{}, fmt.Errorf("%s: invalid accountId: must not be negative", name)
+	}
+
+	return connector.TenantConfig{
+		Name:        name,
+		Environment: environment,
+		BaseURL:     e.BaseURL,
+		Username:    e.Username,
+		Password:    password,
+		AccountID:   e.AccountID,
+	}, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault kinds the test server can inject.
+const (
+	// faultRateLimit responds 429 with a Retry-After header.
+	faultRateLimit = "rate-limit"
+	// faultError responds with a server error, 500 unless the fault sets a status.
+	faultError = "error"
+	// faultLatency delays the request and then serves it normally.
+	faultLatency = "latency"
+	// faultMalformedJSON responds 200 with a body that is not valid JSON.
+	faultMalformedJSON = "malformed-json"
+	// faultTruncatedJSON serves the request but cuts the response body off half way.
+	faultTruncatedJSON = "truncated-json"
+	// faultWrongContentType serves the request with an HTML content type.
+	faultWrongContentType = "wrong-content-type"
+	// faultConnectionReset closes the connection without responding.
+	faultConnectionReset = "connection-reset"
+	// faultExpiredAuth responds 401 as though the credentials had expired.
+	faultExpiredAuth = "expired-auth"
+)
+
+// fault describes one kind of failure and which requests it applies to. A fault applies to
+// requests whose path starts with Endpoint, or to every request when Endpoint is empty.
+// Among those, it skips the first After, then fires on every Every-th request until it has
+// fired Count times. So {"after": 2, "count": 3} fails the third to fifth requests, a burst,
+// and {"every": 4} fails every fourth request indefinitely.
+type fault struct {
+	Kind     string `json:"kind"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Method   string `json:"method,omitempty"`
+	After    int    `json:"after,omitempty"`
+	Every    int    `json:"every,omitempty"`
+	Count    int    `json:"count,omitempty"`
+	// Status is the status of an error fault.
+	Status int `json:"status,omitempty"`
+	// RetryAfter is the Retry-After of a rate-limit fault, in seconds.
+	RetryAfter int `json:"retryAfter,omitempty"`
+	// Latency is how long a latency fault delays requests, such as "250ms".
+	Latency string `json:"latency,omitempty"`
+
+	// Matched and Fired count the requests the fault applied to and the times it fired.
+	Matched int `json:"matched"`
+	Fired   int `json:"fired"`
+
+	latency time.Duration
+}
+
+func (f *fault) validate() error {
+	switch f.Kind {
+	case faultRateLimit, faultMalformedJSON, faultTruncatedJSON, faultWrongContentType, faultConnectionReset, faultExpiredAuth:
+	case faultError:
+		if f.Status == 0 {
+			f.Status = http.StatusInternalServerError
+		}
+		if f.Status < 500 || f.Status > 599 {
+			return fmt.Errorf("error faults need a 5xx status, got %d", f.Status)
+		}
+	case faultLatency:
+		d, err := time.ParseDuration(f.Latency)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("latency faults need a positive latency such as \"250ms\", got %q", f.Latency)
+		}
+		f.latency = d
+	default:
+		return fmt.Errorf("unknown fault kind %q", f.Kind)
+	}
+
+	if f.After < 0 || f.Every < 0 || f.Count < 0 || f.RetryAfter < 0 {
+		return fmt.Errorf("%s fault: after, every, count and retryAfter cannot be negative", f.Kind)
+	}
+	if f.Every == 0 {
+		f.Every = 1
+	}
+	return nil
+}
+
+// fire records a request the fault may apply to, and reports whether the fault fires for it.
+func (f *fault) fire(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, f.Endpoint) || f.Method != "" && !strings.EqualFold(f.Method, r.Method) {
+		return false
+	}
+
+	f.Matched++
+	n := f.Matched - f.After
+	if n <= 0 || n%f.Every != 0 || f.Count > 0 && f.Fired >= f.Count {
+		return false
+	}
+	f.Fired++
+	return true
+}
+
+// faultInjector holds the configured faults. It is safe for concurrent use.
+type faultInjector struct {
+	mu     sync.Mutex
+	faults []*fault
+}
+
+// parseFaults decodes and validates a JSON list of faults.
+func parseFaults(data []byte) ([]*fault, error) {
+	var faults []*fault
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&faults)
+	if err != nil {
+		return nil, fmt.Errorf("faults must be a JSON list: %w", err)
+	}
+
+	for _, f := range faults {
+		err := f.validate()
+		if err != nil {
+			return nil, err
+		}
+		f.Matched, f.Fired = 0, 0
+	}
+	return faults, nil
+}
+
+// faultsFromEnv reads faults from the FAULTS environment variable, which holds the same JSON
+// list as the control endpoint accepts.
+func faultsFromEnv() ([]*fault, error) {
+	value := os.Getenv("FAULTS")
+	if value == "" {
+		return nil, nil
+	}
+	return parseFaults([]byte(value))
+}
+
+func (i *faultInjector) set(faults []*fault) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.faults = faults
+}
+
+func (i *faultInjector) list() []fault {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	faults := make([]fault, 0, len(i.faults))
+	for _, f := range i.faults {
+		faults = append(faults, *f)
+	}
+	return faults
+}
+
+// match returns the total latency to add to a request, and the first other fault that fires for it.
+func (i *faultInjector) match(r *http.Request) (time.Duration, *fault) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var latency time.Duration
+	var fired *fault
+	for _, f := range i.faults {
+		if f.Kind == faultLatency {
+			if f.fire(r) {
+				latency += f.latency
+			}
+			continue
+		}
+		if fired == nil && f.fire(r) {
+			fired = f
+		}
+	}
+	return latency, fired
+}
+
+// middleware injects the configured faults into requests before they reach next.
+func (i *faultInjector) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		latency, f := i.match(r)
+		if latency > 0 {
+			log.Printf("Injecting %s latency into %s %s", latency, r.Method, r.URL.Path)
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Printf("Injecting %s fault into %s %s", f.Kind, r.Method, r.URL.Path)
+		switch f.Kind {
+		case faultRateLimit:
+			w.Header().Set("Retry-After", strconv.Itoa(f.RetryAfter))
+			sendErrorResponse(w, http.StatusTooManyRequests, "TooManyRequests", "Too many requests, slow down", "HttpRequest",
+				[]string{fmt.Sprintf("Retry after %d seconds.", f.RetryAfter)})
+		case faultError:
+			sendErrorResponse(w, f.Status, "ServerError", http.StatusText(f.Status), "HttpRequest",
+				[]string{"The server encountered an injected error."})
+		case faultExpiredAuth:
+			sendErrorResponse(w, http.StatusUnauthorized, "AuthenticationException", "Authentication failed", "HttpRequest",
+				[]string{"The credentials have expired."})
+		case faultMalformedJSON:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"value": [{"id": 1,, "@nextLink": }`))
+		case faultTruncatedJSON:
+			rec := serveBuffered(next, r)
+			copyHeader(w.Header(), rec.header)
+			w.WriteHeader(rec.status)
+			_, _ = w.Write(rec.body.Bytes()[:rec.body.Len()/2])
+		case faultWrongContentType:
+			rec := serveBuffered(next, r)
+			copyHeader(w.Header(), rec.header)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(rec.status)
+			_, _ = w.Write(rec.body.Bytes())
+		case faultConnectionReset:
+			resetConnection(w)
+		}
+	})
+}
+
+// bufferedResponse captures a response so a fault can alter it before it is sent.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func serveBuffered(next http.Handler, r *http.Request) *bufferedResponse {
+	rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+	return rec
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = values
+	}
+}
+
+// resetConnection closes the client's connection without a response. Lingering is disabled
+// so the client sees a reset rather than an orderly close.
+func resetConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		sendErrorResponse(w, http.StatusInternalServerError, "ServerError", "Connection resets are not supported", "HttpRequest", nil)
+		return
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection: %v", err)
+		return
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// handleFaults lists the configured faults with their counts on GET, replaces them with a
+// JSON list on PUT or POST, and removes them on DELETE.
+func (i *faultInjector) handleFaults(w http.ResponseWriter, r *http.Request) {
+	logRequest("/testing/faults", r)
+
+	switch r.Method {
+	case http.MethodGet:
+		sendJSONResponse(w, i.list())
+	case http.MethodPut, http.MethodPost:
+		var body bytes.Buffer
+		_, err := body.ReadFrom(r.Body)
+		if err != nil {
+			sendAPIError(w, invalidField("JsonFormatError", "HttpRequest", err.Error()))
+			return
+		}
+		faults, err := parseFaults(body.Bytes())
+		if err != nil {
+			sendAPIError(w, invalidField("InvalidFault", "HttpRequest", err.Error()))
+			return
+		}
+		i.set(faults)
+		sendJSONResponse(w, i.list())
+	case http.MethodDelete:
+		i.set(nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultFixture is the fixture the test server serves unless --fixtures selects another.
+const defaultFixture = "default"
+
+// fixtures are the scenario fixtures shipped with the test server, selected by name.
+//
+//go:embed fixtures
+var fixtures embed.FS
+
+// dataset is the data the test server starts from, and returns to when it is reset.
+type dataset struct {
+	// Ping is the response of the ping endpoint, which identifies the authenticated user and account.
+	Ping          record   `json:"ping" yaml:"ping"`
+	Accounts      []record `json:"accounts" yaml:"accounts"`
+	Companies     []record `json:"companies" yaml:"companies"`
+	Users         []record `json:"users" yaml:"users"`
+	SecurityRoles []record `json:"securityRoles" yaml:"securityRoles"`
+	Permissions   []string `json:"permissions" yaml:"permissions"`
+	// Entitlements are keyed by userId. Users without an entry have DefaultEntitlements.
+	Entitlements        []record `json:"entitlements" yaml:"entitlements"`
+	DefaultEntitlements record   `json:"defaultEntitlements" yaml:"defaultEntitlements"`
+	AuditEvents         []record `json:"auditEvents" yaml:"auditEvents"`
+}
+
+// defaultDataset returns the default fixture. It panics if the embedded fixture is invalid.
+func defaultDataset() *dataset {
+	d, err := loadFixture(defaultFixture)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// loadFixture loads a dataset from a fixture. A bare name such as "firm-account" selects a
+// shipped fixture, "synthetic:..." generates a dataset, and anything else is the path of a
+// JSON or YAML file.
+func loadFixture(nameOrPath string) (*dataset, error) {
+	if nameOrPath == syntheticPrefix || strings.HasPrefix(nameOrPath, syntheticPrefix+":") {
+		return loadSynthetic(strings.TrimPrefix(strings.TrimPrefix(nameOrPath, syntheticPrefix), ":"))
+	}
+
+	var data []byte
+	var err error
+	name := nameOrPath
+	if strings.ContainsAny(nameOrPath, `/\`) || filepath.Ext(nameOrPath) != "" {
+		data, err = os.ReadFile(nameOrPath)
+	} else {
+		name, data, err = readShippedFixture(nameOrPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := parseFixture(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("fixture %s: %w", nameOrPath, err)
+	}
+	return d, nil
+}
+
+// loadSynthetic generates a dataset, and checks it as it would a fixture.
+func loadSynthetic(options string) (*dataset, error) {
+	cfg, err := parseGeneratorConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	d := generateDataset(cfg)
+	err = d.validate()
+	if err != nil {
+		return nil, fmt.Errorf("synthetic dataset: %w", err)
+	}
+	d.applyDefaults()
+	return d, nil
+}
+
+// readShippedFixture reads the shipped fixture with a name, in whichever format it is written.
+func readShippedFixture(name string) (string, []byte, error) {
+	for _, ext := range []string{".json", ".yaml", ".yml"} {
+		file := path.Join("fixtures", name+ext)
+		data, err := fixtures.ReadFile(file)
+		if err == nil {
+			return file, data, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", nil, err
+		}
+	}
+	return "", nil, fmt.Errorf("unknown fixture %q, the shipped fixtures are %s", name, strings.Join(shippedFixtures(), ", "))
+}
+
+// shippedFixtures returns the names of the fixtures shipped with the test server.
+func shippedFixtures() []string {
+	entries, _ := fixtures.ReadDir("fixtures")
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), path.Ext(entry.Name())))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseFixture decodes and validates a fixture. YAML fixtures are converted to JSON first, so
+// both formats decode to the same types and reject the same unknown fields.
+func parseFixture(name string, data []byte) (*dataset, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		var v interface{}
+		err := yaml.Unmarshal(data, &v)
+		if err != nil {
+			return nil, err
+		}
+		data, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	case ".json":
+	default:
+		return nil, fmt.Errorf("fixtures must be .json, .yaml or .yml files")
+	}
+
+	var d dataset
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&d)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.validate()
+	if err != nil {
+		return nil, err
+	}
+	d.applyDefaults()
+	return &d, nil
+}
+
+// validate checks that every record has a unique id and that the references between records
+// resolve, so a mistake in a fixture fails at startup rather than as a confusing response.
+func (d *dataset) validate() error {
+	accounts, err := recordIDs("account", d.Accounts)
+	if err != nil {
+		return err
+	}
+	companies, err := recordIDs("company", d.Companies)
+	if err != nil {
+		return err
+	}
+	users, err := recordIDs("user", d.Users)
+	if err != nil {
+		return err
+	}
+	if _, err := recordIDs("security role", d.SecurityRoles); err != nil {
+		return err
+	}
+	if _, err := recordIDs("audit event", d.AuditEvents); err != nil {
+		return err
+	}
+
+	roles := make(map[string]bool, len(d.SecurityRoles))
+	for _, role := range d.SecurityRoles {
+		roles[role.stringField("description")] = true
+	}
+
+	accountID, _ := d.Ping.intField("authenticatedAccountId")
+	if !accounts[accountID] {
+		return fmt.Errorf("ping: authenticatedAccountId %v is not an account", d.Ping["authenticatedAccountId"])
+	}
+	if _, ok := d.Ping.intField("authenticatedUserId"); !ok {
+		return fmt.Errorf("ping: authenticatedUserId is required")
+	}
+
+	for _, c := range d.Companies {
+		if err := checkAccount("company", c, accounts); err != nil {
+			return err
+		}
+	}
+	for _, u := range d.Users {
+		if err := checkAccount("user", u, accounts); err != nil {
+			return err
+		}
+		if companyID, ok := u.intField("companyId"); ok && !companies[companyID] {
+			return fmt.Errorf("user %v: companyId %d is not a company", u["id"], companyID)
+		}
+		if role := u.stringField("securityRoleId"); role != "" && !roles[role] {
+			return fmt.Errorf("user %v: securityRoleId %q is not a security role", u["id"], role)
+		}
+	}
+	for _, e := range d.AuditEvents {
+		if err := checkAccount("audit event", e, accounts); err != nil {
+			return err
+		}
+	}
+	for _, e := range d.Entitlements {
+		userID, ok := e.intField("userId")
+		if !ok || !users[userID] {
+			return fmt.Errorf("entitlements: userId %v is not a user", e["userId"])
+		}
+	}
+	return nil
+}
+
+// applyDefaults fills in the user fields AvaTax always returns, so fixtures can leave them out.
+func (d *dataset) applyDefaults() {
+	defaults := record{
+		"isActive":             true,
+		"isDeleted":            false,
+		"suppressNewUserEmail": false,
+		"passwordStatus":       "UserCanChange",
+	}
+	for _, u := range d.Users {
+		for k, v := range defaults {
+			if _, ok := u[k]; !ok {
+				u[k] = v
+			}
+		}
+	}
+}
+
+// recordIDs returns the set of ids of records, and an error if one is missing or repeated.
+func recordIDs(entity string, records []record) (map[int]bool, error) {
+	ids := make(map[int]bool, len(records))
+	for i, r := range records {
+		id, ok := r.intField("id")
+		if !ok {
+			return nil, fmt.Errorf("%s %d: id is required", entity, i)
+		}
+		if ids[id] {
+			return nil, fmt.Errorf("%s %d: id %d is repeated", entity, i, id)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+func checkAccount(entity string, r record, accounts map[int]bool) error {
+	accountID, ok := r.intField("accountId")
+	if !ok || !accounts[accountID] {
+		return fmt.Errorf("%s %v: accountId %v is not an account", entity, r["id"], r["accountId"])
+	}
+	return nil
+}
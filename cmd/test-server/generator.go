@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syntheticPrefix selects a generated dataset instead of a fixture, as in
+// --fixtures synthetic:accounts=5,companies=200,users=50000,seed=7.
+const syntheticPrefix = "synthetic"
+
+// generatorConfig sizes a synthetic dataset. The same config always generates the same dataset.
+type generatorConfig struct {
+	Seed      int64
+	Accounts  int
+	Companies int
+	Users     int
+}
+
+var defaultGeneratorConfig = generatorConfig{Seed: 1, Accounts: 1, Companies: 10, Users: 1000}
+
+// parseGeneratorConfig parses the options of a synthetic dataset, such as "users=50000,seed=7".
+// Options that are left out take their default.
+func parseGeneratorConfig(options string) (generatorConfig, error) {
+	cfg := defaultGeneratorConfig
+	if options == "" {
+		return cfg, nil
+	}
+
+	for _, option := range strings.Split(options, ",") {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return cfg, fmt.Errorf("synthetic option %q must be of the form key=value", option)
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("synthetic option %q must be a number", option)
+		}
+
+		switch strings.TrimSpace(key) {
+		case "seed":
+			cfg.Seed = n
+		case "accounts":
+			cfg.Accounts = int(n)
+		case "companies":
+			cfg.Companies = int(n)
+		case "users":
+			cfg.Users = int(n)
+		default:
+			return cfg, fmt.Errorf("unknown synthetic option %q, expected seed, accounts, companies or users", key)
+		}
+	}
+
+	if cfg.Accounts < 1 || cfg.Users < 1 {
+		return cfg, fmt.Errorf("a synthetic dataset needs at least one account and one user")
+	}
+	if cfg.Companies < cfg.Accounts {
+		return cfg, fmt.Errorf("a synthetic dataset needs at least one company per account, got %d companies for %d accounts", cfg.Companies, cfg.Accounts)
+	}
+	return cfg, nil
+}
+
+// weightedRole is a security role and how often users hold it, relative to the other roles.
+type weightedRole struct {
+	role   string
+	weight int
+}
+
+// accountRoles and firmRoles approximate how roles are spread across the users of a customer
+// account and of an accounting firm. Most users are limited to their companies, a few
+// administer the account, and some have no role at all.
+var (
+	accountRoles = []weightedRole{
+		{"CompanyUser", 40}, {"AccountUser", 18}, {"CompanyAdmin", 12}, {"ECMCompanyUser", 5},
+		{"ComplianceUser", 4}, {"AccountAdmin", 4}, {"ECMAccountUser", 3}, {"TreasuryUser", 2},
+		{"ComplianceAdmin", 1}, {"TreasuryAdmin", 1}, {"SSTAdmin", 1}, {"TechnicalSupportUser", 1},
+		{"", 3},
+	}
+	firmRoles = []weightedRole{
+		{"FirmUser", 60}, {"FirmAdmin", 8}, {"AccountAdmin", 4}, {"AccountUser", 20}, {"", 3},
+	}
+)
+
+var (
+	firstNames = []string{"Ada", "Ben", "Chloe", "Dev", "Elena", "Farid", "Grace", "Hiro", "Ines", "Jonas", "Kemi", "Liam", "Maya", "Nils", "Olga", "Priya"}
+	lastNames  = []string{"Adams", "Brown", "Chen", "Diaz", "Evans", "Fischer", "Garcia", "Haddad", "Ito", "Jensen", "Kim", "Lopez", "Moreau", "Novak", "Okafor", "Patel"}
+)
+
+// generateDataset generates a dataset of the configured size, with the security roles and
+// permissions of the default fixture. The first account is the authenticated one; when there
+// are several, it is an accounting firm and the others are its clients.
+func generateDataset(cfg generatorConfig) *dataset {
+	rng := rand.New(rand.NewSource(cfg.Seed)) //nolint:gosec // Synthetic data does not need a secure generator.
+	base := defaultDataset()
+	epoch := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	d := &dataset{
+		SecurityRoles: base.SecurityRoles,
+		Permissions:   base.Permissions,
+		DefaultEntitlements: record{
+			"permissions": []interface{}{"CompanyFetch"},
+			"accessLevel": "SingleCompany",
+			"companies":   []interface{}{},
+		},
+	}
+
+	firm := cfg.Accounts > 1
+	accountIDs := make([]int, cfg.Accounts)
+	for i := range accountIDs {
+		accountIDs[i] = 300000001 + i
+		accountType := "Regular"
+		if firm {
+			accountType = "FirmClient"
+			if i == 0 {
+				accountType = "Firm"
+			}
+		}
+		d.Accounts = append(d.Accounts, record{
+			"id":              accountIDs[i],
+			"name":            fmt.Sprintf("Synthetic Account %d", i+1),
+			"effectiveDate":   epoch.AddDate(0, 0, rng.Intn(365)).Format(avalaraTimeLayout),
+			"accountStatusId": "Active",
+			"accountTypeId":   accountType,
+			"isSamlEnabled":   rng.Intn(4) == 0,
+			"isDeleted":       false,
+		})
+	}
+
+	// Every account has a company, and the rest are spread at random.
+	companies := make([][]int, cfg.Accounts)
+	for i := 0; i < cfg.Companies; i++ {
+		account := i
+		if i >= cfg.Accounts {
+			account = rng.Intn(cfg.Accounts)
+		}
+		id := 400001 + i
+		companies[account] = append(companies[account], id)
+		d.Companies = append(d.Companies, record{
+			"id":          id,
+			"accountId":   accountIDs[account],
+			"companyCode": fmt.Sprintf("CO%05d", i+1),
+			"name":        fmt.Sprintf("Synthetic Company %d", i+1),
+			"isActive":    rng.Intn(20) != 0,
+		})
+	}
+
+	// Firm users manage the companies of the client accounts.
+	var clientCompanies []int
+	for _, ids := range companies[1:] {
+		clientCompanies = append(clientCompanies, ids...)
+	}
+
+	for i := 0; i < cfg.Users; i++ {
+		id := 500001 + i
+		account := rng.Intn(cfg.Accounts)
+		roles := accountRoles
+		if firm && account == 0 {
+			roles = firmRoles
+		}
+		role := pickRole(rng, roles)
+		// The authenticated user administers the first account.
+		if i == 0 {
+			account, role = 0, "AccountAdmin"
+			if firm {
+				role = "FirmAdmin"
+			}
+		}
+
+		first, last := firstNames[rng.Intn(len(firstNames))], lastNames[rng.Intn(len(lastNames))]
+		userName := fmt.Sprintf("%s.%s%d", strings.ToLower(first), strings.ToLower(last), id)
+		created := epoch.Add(time.Duration(rng.Int63n(int64(4 * 365 * 24 * time.Hour))))
+		modified := created.Add(time.Duration(rng.Int63n(int64(365 * 24 * time.Hour))))
+		deleted := i != 0 && rng.Intn(50) == 0
+		active := i == 0 || !deleted && rng.Intn(20) != 0
+
+		user := record{
+			"id":                   id,
+			"accountId":            accountIDs[account],
+			"companyId":            companies[account][rng.Intn(len(companies[account]))],
+			"userName":             userName,
+			"firstName":            first,
+			"lastName":             last,
+			"email":                userName + "@example.com",
+			"postalCode":           fmt.Sprintf("%05d", 10000+rng.Intn(89999)),
+			"passwordStatus":       "UserCanChange",
+			"isActive":             active,
+			"suppressNewUserEmail": false,
+			"isDeleted":            deleted,
+			"createdDate":          created.Format(avalaraTimeLayout),
+			"modifiedDate":         modified.Format(avalaraTimeLayout),
+		}
+		if role != "" {
+			user["securityRoleId"] = role
+		}
+		d.Users = append(d.Users, user)
+
+		if e := generateEntitlements(rng, d.Permissions, user, role, companies[account], clientCompanies); e != nil {
+			d.Entitlements = append(d.Entitlements, e)
+		}
+
+		// Roughly one user in ten has a recent audit event.
+		if rng.Intn(10) == 0 {
+			eventType := "UserLogin"
+			if rng.Intn(3) == 0 {
+				eventType = "UserUpdated"
+			}
+			d.AuditEvents = append(d.AuditEvents, record{
+				"id":        len(d.AuditEvents) + 1,
+				"accountId": accountIDs[account],
+				"eventType": eventType,
+				"timestamp": modified.Format(avalaraTimeLayout),
+				"userId":    id,
+				"userName":  userName,
+			})
+		}
+	}
+
+	admin := d.Users[0]
+	d.Ping = record{
+		"version":                base.Ping["version"],
+		"authenticated":          true,
+		"authenticationType":     "Basic",
+		"authenticatedUserName":  admin["userName"],
+		"authenticatedUserId":    admin["id"],
+		"authenticatedAccountId": accountIDs[0],
+		"crmid":                  "synthetic",
+	}
+	return d
+}
+
+func pickRole(rng *rand.Rand, roles []weightedRole) string {
+	total := 0
+	for _, r := range roles {
+		total += r.weight
+	}
+	n := rng.Intn(total)
+	for _, r := range roles {
+		if n < r.weight {
+			return r.role
+		}
+		n -= r.weight
+	}
+	return roles[len(roles)-1].role
+}
+
+// generateEntitlements returns the entitlements of a user, or nil for users who have the
+// default entitlements. Administrators have every permission, users limited to companies
+// have a few of their account's companies, and firm users have some of the client companies.
+func generateEntitlements(rng *rand.Rand, allPermissions []string, user record, role string, accountCompanies, clientCompanies []int) record {
+	if role == "" {
+		return nil
+	}
+
+	var permissions []interface{}
+	for _, p := range allPermissions {
+		if strings.HasSuffix(role, "Admin") || strings.HasSuffix(p, "Fetch") || rng.Intn(3) == 0 {
+			permissions = append(permissions, p)
+		}
+	}
+
+	accessLevel := "SingleAccount"
+	var ids []int
+	switch {
+	case strings.HasPrefix(role, "Firm"):
+		accessLevel = "FirmManagedAccounts"
+		for _, id := range clientCompanies {
+			if role == "FirmAdmin" || rng.Intn(2) == 0 {
+				ids = append(ids, id)
+			}
+		}
+	case companyScopedRoles[role]:
+		accessLevel = "SingleCompany"
+		companyID, _ := user.intField("companyId")
+		ids = append(ids, companyID)
+		for _, id := range accountCompanies {
+			if id != companyID && rng.Intn(8) == 0 {
+				ids = append(ids, id)
+			}
+		}
+	default:
+		ids = accountCompanies
+	}
+	companyIDs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		companyIDs[i] = id
+	}
+	return record{
+		"userId":      user["id"],
+		"permissions": permissions,
+		"accessLevel": accessLevel,
+		"companies":   companyIDs,
+	}
+}
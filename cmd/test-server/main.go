@@ -4,13 +4,12 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"sort"
-	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
@@ -27,19 +26,79 @@ func getBaseURL() string {
 	return baseURL
 }
 
+// requestBaseURL returns the base URL of links in a response: BASE_URL when it is set, and
+// otherwise the address the request was sent to, so that links work wherever the server listens.
+func requestBaseURL(r *http.Request) string {
+	if os.Getenv("BASE_URL") != "" || r.Host == "" {
+		return getBaseURL()
+	}
+	return "http://" + r.Host
+}
+
 func main() {
+	fixture := flag.String("fixtures", defaultFixture,
+		fmt.Sprintf("Fixture to serve: one of %s, the path of a JSON or YAML file, or "+
+			"synthetic:accounts=N,companies=M,users=K,seed=S to generate one", strings.Join(shippedFixtures(), ", ")))
+	flag.Parse()
+
+	data, err := loadFixture(*fixture)
+	if err != nil {
+		log.Fatalf("Invalid fixture: %v", err)
+	}
+	log.Printf("Serving fixture %s\n", *fixture)
+
 	baseURL := getBaseURL()
 	log.Printf("Starting test server with base URL: %s\n", baseURL)
 
-	http.HandleFunc("/api/v2/definitions/securityroles", authMiddleware(handleSecurityRoles))
-	http.HandleFunc("/api/v2/users", authMiddleware(handleUsers))
-	http.HandleFunc("/api/v2/definitions/permissions", authMiddleware(handlePermissions))
-	http.HandleFunc("/api/v2/accounts/", authMiddleware(handleUserEntitlements))
-	http.HandleFunc("/api/v2/utilities/ping", authMiddleware(handlePing))
+	faults, err := faultsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid FAULTS: %v", err)
+	}
+	injector := &faultInjector{}
+	injector.set(faults)
+	for _, f := range faults {
+		log.Printf("Injecting %s faults into %q\n", f.Kind, f.Endpoint)
+	}
 
 	port := 8080
 	log.Printf("Starting test server on port %d...\n", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), nil)) //nolint:gosec // This is a test server.
+	log.Fatal(http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), newServeMux(newStore(data), injector))) //nolint:gosec // This is a test server.
+}
+
+// server serves the Avalara API from an in-memory store.
+type server struct {
+	store  *store
+	faults *faultInjector
+}
+
+// newServeMux registers every endpoint the test server implements. Faults are injected into
+// the API endpoints, but not into the endpoints tests use to control the server.
+func newServeMux(st *store, faults *faultInjector) *http.ServeMux {
+	s := &server{store: st, faults: faults}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/definitions/securityroles", authMiddleware(s.handleSecurityRoles))
+	mux.HandleFunc("/api/v2/users", authMiddleware(s.handleUsers))
+	mux.HandleFunc("/api/v2/definitions/permissions", authMiddleware(s.handlePermissions))
+	mux.HandleFunc("GET /api/v2/accounts/{accountId}", authMiddleware(s.handleAccount))
+	mux.HandleFunc("GET /api/v2/accounts/{accountId}/auditevents", authMiddleware(s.handleAuditEvents))
+	mux.HandleFunc("POST /api/v2/accounts/{accountId}/resetlicensekey", authMiddleware(s.handleResetLicenseKey))
+	mux.HandleFunc("GET /api/v2/accounts/{accountId}/users", authMiddleware(s.handleAccountUsers))
+	mux.HandleFunc("POST /api/v2/accounts/{accountId}/users", authMiddleware(s.handleCreateUsers))
+	mux.HandleFunc("GET /api/v2/accounts/{accountId}/users/{userId}", authMiddleware(s.handleGetUser))
+	mux.HandleFunc("PUT /api/v2/accounts/{accountId}/users/{userId}", authMiddleware(s.handleUpdateUser))
+	mux.HandleFunc("DELETE /api/v2/accounts/{accountId}/users/{userId}", authMiddleware(s.handleDeleteUser))
+	mux.HandleFunc("GET /api/v2/accounts/{accountId}/users/{userId}/entitlements", authMiddleware(s.handleUserEntitlements))
+	mux.HandleFunc("POST /api/v2/passwords/{userId}/reset", authMiddleware(s.handleResetPassword))
+	mux.HandleFunc("/api/v2/companies", authMiddleware(s.handleCompanies))
+	mux.HandleFunc("/api/v2/utilities/ping", authMiddleware(s.handlePing))
+
+	// The control endpoints are for tests, so they need no credentials.
+	control := http.NewServeMux()
+	control.Handle("/api/", faults.middleware(mux))
+	control.HandleFunc("POST /testing/reset", s.handleReset)
+	control.HandleFunc("/testing/faults", faults.handleFaults)
+	return control
 }
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -113,294 +172,126 @@ func sendAuthError(w http.ResponseWriter, message string) {
 	}
 }
 
-func handleSecurityRoles(w http.ResponseWriter, r *http.Request) {
+func (s *server) handleSecurityRoles(w http.ResponseWriter, r *http.Request) {
 	logRequest("/api/v2/definitions/securityroles", r)
 
-	// Parse query parameters.
-	queryParams := r.URL.Query()
-	filter := queryParams.Get("$filter")
-	skip, _ := strconv.Atoi(queryParams.Get("$skip"))
-
-	// Define all security roles.
-	allRoles := []map[string]interface{}{
-		{"id": 1, "description": "AccountAdmin"},
-		{"id": 2, "description": "AccountUser"},
-		{"id": 3, "description": "BatchServiceAdmin"},
-		{"id": 4, "description": "CompanyAdmin"},
-		{"id": 5, "description": "CompanyUser"},
-		{"id": 6, "description": "Compliance Root User"},
-		{"id": 7, "description": "ComplianceAdmin"},
-		{"id": 8, "description": "ComplianceUser"},
-		{"id": 9, "description": "CSPAdmin"},
-		{"id": 10, "description": "CSPTester"},
-		{"id": 11, "description": "ECMAccountUser"},
-		{"id": 12, "description": "ECMCompanyUser"},
-		{"id": 13, "description": "FirmAdmin"},
-		{"id": 14, "description": "FirmUser"},
-		{"id": 15, "description": "Registrar"},
-		{"id": 16, "description": "SiteAdmin"},
-		{"id": 17, "description": "SSTAdmin"},
-		{"id": 18, "description": "SystemAdmin"},
-		{"id": 19, "description": "TechnicalSupportAdmin"},
-		{"id": 20, "description": "TechnicalSupportUser"},
-		{"id": 21, "description": "TreasuryAdmin"},
-		{"id": 22, "description": "TreasuryUser"},
-	}
-
-	// Apply filtering if a filter is provided.
-	filteredRoles := []map[string]interface{}{}
-	if filter != "" {
-		for _, role := range allRoles {
-			if applyRoleFilter(role, filter) {
-				filteredRoles = append(filteredRoles, role)
-			}
-		}
-	} else {
-		filteredRoles = allRoles
-	}
-
-	response := map[string]interface{}{
-		"@recordsetCount": len(filteredRoles),
-		"value":           filteredRoles[skip:],
-	}
-
-	// Update nextLink only for the first request.
-	if skip == 0 && len(filteredRoles) > 0 {
-		response["@nextLink"] = fmt.Sprintf(
-			"%s/api/v2/definitions/securityroles?$skip=%d&$top=%d&$filter=%s",
-			getBaseURL(), len(filteredRoles), len(filteredRoles), filter)
+	roles, ok := queryRecords(w, r, s.store.listRoles())
+	if !ok {
+		return
 	}
-
-	sendJSONResponse(w, response)
-}
-
-// Helper function to apply filter for security roles.
-func applyRoleFilter(role map[string]interface{}, filter string) bool {
-	// Implement basic filtering logic here.
-	// For example, let's support filtering by id or description.
-	if strings.Contains(filter, "id eq") {
-		idStr := strings.TrimSpace(strings.TrimPrefix(filter, "id eq"))
-		id, err := strconv.Atoi(idStr)
-		if err == nil {
-			return role["id"] == id
-		}
-	} else if strings.Contains(filter, "description eq") {
-		description := strings.Trim(strings.TrimSpace(strings.TrimPrefix(filter, "description eq")), "'")
-		return strings.EqualFold(role["description"].(string), description)
+	start, end, nextLink, ok := paginate(w, r, len(roles))
+	if !ok {
+		return
 	}
-	// Add more filter conditions as needed.
-
-	// If no filter matches, return true (include the role).
-	return true
+	sendPage(w, roles[start:end], len(roles), nextLink)
 }
 
-func handleUsers(w http.ResponseWriter, r *http.Request) {
+func (s *server) handleUsers(w http.ResponseWriter, r *http.Request) {
 	logRequest("/api/v2/users", r)
+	sendUserList(w, r, s.store.listUsers())
+}
 
-	// Parse query parameters.
-	queryParams := r.URL.Query()
-	filter := queryParams.Get("$filter")
-	include := queryParams.Get("$include")
-	top, _ := strconv.Atoi(queryParams.Get("$top"))
-	skip, _ := strconv.Atoi(queryParams.Get("$skip"))
-	orderBy := queryParams.Get("$orderBy")
-
-	// Define all users.
-	allUsers := []map[string]interface{}{
-		{
-			"id": 12345, "accountId": 123456789, "companyId": 123456,
-			"userName": "bobExample", "firstName": "Bob", "lastName": "Example",
-			"email": "bob@example.org", "postalCode": "98110",
-			"securityRoleId": "AccountUser", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 67890, "accountId": 123456789, "companyId": 123456,
-			"userName": "aliceExample", "firstName": "Alice", "lastName": "Example",
-			"email": "alice@example.org", "postalCode": "98111",
-			"securityRoleId": "AccountAdmin", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 13579, "accountId": 123456789, "companyId": 123457,
-			"userName": "charlieExample", "firstName": "Charlie", "lastName": "Example",
-			"email": "charlie@example.org", "postalCode": "98112",
-			"securityRoleId": "CompanyUser", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 24680, "accountId": 123456789, "companyId": 123457,
-			"userName": "danaExample", "firstName": "Dana", "lastName": "Example",
-			"email": "dana@example.org", "postalCode": "98113",
-			"securityRoleId": "CompanyAdmin", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 35791, "accountId": 123456789, "companyId": 123458,
-			"userName": "eveExample", "firstName": "Eve", "lastName": "Example",
-			"email": "eve@example.org", "postalCode": "98114",
-			"securityRoleId": "SystemAdmin", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 46802, "accountId": 123456789, "companyId": 123458,
-			"userName": "frankExample", "firstName": "Frank", "lastName": "Example",
-			"email": "frank@example.org", "postalCode": "98115",
-			"securityRoleId": "TechnicalSupportAdmin", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 57913, "accountId": 123456789, "companyId": 123459,
-			"userName": "graceExample", "firstName": "Grace", "lastName": "Example",
-			"email": "grace@example.org", "postalCode": "98116",
-			"securityRoleId": "ComplianceUser", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 68024, "accountId": 123456789, "companyId": 123459,
-			"userName": "henryExample", "firstName": "Henry", "lastName": "Example",
-			"email": "henry@example.org", "postalCode": "98117",
-			"securityRoleId": "ComplianceAdmin", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 79135, "accountId": 123456789, "companyId": 123460,
-			"userName": "isabelExample", "firstName": "Isabel", "lastName": "Example",
-			"email": "isabel@example.org", "postalCode": "98118",
-			"securityRoleId": "FirmUser", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-		{
-			"id": 80246, "accountId": 123456789, "companyId": 123460,
-			"userName": "jackExample", "firstName": "Jack", "lastName": "Example",
-			"email": "jack@example.org", "postalCode": "98119",
-			"securityRoleId": "FirmAdmin", "passwordStatus": "UserCanChange",
-			"isActive": true, "suppressNewUserEmail": false, "isDeleted": false,
-		},
-	}
-
-	// Apply filtering if a filter is provided.
-	filteredUsers := []map[string]interface{}{}
-	if filter != "" {
-		for _, user := range allUsers {
-			if applyFilter(user, filter) {
-				filteredUsers = append(filteredUsers, user)
-			}
-		}
-	} else {
-		filteredUsers = allUsers
-	}
-
-	// Apply ordering if orderBy is provided.
-	if orderBy != "" {
-		sortUsers(filteredUsers, orderBy)
+// sendUserList filters, orders and pages users by the request's query parameters.
+func sendUserList(w http.ResponseWriter, r *http.Request, allUsers []record) {
+	users, ok := queryRecords(w, r, allUsers)
+	if !ok {
+		return
 	}
-
-	// Apply pagination.
-	start := skip
-	end := len(filteredUsers)
-	if top > 0 {
-		end = minCheck(start+top, end)
+	start, end, nextLink, ok := paginate(w, r, len(users))
+	if !ok {
+		return
 	}
-	paginatedUsers := filteredUsers[start:end]
+	page := users[start:end]
 
 	// Handle $include parameter.
-	if include == "FetchResult" {
-		for i, user := range paginatedUsers {
-			paginatedUsers[i] = addFetchResult(user)
+	if queryParam(r, "$include") == "FetchResult" {
+		for i, user := range page {
+			page[i] = addFetchResult(user.clone())
 		}
 	}
 
-	// Initialize the response.
-	response := map[string]interface{}{
-		"@recordsetCount": len(filteredUsers),
-		"value":           paginatedUsers,
-	}
+	sendPage(w, page, len(users), nextLink)
+}
 
-	// Update nextLink if necessary.
-	if end < len(filteredUsers) {
-		nextSkip := skip + len(paginatedUsers)
-		response["@nextLink"] = fmt.Sprintf(
-			"%s/api/v2/users?$skip=%d&$top=%d&$filter=%s&$orderBy=%s&$include=%s",
-			getBaseURL(), nextSkip, top, filter, orderBy, include)
+func (s *server) handlePermissions(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/definitions/permissions", r)
+	// Permissions are plain strings, with no fields to filter or order by.
+	if queryParam(r, "$filter") != "" || queryParam(r, "$orderby") != "" {
+		sendAPIError(w, invalidField("InvalidFilter", "$filter", "Permissions cannot be filtered or ordered."))
+		return
 	}
 
-	sendJSONResponse(w, response)
+	permissions := s.store.listPermissions()
+	start, end, nextLink, ok := paginate(w, r, len(permissions))
+	if !ok {
+		return
+	}
+	sendPage(w, permissions[start:end], len(permissions), nextLink)
 }
 
-// Helper function to apply filter.
-func applyFilter(user map[string]interface{}, filter string) bool {
-	if strings.Contains(filter, "lastName startsWith") {
-		prefix := strings.Trim(strings.TrimSpace(strings.TrimPrefix(filter, "lastName startsWith")), "\"")
-		lastName, ok := user["lastName"].(string)
-		return ok && strings.HasPrefix(strings.ToLower(lastName), strings.ToLower(prefix))
+func (s *server) handleCompanies(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/companies", r)
+	companies, ok := queryRecords(w, r, s.store.listCompanies())
+	if !ok {
+		return
+	}
+	start, end, nextLink, ok := paginate(w, r, len(companies))
+	if !ok {
+		return
 	}
-	// Add more filter conditions as needed.
-	return true
+	sendPage(w, companies[start:end], len(companies), nextLink)
 }
 
-func sortUsers(users []map[string]interface{}, orderBy string) {
-	sort.Slice(users, func(i, j int) bool {
-		parts := strings.Split(orderBy, " ")
-		field := parts[0]
-		ascending := len(parts) == 1 || strings.ToUpper(parts[1]) != "DESC"
-
-		valI, okI := users[i][field].(string)
-		valJ, okJ := users[j][field].(string)
-
-		if !okI || !okJ {
-			return false
-		}
+func (s *server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
+	}
 
-		if ascending {
-			return valI < valJ
-		}
-		return valI > valJ
-	})
+	account, err := s.store.getAccount(accountID)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSONResponse(w, account)
 }
 
-func minCheck(a, b int) int {
-	if a < b {
-		return a
+func (s *server) handleAuditEvents(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}/auditevents", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
 	}
-	return b
-}
 
-func handlePermissions(w http.ResponseWriter, r *http.Request) {
-	logRequest("/api/v2/definitions/permissions", r)
-	response := map[string]interface{}{
-		"@recordsetCount": 3,
-		"value": []string{
-			"AccountSvc",
-			"CompanySvc",
-			"TaxSvc",
-		},
-		"@nextLink": fmt.Sprintf("%s/api/v2/definitions/permissions?$skip=3&$top=3", getBaseURL()),
+	// Audit events are kept oldest first.
+	allEvents, err := s.store.listAuditEvents(accountID)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	allEvents, ok = queryRecords(w, r, allEvents)
+	if !ok {
+		return
 	}
-	sendJSONResponse(w, response)
-}
 
-func handleUserEntitlements(w http.ResponseWriter, r *http.Request) {
-	logRequest("/api/v2/accounts/", r)
-	response := map[string]interface{}{
-		"permissions": []string{
-			"CompanyFetch",
-			"CompanySave",
-			"NexusFetch",
-			"NexusSave",
-		},
-		"accessLevel": "SingleAccount",
-		"companies":   []int{123, 456, 789},
+	start, end, nextLink, ok := paginate(w, r, len(allEvents))
+	if !ok {
+		return
 	}
-	sendJSONResponse(w, response)
+	sendPage(w, allEvents[start:end], len(allEvents), nextLink)
 }
 
 func sendJSONResponse(w http.ResponseWriter, data interface{}) {
+	sendJSONResponseWithStatus(w, http.StatusOK, data)
+}
+
+func sendJSONResponseWithStatus(w http.ResponseWriter, statusCode int, data interface{}) {
 	if w.Header().Get("X-Correlation-Id") == "" {
 		w.Header().Set("X-Correlation-Id", uuid.New().String())
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(statusCode)
 
 	// Log the response.
 	responseJSON, err := json.MarshalIndent(data, "", "  ")
@@ -475,7 +366,7 @@ func sendErrorResponse(w http.ResponseWriter, statusCode int, errorCode, message
 	}
 }
 
-func handlePing(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlePing(w http.ResponseWriter, r *http.Request) {
 	logRequest("/api/v2/utilities/ping", r)
 
 	// Check for X-Avalara-Client header.
@@ -486,21 +377,11 @@ func handlePing(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Simulate successful ping response.
-	response := map[string]interface{}{
-		"version":                "24.8.2",
-		"authenticated":          true,
-		"authenticationType":     "Basic",
-		"authenticatedUserName":  "testuser",
-		"authenticatedUserId":    12345,
-		"authenticatedAccountId": 123456789,
-		"crmid":                  "some-crm-id",
-	}
-	sendJSONResponse(w, response)
+	sendJSONResponse(w, s.store.ping())
 }
 
 // Helper function to add FetchResult to a user.
-func addFetchResult(user map[string]interface{}) map[string]interface{} {
+func addFetchResult(user record) record {
 	fetchResult := map[string]interface{}{
 		"@recordsetCount": 1,
 		"value": []map[string]interface{}{
@@ -0,0 +1,1230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	"github.com/conductorone/baton-avalara/pkg/connector"
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-sdk/pkg/connectorbuilder"
+	"github.com/conductorone/baton-sdk/pkg/pagination"
+	"github.com/conductorone/baton-sdk/pkg/uhttp"
+)
+
+// countingHandler counts the requests and response bytes served by the wrapped handler.
+type countingHandler struct {
+	next     http.Handler
+	requests atomic.Int64
+	bytes    atomic.Int64
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	bytes *atomic.Int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes.Add(int64(n))
+	return n, err
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.requests.Add(1)
+	h.next.ServeHTTP(&countingResponseWriter{ResponseWriter: w, bytes: &h.bytes}, r)
+}
+
+func newTestConnector(tb testing.TB, serverURL string) map[string]connectorbuilder.ResourceSyncer {
+	ctx := context.Background()
+	cb, err := connector.New(ctx, connector.Config{
+		BaseURL:                serverURL,
+		Username:               "testuser",
+		Password:               "testpass",
+		EntitlementConcurrency: 1,
+		SyncInactiveUsers:      true,
+	})
+	if err != nil {
+		tb.Fatalf("failed to create connector: %v", err)
+	}
+
+	syncers := make(map[string]connectorbuilder.ResourceSyncer)
+	for _, syncer := range cb.ResourceSyncers(ctx) {
+		syncers[syncer.ResourceType(ctx).Id] = syncer
+	}
+	return syncers
+}
+
+// BenchmarkRoleGrants syncs the roles and the grants of every role against the test server and
+// reports how many requests and response bytes that takes. Listing the roles starts a new sync,
+// so every iteration lists the users again.
+func BenchmarkRoleGrants(b *testing.B) {
+	b.Setenv("BATON_DISABLE_HTTP_CACHE", "true")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	handler := &countingHandler{next: newServeMux(newStore(defaultDataset()), &faultInjector{})}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx := context.Background()
+	syncers := newTestConnector(b, server.URL)
+
+	roleSyncer := syncers["role"]
+
+	handler.requests.Store(0)
+	handler.bytes.Store(0)
+	b.ResetTimer()
+
+	grants := 0
+	for i := 0; i < b.N; i++ {
+		roles, _, _, err := roleSyncer.List(ctx, nil, nil)
+		if err != nil {
+			b.Fatalf("failed to list roles: %v", err)
+		}
+		for _, role := range roles {
+			rv, _, _, err := roleSyncer.Grants(ctx, role, nil)
+			if err != nil {
+				b.Fatalf("failed to list grants: %v", err)
+			}
+			grants += len(rv)
+		}
+	}
+
+	b.ReportMetric(float64(handler.requests.Load())/float64(b.N), "requests/op")
+	b.ReportMetric(float64(handler.bytes.Load())/float64(b.N), "response-bytes/op")
+	b.ReportMetric(float64(grants)/float64(b.N), "grants/op")
+}
+
+// syncCounts totals what a sync found.
+type syncCounts struct {
+	resources    int
+	entitlements int
+	grants       int
+}
+
+// syncAll lists every resource, entitlement and grant the connector syncs, following page
+// tokens and child resource types the way the SDK's syncer does.
+func syncAll(ctx context.Context, syncers map[string]connectorbuilder.ResourceSyncer) (syncCounts, error) {
+	var counts syncCounts
+
+	type pending struct {
+		resourceType string
+		parent       *v2.ResourceId
+	}
+	var queue []pending
+	for resourceType := range syncers {
+		queue = append(queue, pending{resourceType: resourceType})
+	}
+
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		syncer := syncers[next.resourceType]
+
+		token := ""
+		for {
+			resources, nextToken, _, err := syncer.List(ctx, next.parent, &pagination.Token{Token: token})
+			if err != nil {
+				return counts, fmt.Errorf("failed to list %s: %w", next.resourceType, err)
+			}
+
+			for _, resource := range resources {
+				counts.resources++
+				for _, a := range resource.Annotations {
+					child := &v2.ChildResourceType{}
+					if a.MessageIs(child) {
+						if err := a.UnmarshalTo(child); err != nil {
+							return counts, err
+						}
+						queue = append(queue, pending{resourceType: child.ResourceTypeId, parent: resource.Id})
+					}
+				}
+
+				entitlements, err := drain(func(token string) (int, string, error) {
+					rv, next, _, err := syncer.Entitlements(ctx, resource, &pagination.Token{Token: token})
+					return len(rv), next, err
+				})
+				if err != nil {
+					return counts, fmt.Errorf("failed to list entitlements of %s: %w", resource.Id.Resource, err)
+				}
+				counts.entitlements += entitlements
+
+				grants, err := drain(func(token string) (int, string, error) {
+					rv, next, _, err := syncer.Grants(ctx, resource, &pagination.Token{Token: token})
+					return len(rv), next, err
+				})
+				if err != nil {
+					return counts, fmt.Errorf("failed to list grants of %s: %w", resource.Id.Resource, err)
+				}
+				counts.grants += grants
+			}
+
+			if nextToken == "" {
+				break
+			}
+			token = nextToken
+		}
+	}
+	return counts, nil
+}
+
+// drain calls list with each page token in turn until there are no more pages, and returns
+// the number of items listed.
+func drain(list func(token string) (int, string, error)) (int, error) {
+	total := 0
+	token := ""
+	for {
+		n, next, err := list(token)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if next == "" {
+			return total, nil
+		}
+		token = next
+	}
+}
+
+// BenchmarkSyntheticSync runs a full connector sync against generated tenants of increasing
+// size, and reports the requests it takes and the peak heap of the process, which includes
+// the test server. Larger tenants can be generated with the test server's --fixtures flag.
+func BenchmarkSyntheticSync(b *testing.B) {
+	b.Setenv("BATON_DISABLE_HTTP_CACHE", "true")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, cfg := range []generatorConfig{
+		{Seed: 1, Accounts: 1, Companies: 10, Users: 1000},
+		{Seed: 1, Accounts: 5, Companies: 100, Users: 10000},
+	} {
+		b.Run(fmt.Sprintf("accounts=%d,companies=%d,users=%d", cfg.Accounts, cfg.Companies, cfg.Users), func(b *testing.B) {
+			d, err := loadSynthetic(fmt.Sprintf("seed=%d,accounts=%d,companies=%d,users=%d", cfg.Seed, cfg.Accounts, cfg.Companies, cfg.Users))
+			if err != nil {
+				b.Fatalf("failed to generate dataset: %v", err)
+			}
+			handler := &countingHandler{next: newServeMux(newStore(d), &faultInjector{})}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			ctx := context.Background()
+			var counts syncCounts
+			var peakHeap uint64
+			var stats runtime.MemStats
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				syncers := newTestConnector(b, server.URL)
+				handler.requests.Store(0)
+				b.StartTimer()
+
+				counts, err = syncAll(ctx, syncers)
+				if err != nil {
+					b.Fatalf("sync failed: %v", err)
+				}
+
+				runtime.ReadMemStats(&stats)
+				peakHeap = max(peakHeap, stats.HeapInuse)
+			}
+
+			b.ReportMetric(float64(handler.requests.Load()), "requests/op")
+			b.ReportMetric(float64(counts.resources), "resources/op")
+			b.ReportMetric(float64(counts.grants), "grants/op")
+			b.ReportMetric(float64(peakHeap), "peak-heap-bytes")
+		})
+	}
+}
+
+// TestUserProvisioning runs provisioning requests in order against one server, checking
+// that each sees the changes of those before it.
+func TestUserProvisioning(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	server := httptest.NewServer(newServeMux(newStore(defaultDataset()), &faultInjector{}))
+	defer server.Close()
+
+	const account = "/api/v2/accounts/123456789"
+	newUser := map[string]interface{}{
+		"userName": "zoeExample", "firstName": "Zoe", "lastName": "Example",
+		"email": "zoe@example.org", "companyId": 123456,
+	}
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		status int
+		// code is the expected error code, or a field the response must contain.
+		code string
+	}{
+		{"create user", http.MethodPost, account + "/users", []interface{}{newUser}, http.StatusCreated, ""},
+		{"get created user", http.MethodGet, account + "/users/80247", nil, http.StatusOK, "zoeExample"},
+		{"create duplicate user name", http.MethodPost, account + "/users", []interface{}{newUser}, http.StatusConflict, "DuplicateEntityError"},
+		{"create user without email", http.MethodPost, account + "/users",
+			[]interface{}{map[string]interface{}{"userName": "x", "firstName": "X", "lastName": "Y"}}, http.StatusBadRequest, "ValueRequiredError"},
+		{"create user in unknown company", http.MethodPost, account + "/users",
+			[]interface{}{map[string]interface{}{"userName": "x", "firstName": "X", "lastName": "Y", "email": "x@example.org", "companyId": 1}},
+			http.StatusBadRequest, "EntityNotFoundError"},
+		{"create user in unknown account", http.MethodPost, "/api/v2/accounts/1/users", []interface{}{newUser}, http.StatusNotFound, "EntityNotFoundError"},
+		{"create users from invalid JSON", http.MethodPost, account + "/users", "not a list", http.StatusBadRequest, "JsonFormatError"},
+		{"change to unknown role", http.MethodPut, account + "/users/80247", map[string]interface{}{"securityRoleId": "Owner"}, http.StatusBadRequest, "InvalidSecurityRole"},
+		{"change role", http.MethodPut, account + "/users/80247", map[string]interface{}{"securityRoleId": "AccountAdmin"}, http.StatusOK, "AccountAdmin"},
+		{"role change is audited", http.MethodGet, account + "/auditevents", nil, http.StatusOK, "SecurityRoleChanged"},
+		{"company role without company", http.MethodPut, account + "/users/80247",
+			map[string]interface{}{"securityRoleId": "CompanyUser", "companyId": 0}, http.StatusBadRequest, "CompanyRequired"},
+		{"move user to another account", http.MethodPut, account + "/users/80247", map[string]interface{}{"accountId": 1}, http.StatusBadRequest, "CannotChangeAccount"},
+		{"reset short password", http.MethodPost, "/api/v2/passwords/80247/reset", map[string]interface{}{"newPassword": "abc1"}, http.StatusBadRequest, "PasswordLengthInvalid"},
+		{"reset simple password", http.MethodPost, "/api/v2/passwords/80247/reset", map[string]interface{}{"newPassword": "abcdefghij"}, http.StatusBadRequest, "PasswordComplexityInvalid"},
+		{"reset password", http.MethodPost, "/api/v2/passwords/80247/reset", map[string]interface{}{"newPassword": "correct-horse-1"}, http.StatusOK, "Success"},
+		{"delete user", http.MethodDelete, account + "/users/80247", nil, http.StatusOK, ""},
+		{"deleted user is still listed", http.MethodGet, account + "/users/80247", nil, http.StatusOK, `"isDeleted":true`},
+		{"update deleted user", http.MethodPut, account + "/users/80247", map[string]interface{}{"firstName": "Z"}, http.StatusBadRequest, "CannotModifyDeletedRecords"},
+		{"delete deleted user", http.MethodDelete, account + "/users/80247", nil, http.StatusNotFound, "EntityNotFoundError"},
+		{"reset license key unconfirmed", http.MethodPost, account + "/resetlicensekey", map[string]interface{}{"accountId": 123456789}, http.StatusBadRequest, "ValueRequiredError"},
+		{"reset license key", http.MethodPost, account + "/resetlicensekey",
+			map[string]interface{}{"accountId": 123456789, "confirmResetLicenseKey": true}, http.StatusOK, "privateLicenseKey"},
+		{"reset server", http.MethodPost, "/testing/reset", nil, http.StatusNoContent, ""},
+		{"reset removes created user", http.MethodGet, account + "/users/80247", nil, http.StatusNotFound, "EntityNotFoundError"},
+	}
+
+	for _, tc := range testCases {
+		var body io.Reader
+		if tc.body != nil {
+			b, err := json.Marshal(tc.body)
+			if err != nil {
+				t.Fatalf("%s: failed to marshal body: %v", tc.name, err)
+			}
+			body = bytes.NewReader(b)
+		}
+
+		req, err := http.NewRequestWithContext(context.Background(), tc.method, server.URL+tc.path, body)
+		if err != nil {
+			t.Fatalf("%s: failed to create request: %v", tc.name, err)
+		}
+		req.SetBasicAuth("testuser", "testpass")
+		req.Header.Set("X-Avalara-Client", "test")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tc.name, err)
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to read response: %v", tc.name, err)
+		}
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: Expected status %d, got %d: %s", tc.name, tc.status, resp.StatusCode, respBody)
+		}
+		if !bytes.Contains(respBody, []byte(tc.code)) {
+			t.Errorf("%s: Expected the response to contain %q, got %s", tc.name, tc.code, respBody)
+		}
+	}
+}
+
+// beforeRoundTripper runs a function before each request with a method, to change the server in between a client's requests.
+type beforeRoundTripper struct {
+	method string
+	before func()
+	next   http.RoundTripper
+}
+
+func (rt *beforeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == rt.method && rt.before != nil {
+		rt.before()
+	}
+	return rt.next.RoundTrip(req)
+}
+
+func TestConcurrentUserUpdate(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const accountID, userID = 123456789, 12345
+	ctx := context.Background()
+
+	testCases := []struct {
+		name string
+		// concurrent changes the user after the client first read it, before its update is sent.
+		concurrent bool
+		// beforePUT changes the user after the client read it again, just before its PUT.
+		beforePUT bool
+		// withoutETag drops the ETag so the update relies on modifiedDate and If-Unmodified-Since.
+		withoutETag bool
+		expectedErr error
+	}{
+		{name: "no concurrent change"},
+		{name: "changed before the update", concurrent: true, expectedErr: avalaraclient.ErrConcurrentModification},
+		{name: "changed before the PUT", beforePUT: true, expectedErr: avalaraclient.ErrConcurrentModification},
+		{name: "changed before the PUT without ETag", beforePUT: true, withoutETag: true, expectedErr: avalaraclient.ErrConcurrentModification},
+	}
+
+	for _, tc := range testCases {
+		st := newStore(defaultDataset())
+		clock := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+		st.now = func() time.Time { return clock }
+		server := httptest.NewServer(newServeMux(st, &faultInjector{}))
+
+		// changeUser renames the user as another administrator would, a second later.
+		changeUser := func() {
+			clock = clock.Add(time.Second)
+			_, err := st.updateUser(accountID, userID, record{"firstName": "Robert"}, st.actor(), precondition{})
+			if err != nil {
+				t.Fatalf("%s: failed to change the user: %v", tc.name, err)
+			}
+		}
+
+		rt := &beforeRoundTripper{method: http.MethodPut, next: http.DefaultTransport}
+		c := avalaraclient.NewAvalaraClient(server.URL, uhttp.NewBaseHttpClient(&http.Client{Transport: rt}))
+		c.AddCredentials("testuser", "testpass")
+
+		user, err := c.GetUser(ctx, accountID, userID)
+		if err != nil {
+			t.Fatalf("%s: failed to get user: %v", tc.name, err)
+		}
+		if user.ETag == "" {
+			t.Errorf("%s: Expected the user to have an ETag", tc.name)
+		}
+		if tc.withoutETag {
+			user.ETag = ""
+		}
+		if tc.concurrent {
+			changeUser()
+		}
+		if tc.beforePUT {
+			rt.before = changeUser
+		}
+
+		user.SecurityRoleID = "AccountAdmin"
+		_, err = c.UpdateUser(ctx, accountID, userID, user)
+		server.Close()
+
+		if !errors.Is(err, tc.expectedErr) {
+			t.Errorf("%s: Expected error %v, got %v", tc.name, tc.expectedErr, err)
+		}
+		current, err := st.findAccountUser(accountID, userID)
+		if err != nil {
+			t.Fatalf("%s: failed to find user: %v", tc.name, err)
+		}
+		expectedRole := "AccountAdmin"
+		if tc.expectedErr != nil {
+			expectedRole = "AccountUser"
+		}
+		if role := current.stringField("securityRoleId"); role != expectedRole {
+			t.Errorf("%s: Expected role %s, got %s", tc.name, expectedRole, role)
+		}
+	}
+}
+
+func TestFilterRecords(t *testing.T) {
+	users := defaultDataset().Users
+
+	testCases := []struct {
+		filter   string
+		expected []string
+		// err is part of the expected error, for filters that are rejected.
+		err string
+	}{
+		{filter: "", expected: []string{"bobExample", "aliceExample", "charlieExample", "danaExample", "eveExample", "frankExample", "graceExample", "henryExample", "isabelExample", "jackExample"}},
+		{filter: "id eq 12345", expected: []string{"bobExample"}},
+		{filter: "securityRoleId eq 'accountadmin'", expected: []string{"aliceExample"}},
+		{filter: "companyId in (123457, 123458) and id ne 13579", expected: []string{"danaExample", "eveExample", "frankExample"}},
+		{filter: "id gt 60000 and id le 68024", expected: []string{"aliceExample", "henryExample"}},
+		{filter: "id lt 13000 or id ge 80246", expected: []string{"bobExample", "jackExample"}},
+		{filter: "not (companyId lt 123459) and isActive eq true", expected: []string{"graceExample", "henryExample", "isabelExample", "jackExample"}},
+		{filter: "contains(email, 'ALICE') or startswith(userName, 'dan') or endswith(lastName, 'xyz')", expected: []string{"aliceExample", "danaExample"}},
+		{filter: "modifiedDate gt '2024-07-09T00:00:00'", expected: []string{"isabelExample", "jackExample"}},
+		{filter: "createdDate lt 2024-01-02", expected: []string{"bobExample"}},
+		{filter: "userName eq 'O''Brien' or isDeleted ne false", expected: []string{}},
+		{filter: "postalCode eq null", expected: []string{}},
+		{filter: "UserName EQ 'bobExample'", expected: []string{"bobExample"}},
+		{filter: "nickname eq 'bob'", err: "unknown field 'nickname'"},
+		{filter: "id eq '12345'", err: "cannot compare numeric field 'id'"},
+		{filter: "isActive gt false", err: "only supports eq and ne"},
+		{filter: "userName eq 42", err: "cannot compare text field 'userName'"},
+		{filter: "id has 1", err: "unsupported operator 'has'"},
+		{filter: "id eq 1 and", err: "expected a field name at the end"},
+		{filter: "(id eq 1", err: "expected ')'"},
+		{filter: "userName eq 'bob", err: "unterminated string"},
+		{filter: "id eq 1 id eq 2", err: "unexpected 'id'"},
+		{filter: "id eq #", err: "unexpected character '#'"},
+		{filter: "substringof('bob', userName)", err: "expected an operator"},
+		{filter: "contains(id, '1')", err: "requires a text field"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.filter, func(t *testing.T) {
+			matched, err := filterRecords(users, tc.filter)
+			if tc.err != "" {
+				var apiErr *apiError
+				if !errors.As(err, &apiErr) || apiErr.status != http.StatusBadRequest || !strings.Contains(apiErr.message, tc.err) {
+					t.Errorf("Expected a 400 error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			names := []string{}
+			for _, user := range matched {
+				names = append(names, user.stringField("userName"))
+			}
+			if strings.Join(names, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("Expected %v, got %v", tc.expected, names)
+			}
+		})
+	}
+}
+
+func TestSortRecords(t *testing.T) {
+	testCases := []struct {
+		orderBy  string
+		expected []string
+		err      string
+	}{
+		{orderBy: "id", expected: []string{"bobExample", "charlieExample", "danaExample"}},
+		{orderBy: "companyId desc, userName asc", expected: []string{"charlieExample", "danaExample", "bobExample"}},
+		{orderBy: "LASTNAME, id DESC", expected: []string{"danaExample", "charlieExample", "bobExample"}},
+		{orderBy: "nickname", err: "unknown field 'nickname'"},
+		{orderBy: "id sideways", err: "unsupported sort direction"},
+		{orderBy: "id,", err: "expected a field"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.orderBy, func(t *testing.T) {
+			users := defaultDataset().Users[:4]
+			users = append(users[:1], users[2:]...)
+
+			err := sortRecords(users, tc.orderBy)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("Expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			var names []string
+			for _, user := range users {
+				names = append(names, user.stringField("userName"))
+			}
+			if strings.Join(names, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("Expected %v, got %v", tc.expected, names)
+			}
+		})
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	faults := &faultInjector{}
+	server := httptest.NewServer(newServeMux(newStore(defaultDataset()), faults))
+	defer server.Close()
+
+	get := func(path string) (*http.Response, []byte, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.SetBasicAuth("testuser", "testpass")
+		req.Header.Set("X-Avalara-Client", "test")
+
+		// A fresh transport keeps a reset connection from affecting later requests.
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, body, err
+	}
+
+	type result struct {
+		status int
+		// check inspects the response beyond its status.
+		check func(resp *http.Response, body []byte) error
+	}
+	validJSON := func(resp *http.Response, body []byte) error {
+		if !json.Valid(body) {
+			return fmt.Errorf("invalid JSON: %s", body)
+		}
+		return nil
+	}
+	invalidJSON := func(resp *http.Response, body []byte) error {
+		if json.Valid(body) {
+			return fmt.Errorf("valid JSON: %s", body)
+		}
+		return nil
+	}
+
+	testCases := []struct {
+		name   string
+		faults string
+		path   string
+		// expected holds the result of consecutive requests to path.
+		expected []result
+	}{
+		{
+			name:   "rate limit",
+			faults: `[{"kind": "rate-limit", "retryAfter": 7, "count": 1}]`,
+			path:   "/api/v2/users",
+			expected: []result{
+				{http.StatusTooManyRequests, func(resp *http.Response, body []byte) error {
+					if resp.Header.Get("Retry-After") != "7" {
+						return fmt.Errorf("Retry-After %q", resp.Header.Get("Retry-After"))
+					}
+					return nil
+				}},
+				{http.StatusOK, validJSON},
+			},
+		},
+		{
+			name:     "error burst",
+			faults:   `[{"kind": "error", "status": 503, "after": 1, "count": 2}]`,
+			path:     "/api/v2/companies",
+			expected: []result{{http.StatusOK, nil}, {http.StatusServiceUnavailable, nil}, {http.StatusServiceUnavailable, nil}, {http.StatusOK, nil}},
+		},
+		{
+			name:     "every other request",
+			faults:   `[{"kind": "error", "endpoint": "/api/v2/companies", "every": 2}]`,
+			path:     "/api/v2/companies",
+			expected: []result{{http.StatusOK, nil}, {http.StatusInternalServerError, nil}, {http.StatusOK, nil}, {http.StatusInternalServerError, nil}},
+		},
+		{
+			name:     "other endpoint",
+			faults:   `[{"kind": "error", "endpoint": "/api/v2/companies"}]`,
+			path:     "/api/v2/users",
+			expected: []result{{http.StatusOK, nil}},
+		},
+		{
+			name:     "other method",
+			faults:   `[{"kind": "error", "method": "PUT"}]`,
+			path:     "/api/v2/users",
+			expected: []result{{http.StatusOK, nil}},
+		},
+		{
+			name:     "malformed JSON",
+			faults:   `[{"kind": "malformed-json"}]`,
+			path:     "/api/v2/users",
+			expected: []result{{http.StatusOK, invalidJSON}},
+		},
+		{
+			name:     "truncated JSON",
+			faults:   `[{"kind": "truncated-json"}]`,
+			path:     "/api/v2/users",
+			expected: []result{{http.StatusOK, invalidJSON}},
+		},
+		{
+			name:   "wrong content type",
+			faults: `[{"kind": "wrong-content-type"}]`,
+			path:   "/api/v2/users",
+			expected: []result{{http.StatusOK, func(resp *http.Response, body []byte) error {
+				if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+					return fmt.Errorf("Content-Type %q", resp.Header.Get("Content-Type"))
+				}
+				return validJSON(resp, body)
+			}}},
+		},
+		{
+			name:     "expired auth",
+			faults:   `[{"kind": "expired-auth", "endpoint": "/api/v2/utilities/ping"}]`,
+			path:     "/api/v2/utilities/ping",
+			expected: []result{{http.StatusUnauthorized, nil}},
+		},
+		{
+			name:     "connection reset",
+			faults:   `[{"kind": "connection-reset", "count": 1}]`,
+			path:     "/api/v2/users",
+			expected: []result{{0, nil}, {http.StatusOK, nil}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, err := parseFaults([]byte(tc.faults))
+			if err != nil {
+				t.Fatalf("Expected valid faults, got %v", err)
+			}
+			faults.set(parsed)
+
+			for i, expected := range tc.expected {
+				resp, body, err := get(tc.path)
+				if expected.status == 0 {
+					if err == nil {
+						t.Errorf("request %d: Expected the connection to fail, got %d", i+1, resp.StatusCode)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("request %d: Expected a response, got %v", i+1, err)
+				}
+				if resp.StatusCode != expected.status {
+					t.Errorf("request %d: Expected status %d, got %d", i+1, expected.status, resp.StatusCode)
+				}
+				if expected.check != nil {
+					if err := expected.check(resp, body); err != nil {
+						t.Errorf("request %d: Unexpected response: %v", i+1, err)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("latency", func(t *testing.T) {
+		faults.set([]*fault{{Kind: faultLatency, Every: 1, latency: 50 * time.Millisecond}})
+		start := time.Now()
+		resp, _, err := get("/api/v2/users")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected a successful response, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Expected at least 50ms of latency, got %s", elapsed)
+		}
+	})
+
+	t.Run("invalid faults", func(t *testing.T) {
+		for _, faults := range []string{
+			`{"kind": "error"}`,
+			`[{"kind": "meteor"}]`,
+			`[{"kind": "error", "status": 404}]`,
+			`[{"kind": "latency", "latency": "soon"}]`,
+			`[{"kind": "error", "every": -1}]`,
+			`[{"kind": "error", "endpint": "/api/v2/users"}]`,
+		} {
+			_, err := parseFaults([]byte(faults))
+			if err == nil {
+				t.Errorf("Expected %s to be rejected", faults)
+			}
+		}
+	})
+}
+
+// TestRateLimitedSync syncs permission grants while user entitlements are rate limited, and
+// checks that the connector backs off and retries rather than failing.
+func TestRateLimitedSync(t *testing.T) {
+	t.Setenv("BATON_DISABLE_HTTP_CACHE", "true")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	faults := &faultInjector{}
+	server := httptest.NewServer(newServeMux(newStore(defaultDataset()), faults))
+	defer server.Close()
+
+	ctx := context.Background()
+	cb, err := connector.New(ctx, connector.Config{
+		BaseURL:                server.URL,
+		Username:               "testuser",
+		Password:               "testpass",
+		EntitlementConcurrency: 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to create connector: %v", err)
+	}
+	syncers := make(map[string]connectorbuilder.ResourceSyncer)
+	for _, syncer := range cb.ResourceSyncers(ctx) {
+		syncers[syncer.ResourceType(ctx).Id] = syncer
+	}
+
+	permissions, _, _, err := syncers["permission"].List(ctx, nil, nil)
+	if err != nil || len(permissions) == 0 {
+		t.Fatalf("failed to list permissions: %v", err)
+	}
+
+	parsed, err := parseFaults([]byte(`[{"kind": "rate-limit", "endpoint": "/api/v2/accounts/", "method": "GET", "retryAfter": 1, "count": 2}]`))
+	if err != nil {
+		t.Fatalf("Expected valid faults, got %v", err)
+	}
+	faults.set(parsed)
+
+	// Every user holds CompanyFetch in the default dataset.
+	var companyFetch *v2.Resource
+	for _, permission := range permissions {
+		if permission.DisplayName == "CompanyFetch" {
+			companyFetch = permission
+		}
+	}
+	if companyFetch == nil {
+		t.Fatalf("Expected the CompanyFetch permission")
+	}
+
+	grants, _, _, err := syncers["permission"].Grants(ctx, companyFetch, nil)
+	if err != nil {
+		t.Fatalf("Expected the sync to recover from rate limiting, got %v", err)
+	}
+	if len(grants) == 0 {
+		t.Errorf("Expected grants after retrying")
+	}
+	if fired := faults.list()[0].Fired; fired != 2 {
+		t.Errorf("Expected the rate limit to fire 2 times, got %d", fired)
+	}
+}
+
+func TestShippedFixtures(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	names := shippedFixtures()
+	if len(names) < 4 {
+		t.Fatalf("Expected the default fixture and at least three scenarios, got %v", names)
+	}
+
+	for _, name := range names {
+		d, err := loadFixture(name)
+		if err != nil {
+			t.Errorf("%s: Expected the fixture to load, got %v", name, err)
+			continue
+		}
+
+		server := httptest.NewServer(newServeMux(newStore(d), &faultInjector{}))
+		for _, path := range []string{"/api/v2/utilities/ping", "/api/v2/users", "/api/v2/companies", "/api/v2/definitions/securityroles"} {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+path, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.SetBasicAuth("testuser", "testpass")
+			req.Header.Set("X-Avalara-Client", "test")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: request failed: %v", name, path, err)
+			}
+			var body map[string]interface{}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || err != nil {
+				t.Errorf("%s %s: Expected a JSON object with status 200, got %d: %v", name, path, resp.StatusCode, err)
+			}
+			if path == "/api/v2/users" && body["@recordsetCount"] != float64(len(d.Users)) {
+				t.Errorf("%s: Expected %d users, got %v", name, len(d.Users), body["@recordsetCount"])
+			}
+		}
+		server.Close()
+
+		for _, u := range d.Users {
+			if _, ok := u["isActive"].(bool); !ok {
+				t.Errorf("%s: Expected user %v to have isActive, got %v", name, u["id"], u["isActive"])
+			}
+		}
+	}
+}
+
+func TestParseFixture(t *testing.T) {
+	const valid = `{
+		"ping": {"authenticatedUserName": "testuser", "authenticatedUserId": 1, "authenticatedAccountId": 10},
+		"accounts": [{"id": 10, "name": "Account"}],
+		"companies": [{"id": 20, "accountId": 10, "companyCode": "DEFAULT"}],
+		"securityRoles": [{"id": 1, "description": "AccountAdmin"}],
+		"users": [{"id": 1, "accountId": 10, "companyId": 20, "userName": "a", "securityRoleId": "AccountAdmin"}],
+		"entitlements": [{"userId": 1, "accessLevel": "SingleAccount"}],
+		"auditEvents": [{"id": 1, "accountId": 10, "eventType": "UserLogin"}]
+	}`
+	validYAML := `
+ping: {authenticatedUserName: testuser, authenticatedUserId: 1, authenticatedAccountId: 10}
+accounts:
+  - {id: 10, name: Account, effectiveDate: 2020-01-01T00:00:00}
+users:
+  - {id: 1, accountId: 10, userName: a}
+`
+
+	testCases := []struct {
+		name string
+		file string
+		data string
+		// err is part of the expected error, or empty when the fixture is valid.
+		err string
+	}{
+		{"valid JSON", "f.json", valid, ""},
+		{"valid YAML", "f.yaml", validYAML, ""},
+		{"unsupported extension", "f.txt", valid, "must be .json, .yaml or .yml"},
+		{"unknown field", "f.json", `{"accounts": [], "widgets": []}`, "unknown field"},
+		{"invalid YAML", "f.yml", "accounts: [", "yaml"},
+		{"missing id", "f.json", strings.Replace(valid, `"id": 20, `, "", 1), "company 0: id is required"},
+		{"repeated id", "f.json", strings.Replace(valid, `"id": 20`, `"id": 20}, {"id": 20, "accountId": 10`, 1), "id 20 is repeated"},
+		{"unknown ping account", "f.json", strings.Replace(valid, `"authenticatedAccountId": 10`, `"authenticatedAccountId": 11`, 1), "authenticatedAccountId 11 is not an account"},
+		{"unknown company account", "f.json", strings.Replace(valid, `"accountId": 10, "companyCode"`, `"accountId": 11, "companyCode"`, 1), "accountId 11 is not an account"},
+		{"unknown user company", "f.json", strings.Replace(valid, `"companyId": 20`, `"companyId": 21`, 1), "companyId 21 is not a company"},
+		{"unknown user role", "f.json", strings.Replace(valid, `"securityRoleId": "AccountAdmin"`, `"securityRoleId": "Owner"`, 1), `"Owner" is not a security role`},
+		{"unknown entitlement user", "f.json", strings.Replace(valid, `"userId": 1`, `"userId": 2`, 1), "userId 2 is not a user"},
+	}
+
+	for _, tc := range testCases {
+		d, err := parseFixture(tc.file, []byte(tc.data))
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: Expected no error, got %v", tc.name, err)
+				continue
+			}
+			if d.Users[0]["isActive"] != true || d.Users[0]["passwordStatus"] != "UserCanChange" {
+				t.Errorf("%s: Expected user defaults to be applied, got %v", tc.name, d.Users[0])
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: Expected an error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	_, err := loadFixture("no-such-fixture")
+	if err == nil || !strings.Contains(err.Error(), "firm-account") {
+		t.Errorf("Expected an unknown fixture to list the shipped fixtures, got %v", err)
+	}
+}
+
+func TestGenerateDataset(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	d, err := loadFixture("synthetic:accounts=3,companies=20,users=2000,seed=42")
+	if err != nil {
+		t.Fatalf("Expected the synthetic dataset to load, got %v", err)
+	}
+	if len(d.Accounts) != 3 || len(d.Companies) != 20 || len(d.Users) != 2000 {
+		t.Errorf("Expected 3 accounts, 20 companies and 2000 users, got %d, %d and %d", len(d.Accounts), len(d.Companies), len(d.Users))
+	}
+	if d.Accounts[0]["accountTypeId"] != "Firm" || d.Users[0]["securityRoleId"] != "FirmAdmin" {
+		t.Errorf("Expected the authenticated user to administer a firm, got %v and %v", d.Accounts[0]["accountTypeId"], d.Users[0]["securityRoleId"])
+	}
+
+	again, err := loadFixture("synthetic:seed=42,users=2000,companies=20,accounts=3")
+	if err != nil {
+		t.Fatalf("Expected the synthetic dataset to load, got %v", err)
+	}
+	first, _ := json.Marshal(d)
+	second, _ := json.Marshal(again)
+	if !bytes.Equal(first, second) {
+		t.Errorf("Expected the same seed to generate the same dataset")
+	}
+	other, _ := loadFixture("synthetic:accounts=3,companies=20,users=2000,seed=43")
+	third, _ := json.Marshal(other)
+	if bytes.Equal(first, third) {
+		t.Errorf("Expected another seed to generate another dataset")
+	}
+
+	roles := make(map[string]int)
+	for _, u := range d.Users {
+		roles[u.stringField("securityRoleId")]++
+	}
+	if roles["CompanyUser"] < roles["AccountAdmin"] || roles["FirmUser"] == 0 || roles[""] == 0 {
+		t.Errorf("Expected mostly company users, some firm users and some users without a role, got %v", roles)
+	}
+
+	for _, options := range []string{"users=0", "accounts=3,companies=2", "users=many", "size=3", "users"} {
+		if _, err := loadFixture("synthetic:" + options); err == nil {
+			t.Errorf("%s: Expected an error", options)
+		}
+	}
+
+	// Every user is served exactly once when the users are paged through.
+	server := httptest.NewServer(newServeMux(newStore(d), &faultInjector{}))
+	defer server.Close()
+
+	seen := make(map[float64]bool)
+	next := server.URL + "/api/v2/users?$top=300"
+	for next != "" {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, next, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.SetBasicAuth("testuser", "testpass")
+		req.Header.Set("X-Avalara-Client", "test")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		var page struct {
+			NextLink string                   `json:"@nextLink"`
+			Value    []map[string]interface{} `json:"value"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode page: %v", err)
+		}
+
+		for _, u := range page.Value {
+			id, _ := u["id"].(float64)
+			if seen[id] {
+				t.Errorf("Expected user %v to be served once, got it again", id)
+			}
+			seen[id] = true
+		}
+		next = page.NextLink
+	}
+	if len(seen) != len(d.Users) {
+		t.Errorf("Expected %d users, got %d", len(d.Users), len(seen))
+	}
+}
+
+// pageResult is what walkPages saw while following next links.
+type pageResult struct {
+	ids   []string
+	pages int
+}
+
+// walkPages follows a list endpoint's next links to the last page, checking on every page
+// that $top is honored, @recordsetCount is the total and @nextLink is sent exactly when rows
+// remain. Skip is the $skip of the first page.
+func walkPages(t *testing.T, serverURL, path string, top, skip, total int) pageResult {
+	t.Helper()
+
+	var result pageResult
+	next := serverURL + path
+	for next != "" {
+		if result.pages > total+1 {
+			t.Fatalf("%s: Expected the pages to end, got %d pages", path, result.pages)
+		}
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, next, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.SetBasicAuth("testuser", "testpass")
+		req.Header.Set("X-Avalara-Client", "test")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", path, err)
+		}
+		var page struct {
+			Count    int               `json:"@recordsetCount"`
+			NextLink string            `json:"@nextLink"`
+			Value    []json.RawMessage `json:"value"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("%s: Expected a page with status 200, got %d: %v", path, resp.StatusCode, err)
+		}
+		result.pages++
+
+		if page.Count != total {
+			t.Errorf("%s: Expected @recordsetCount %d, got %d", path, total, page.Count)
+		}
+		if top > 0 && len(page.Value) > top {
+			t.Errorf("%s: Expected at most %d rows, got %d", path, top, len(page.Value))
+		}
+		for _, v := range page.Value {
+			var item struct {
+				ID json.Number `json:"id"`
+			}
+			if json.Unmarshal(v, &item) != nil {
+				// Permissions are plain strings.
+				result.ids = append(result.ids, string(v))
+				continue
+			}
+			result.ids = append(result.ids, item.ID.String())
+		}
+
+		remaining := skip+len(result.ids) < total
+		if remaining != (page.NextLink != "") {
+			t.Errorf("%s: Expected a next link only while rows remain, got %q after %d of %d rows", path, page.NextLink, len(result.ids), total)
+		}
+		next = page.NextLink
+	}
+	return result
+}
+
+func TestPagination(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	d, err := loadFixture("synthetic:accounts=2,companies=30,users=2500,seed=3")
+	if err != nil {
+		t.Fatalf("failed to generate dataset: %v", err)
+	}
+	server := httptest.NewServer(newServeMux(newStore(d), &faultInjector{}))
+	defer server.Close()
+
+	account := fmt.Sprintf("/api/v2/accounts/%v", d.Accounts[0]["id"])
+	accountUsers, accountEvents := 0, 0
+	companyUsers := 0
+	for _, u := range d.Users {
+		if u["accountId"] == d.Accounts[0]["id"] {
+			accountUsers++
+		}
+		if u["securityRoleId"] == "CompanyUser" {
+			companyUsers++
+		}
+	}
+	for _, e := range d.AuditEvents {
+		if e["accountId"] == d.Accounts[0]["id"] {
+			accountEvents++
+		}
+	}
+
+	testCases := []struct {
+		path  string
+		top   int
+		skip  int
+		total int
+	}{
+		{"/api/v2/definitions/securityroles", 0, 0, len(d.SecurityRoles)},
+		{"/api/v2/definitions/securityroles?$top=5", 5, 0, len(d.SecurityRoles)},
+		{"/api/v2/definitions/securityroles?$top=11", 11, 0, len(d.SecurityRoles)},
+		{"/api/v2/definitions/securityroles?$top=5&$filter=startswith(description, 'Company')", 5, 0, 2},
+		{"/api/v2/definitions/permissions?$top=4", 4, 0, len(d.Permissions)},
+		{"/api/v2/companies?$top=7", 7, 0, len(d.Companies)},
+		{"/api/v2/companies?$top=7&$skip=100", 7, 100, len(d.Companies)},
+		{"/api/v2/users", maxPageSize, 0, len(d.Users)},
+		{"/api/v2/users?$top=300", 300, 0, len(d.Users)},
+		{"/api/v2/users?$top=5000", maxPageSize, 0, len(d.Users)},
+		{"/api/v2/users?$top=2&$skip=2497", 2, 2497, len(d.Users)},
+		{"/api/v2/users?$top=100&$filter=securityRoleId eq 'CompanyUser'&$orderBy=userName desc", 100, 0, companyUsers},
+		{account + "/users?$top=250&$include=FetchResult", 250, 0, accountUsers},
+		{account + "/auditevents?$top=20", 20, 0, accountEvents},
+	}
+
+	for _, tc := range testCases {
+		path := strings.ReplaceAll(tc.path, " ", "%20")
+		result := walkPages(t, server.URL, path, tc.top, tc.skip, tc.total)
+
+		if expected := max(tc.total-tc.skip, 0); len(result.ids) != expected {
+			t.Errorf("%s: Expected %d rows, got %d", tc.path, expected, len(result.ids))
+		}
+		seen := make(map[string]bool)
+		for _, id := range result.ids {
+			if seen[id] {
+				t.Errorf("%s: Expected %s once, got it again", tc.path, id)
+			}
+			seen[id] = true
+		}
+	}
+
+	// The users' order carries over to later pages.
+	result := walkPages(t, server.URL, "/api/v2/users?$top=400&$orderby=id%20desc", 400, 0, len(d.Users))
+	for i := 1; i < len(result.ids); i++ {
+		previous, _ := strconv.Atoi(result.ids[i-1])
+		current, _ := strconv.Atoi(result.ids[i])
+		if previous <= current {
+			t.Fatalf("Expected ids in descending order, got %d before %d", previous, current)
+		}
+	}
+
+	for _, path := range []string{"/api/v2/users?$top=-1", "/api/v2/users?$skip=x", "/api/v2/companies?$top=1.5"} {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.SetBasicAuth("testuser", "testpass")
+		req.Header.Set("X-Avalara-Client", "test")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: Expected status 400, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+// TestClientPagination pages through every list the client reads, with page sizes that do
+// and don't divide the number of records, so that paging bugs in the client show up.
+func TestClientPagination(t *testing.T) {
+	t.Setenv("BATON_DISABLE_HTTP_CACHE", "true")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	d, err := loadFixture("synthetic:accounts=1,companies=5,users=230,seed=5")
+	if err != nil {
+		t.Fatalf("failed to generate dataset: %v", err)
+	}
+	server := httptest.NewServer(newServeMux(newStore(d), &faultInjector{}))
+	defer server.Close()
+
+	ctx := context.Background()
+	accountID, _ := d.Accounts[0].intField("id")
+	for _, pageSize := range []int{1, 7, 23, 100} {
+		httpClient, err := uhttp.NewClient(ctx)
+		if err != nil {
+			t.Fatalf("failed to create HTTP client: %v", err)
+		}
+		c := avalaraclient.NewAvalaraClient(server.URL, uhttp.NewBaseHttpClient(httpClient))
+		c.AddCredentials("testuser", "testpass")
+		c.SetPageSize(pageSize, false)
+
+		type lister func(options *avalaraclient.PaginationOptions) (int, *avalaraclient.PaginationOptions, error)
+		listers := map[string]struct {
+			list  lister
+			total int
+		}{
+			"roles": {func(o *avalaraclient.PaginationOptions) (int, *avalaraclient.PaginationOptions, error) {
+				resp, next, err := c.GetUserRoles(ctx, o)
+				if err != nil {
+					return 0, nil, err
+				}
+				return len(resp.Value), next, nil
+			}, len(d.SecurityRoles)},
+			"permissions": {func(o *avalaraclient.PaginationOptions) (int, *avalaraclient.PaginationOptions, error) {
+				resp, next, err := c.GetPermissions(ctx, o)
+				if err != nil {
+					return 0, nil, err
+				}
+				return len(resp.Value), next, nil
+			}, len(d.Permissions)},
+			"users": {func(o *avalaraclient.PaginationOptions) (int, *avalaraclient.PaginationOptions, error) {
+				resp, next, err := c.GetUsers(ctx, o)
+				if err != nil {
+					return 0, nil, err
+				}
+				return len(resp.Value), next, nil
+			}, len(d.Users)},
+			"audit events": {func(o *avalaraclient.PaginationOptions) (int, *avalaraclient.PaginationOptions, error) {
+				resp, next, err := c.GetAuditEvents(ctx, accountID, o)
+				if err != nil {
+					return 0, nil, err
+				}
+				return len(resp.Value), next, nil
+			}, len(d.AuditEvents)},
+		}
+
+		for name, l := range listers {
+			total := 0
+			options := &avalaraclient.PaginationOptions{}
+			for pages := 0; ; pages++ {
+				if pages > l.total+1 {
+					t.Fatalf("%s with page size %d: Expected the pages to end", name, pageSize)
+				}
+				n, next, err := l.list(options)
+				if err != nil {
+					t.Fatalf("%s with page size %d: Expected no error, got %v", name, pageSize, err)
+				}
+				total += n
+				if next == nil || next.PageToken == "" {
+					break
+				}
+				options = &avalaraclient.PaginationOptions{PageToken: next.PageToken}
+			}
+			if total != l.total {
+				t.Errorf("%s with page size %d: Expected %d records, got %d", name, pageSize, l.total, total)
+			}
+		}
+	}
+}
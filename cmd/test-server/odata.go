@@ -0,0 +1,762 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The test server evaluates OData $filter and $orderby expressions against its records. It
+// supports the subset AvaTax documents: comparisons, in, and/or/not, contains, startswith
+// and endswith, and parentheses. Anything else is rejected with a 400, as AvaTax does, rather
+// than silently matching every record.
+
+// filterExpr is a parsed $filter expression.
+type filterExpr interface {
+	eval(r record) (bool, error)
+}
+
+type literalKind int
+
+const (
+	literalString literalKind = iota
+	literalNumber
+	literalBool
+	literalNull
+	literalDate
+)
+
+type literal struct {
+	kind   literalKind
+	text   string
+	number float64
+	bool   bool
+	date   time.Time
+}
+
+func (l literal) String() string {
+	switch l.kind {
+	case literalString:
+		return "'" + strings.ReplaceAll(l.text, "'", "''") + "'"
+	default:
+		return l.text
+	}
+}
+
+type comparison struct {
+	field string
+	op    string
+	value literal
+}
+
+type inList struct {
+	field  string
+	values []literal
+}
+
+type stringFunction struct {
+	name  string
+	field string
+	value string
+}
+
+type logical struct {
+	op          string
+	left, right filterExpr
+}
+
+type negation struct {
+	expr filterExpr
+}
+
+func (c *comparison) eval(r record) (bool, error) {
+	actual, ok := r[c.field]
+	if c.value.kind == literalNull {
+		isNull := !ok || actual == nil
+		return isNull == (c.op == "eq"), nil
+	}
+	if !ok || actual == nil {
+		return c.op == "ne", nil
+	}
+
+	order, err := compareValue(c.field, actual, c.value, c.op)
+	if err != nil {
+		return false, err
+	}
+
+	switch c.op {
+	case "eq":
+		return order == 0, nil
+	case "ne":
+		return order != 0, nil
+	case "gt":
+		return order > 0, nil
+	case "ge":
+		return order >= 0, nil
+	case "lt":
+		return order < 0, nil
+	case "le":
+		return order <= 0, nil
+	}
+	return false, fmt.Errorf("unsupported operator '%s'", c.op)
+}
+
+func (c *inList) eval(r record) (bool, error) {
+	actual, ok := r[c.field]
+	for _, value := range c.values {
+		if value.kind == literalNull {
+			if !ok || actual == nil {
+				return true, nil
+			}
+			continue
+		}
+		if !ok || actual == nil {
+			continue
+		}
+
+		order, err := compareValue(c.field, actual, value, "eq")
+		if err != nil {
+			return false, err
+		}
+		if order == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *stringFunction) eval(r record) (bool, error) {
+	actual, ok := r[c.field]
+	if !ok || actual == nil {
+		return false, nil
+	}
+	s, ok := actual.(string)
+	if !ok {
+		return false, fmt.Errorf("%s() requires a text field, but '%s' is not text", c.name, c.field)
+	}
+
+	s, value := strings.ToLower(s), strings.ToLower(c.value)
+	switch c.name {
+	case "contains":
+		return strings.Contains(s, value), nil
+	case "startswith":
+		return strings.HasPrefix(s, value), nil
+	case "endswith":
+		return strings.HasSuffix(s, value), nil
+	}
+	return false, fmt.Errorf("unsupported function '%s'", c.name)
+}
+
+func (c *logical) eval(r record) (bool, error) {
+	left, err := c.left.eval(r)
+	if err != nil {
+		return false, err
+	}
+	if c.op == "and" && !left || c.op == "or" && left {
+		return left, nil
+	}
+	return c.right.eval(r)
+}
+
+func (c *negation) eval(r record) (bool, error) {
+	matched, err := c.expr.eval(r)
+	return !matched, err
+}
+
+// compareValue orders a record value against a literal of a compatible type. Text compares
+// case-insensitively, like the SQL collation behind AvaTax, and dates compare as times.
+func compareValue(field string, actual interface{}, value literal, op string) (int, error) {
+	mismatch := func(kind string) error {
+		return fmt.Errorf("cannot compare %s field '%s' with %s", kind, field, value)
+	}
+
+	switch v := actual.(type) {
+	case bool:
+		if value.kind != literalBool {
+			return 0, mismatch("boolean")
+		}
+		if op != "eq" && op != "ne" {
+			return 0, fmt.Errorf("boolean field '%s' only supports eq and ne", field)
+		}
+		if v == value.bool {
+			return 0, nil
+		}
+		return 1, nil
+	case string:
+		switch value.kind {
+		case literalString:
+			if t, ok := parseDate(v); ok {
+				if d, ok := parseDate(value.text); ok {
+					return t.Compare(d), nil
+				}
+			}
+			return strings.Compare(strings.ToLower(v), strings.ToLower(value.text)), nil
+		case literalDate:
+			t, ok := parseDate(v)
+			if !ok {
+				return 0, mismatch("text")
+			}
+			return t.Compare(value.date), nil
+		}
+		return 0, mismatch("text")
+	}
+
+	if n, ok := numberValue(actual); ok {
+		if value.kind != literalNumber {
+			return 0, mismatch("numeric")
+		}
+		switch {
+		case n < value.number:
+			return -1, nil
+		case n > value.number:
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("field '%s' cannot be filtered", field)
+}
+
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+var dateLayouts = []string{avalaraTimeLayout, "2006-01-02", time.RFC3339, "2006-01-02T15:04:05.999999999"}
+
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenDate
+	tokenOpen
+	tokenClose
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// tokenize splits an expression into identifiers, literals, parentheses and commas.
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenOpen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenClose, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+			i++
+		case c == '\'':
+			start := i
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string starting at position %d", start)
+				}
+				if runes[i] == '\'' {
+					// Quotes inside strings are escaped by doubling them.
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+			}
+			tokens = append(tokens, token{tokenString, sb.String(), start})
+		case unicode.IsDigit(c) || c == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			kind := tokenNumber
+			// Unquoted dates such as 2024-01-01 or 2024-01-01T08:00:00 start like numbers.
+			if i < len(runes) && (runes[i] == '-' || runes[i] == ':' || runes[i] == 'T') {
+				kind = tokenDate
+				for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune("-:T.Z+", runes[i])) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind, string(runes[start:i]), start})
+		case unicode.IsLetter(c) || c == '_' || c == '@':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '@') {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at position %d", c, i)
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "", len(runes)}), nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+// parseFilter parses a $filter expression.
+func parseFilter(filter string) (filterExpr, error) {
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", t.text, t.pos)
+	}
+	return expr, nil
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, unexpected(t, what)
+	}
+	return t, nil
+}
+
+func unexpected(t token, what string) error {
+	if t.kind == tokenEOF {
+		return fmt.Errorf("expected %s at the end of the filter", what)
+	}
+	return fmt.Errorf("expected %s at position %d, found '%s'", what, t.pos, t.text)
+}
+
+// isKeyword reports whether the next token is the given keyword. Keywords are case-insensitive.
+func (p *filterParser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterExpr, error) {
+	if p.isKeyword("not") {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &negation{expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+var stringFunctions = map[string]bool{"contains": true, "startswith": true, "endswith": true}
+
+var comparisonOperators = map[string]bool{"eq": true, "ne": true, "gt": true, "ge": true, "lt": true, "le": true}
+
+func (p *filterParser) parsePrimary() (filterExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenOpen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tokenClose, "')'")
+		if err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case tokenIdent:
+	default:
+		return nil, unexpected(t, "a field name")
+	}
+
+	if name := strings.ToLower(t.text); stringFunctions[name] && p.peek().kind == tokenOpen {
+		return p.parseStringFunction(name)
+	}
+
+	field := t.text
+	opToken := p.next()
+	op := strings.ToLower(opToken.text)
+	if opToken.kind != tokenIdent {
+		return nil, unexpected(opToken, "an operator")
+	}
+
+	if op == "in" {
+		return p.parseInList(field)
+	}
+	if !comparisonOperators[op] {
+		return nil, fmt.Errorf("unsupported operator '%s' at position %d", opToken.text, opToken.pos)
+	}
+
+	value, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if value.kind == literalNull && op != "eq" && op != "ne" {
+		return nil, fmt.Errorf("null can only be compared with eq and ne, found '%s' at position %d", opToken.text, opToken.pos)
+	}
+	return &comparison{field: field, op: op, value: value}, nil
+}
+
+func (p *filterParser) parseStringFunction(name string) (filterExpr, error) {
+	p.next()
+	field, err := p.expect(tokenIdent, "a field name")
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(tokenComma, "','")
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.expect(tokenString, "a string")
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(tokenClose, "')'")
+	if err != nil {
+		return nil, err
+	}
+	return &stringFunction{name: name, field: field.text, value: value.text}, nil
+}
+
+func (p *filterParser) parseInList(field string) (filterExpr, error) {
+	_, err := p.expect(tokenOpen, "'('")
+	if err != nil {
+		return nil, err
+	}
+
+	list := &inList{field: field}
+	for {
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		list.values = append(list.values, value)
+
+		t := p.next()
+		if t.kind == tokenClose {
+			return list, nil
+		}
+		if t.kind != tokenComma {
+			return nil, unexpected(t, "',' or ')'")
+		}
+	}
+}
+
+func (p *filterParser) parseLiteral() (literal, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return literal{kind: literalString, text: t.text}, nil
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return literal{}, fmt.Errorf("invalid number '%s' at position %d", t.text, t.pos)
+		}
+		return literal{kind: literalNumber, text: t.text, number: n}, nil
+	case tokenDate:
+		d, ok := parseDate(t.text)
+		if !ok {
+			return literal{}, fmt.Errorf("invalid date '%s' at position %d", t.text, t.pos)
+		}
+		return literal{kind: literalDate, text: t.text, date: d}, nil
+	case tokenIdent:
+		switch strings.ToLower(t.text) {
+		case "true", "false":
+			return literal{kind: literalBool, text: t.text, bool: strings.EqualFold(t.text, "true")}, nil
+		case "null":
+			return literal{kind: literalNull, text: t.text}, nil
+		}
+	}
+	return literal{}, unexpected(t, "a value")
+}
+
+// fieldResolver maps field names, case-insensitively, to the keys used by a set of records.
+type fieldResolver map[string]string
+
+func newFieldResolver(records []record) fieldResolver {
+	resolver := make(fieldResolver)
+	for _, r := range records {
+		for key := range r {
+			resolver[strings.ToLower(key)] = key
+		}
+	}
+	return resolver
+}
+
+func (f fieldResolver) resolve(name string) (string, error) {
+	key, ok := f[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("unknown field '%s'", name)
+	}
+	return key, nil
+}
+
+// resolveFields rewrites the field names of an expression to the record keys they refer to.
+func (f fieldResolver) resolveFields(expr filterExpr) error {
+	var err error
+	switch e := expr.(type) {
+	case *comparison:
+		e.field, err = f.resolve(e.field)
+	case *inList:
+		e.field, err = f.resolve(e.field)
+	case *stringFunction:
+		e.field, err = f.resolve(e.field)
+	case *logical:
+		err = f.resolveFields(e.left)
+		if err == nil {
+			err = f.resolveFields(e.right)
+		}
+	case *negation:
+		err = f.resolveFields(e.expr)
+	}
+	return err
+}
+
+// filterRecords returns the records that match a $filter expression.
+func filterRecords(records []record, filter string) ([]record, error) {
+	if strings.TrimSpace(filter) == "" {
+		return records, nil
+	}
+
+	expr, err := parseFilter(filter)
+	if err != nil {
+		return nil, invalidQuery("$filter", filter, err)
+	}
+	// Without records there is nothing to check field names against, and nothing to match.
+	if len(records) == 0 {
+		return records, nil
+	}
+	err = newFieldResolver(records).resolveFields(expr)
+	if err != nil {
+		return nil, invalidQuery("$filter", filter, err)
+	}
+
+	matched := []record{}
+	for _, r := range records {
+		ok, err := expr.eval(r)
+		if err != nil {
+			return nil, invalidQuery("$filter", filter, err)
+		}
+		if ok {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+type orderKey struct {
+	field      string
+	descending bool
+}
+
+// parseOrderBy parses a comma-separated list of fields, each optionally followed by asc or desc.
+func parseOrderBy(orderBy string, resolver fieldResolver) ([]orderKey, error) {
+	var keys []orderKey
+	for _, part := range strings.Split(orderBy, ",") {
+		words := strings.Fields(part)
+		if len(words) == 0 || len(words) > 2 {
+			return nil, fmt.Errorf("expected a field and an optional direction, found '%s'", strings.TrimSpace(part))
+		}
+
+		field, err := resolver.resolve(words[0])
+		if err != nil {
+			return nil, err
+		}
+		key := orderKey{field: field}
+		if len(words) == 2 {
+			switch strings.ToLower(words[1]) {
+			case "asc":
+			case "desc":
+				key.descending = true
+			default:
+				return nil, fmt.Errorf("unsupported sort direction '%s'", words[1])
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortRecords orders records by a $orderby expression. Missing values sort first.
+func sortRecords(records []record, orderBy string) error {
+	if strings.TrimSpace(orderBy) == "" || len(records) == 0 {
+		return nil
+	}
+
+	keys, err := parseOrderBy(orderBy, newFieldResolver(records))
+	if err != nil {
+		return invalidQuery("$orderby", orderBy, err)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, key := range keys {
+			order := compareForSort(records[i][key.field], records[j][key.field])
+			if order == 0 {
+				continue
+			}
+			if key.descending {
+				return order > 0
+			}
+			return order < 0
+		}
+		return false
+	})
+	return nil
+}
+
+func compareForSort(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	if x, ok := numberValue(a); ok {
+		if y, ok := numberValue(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(bool); ok {
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(strings.ToLower(fmt.Sprint(a)), strings.ToLower(fmt.Sprint(b)))
+}
+
+func invalidQuery(parameter, value string, err error) *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "InvalidFilter",
+		message: fmt.Sprintf("Unable to parse %s: %v", parameter, err),
+		target:  parameter,
+		details: []string{fmt.Sprintf("The %s '%s' is not supported: %v", parameter, value, err)},
+	}
+}
+
+// queryParam returns a query parameter, accepting any capitalization of its name, such as
+// $orderby and $orderBy.
+func queryParam(r *http.Request, name string) string {
+	for key, values := range r.URL.Query() {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// queryRecords applies the request's $filter and $orderby to records. It sends an error and
+// returns false when either is invalid.
+func queryRecords(w http.ResponseWriter, r *http.Request, records []record) ([]record, bool) {
+	records, err := filterRecords(records, queryParam(r, "$filter"))
+	if err == nil {
+		err = sortRecords(records, queryParam(r, "$orderby"))
+	}
+	if err != nil {
+		sendAPIError(w, err)
+		return nil, false
+	}
+	return records, true
+}
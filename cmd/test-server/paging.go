@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxPageSize is the most records AvaTax returns from one call. It is also the page size when
+// a request does not set $top.
+const maxPageSize = 1000
+
+// paginate returns the range of total records selected by the request's $top and $skip, and
+// the link to the next page, which is empty unless records remain after the range. It sends
+// an error and returns false when $top or $skip is not a number of records.
+func paginate(w http.ResponseWriter, r *http.Request, total int) (int, int, string, bool) {
+	top, err := pageParam(r, "$top")
+	if err == nil && top == 0 || top > maxPageSize {
+		top = maxPageSize
+	}
+	var skip int
+	if err == nil {
+		skip, err = pageParam(r, "$skip")
+	}
+	if err != nil {
+		sendAPIError(w, err)
+		return 0, 0, "", false
+	}
+
+	start := min(skip, total)
+	end := min(start+top, total)
+	if end == total {
+		return start, end, "", true
+	}
+
+	// The next link keeps the request's other parameters, so the next page is filtered and
+	// ordered the same way.
+	query := url.Values{}
+	for key, values := range r.URL.Query() {
+		if !strings.EqualFold(key, "$top") && !strings.EqualFold(key, "$skip") {
+			query[key] = values
+		}
+	}
+	query.Set("$top", strconv.Itoa(top))
+	query.Set("$skip", strconv.Itoa(end))
+	return start, end, requestBaseURL(r) + r.URL.Path + "?" + query.Encode(), true
+}
+
+// pageParam parses $top or $skip, which must be a number of records when it is set.
+func pageParam(r *http.Request, name string) (int, error) {
+	value := queryParam(r, name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, invalidField("InvalidParameter", name, fmt.Sprintf("'%s' is not a valid value for %s.", value, name))
+	}
+	return n, nil
+}
+
+// sendPage sends one page of a list, in the form AvaTax uses for every list endpoint.
+func sendPage(w http.ResponseWriter, value interface{}, total int, nextLink string) {
+	response := map[string]interface{}{
+		"@recordsetCount": total,
+		"value":           value,
+	}
+	if nextLink != "" {
+		response["@nextLink"] = nextLink
+	}
+	sendJSONResponse(w, response)
+}
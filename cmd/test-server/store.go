@@ -0,0 +1,618 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// avalaraTimeLayout is the layout AvaTax uses for dates, in UTC without a zone designator.
+const avalaraTimeLayout = "2006-01-02T15:04:05"
+
+// record is one JSON object served by the test server.
+type record map[string]interface{}
+
+// intField returns a numeric field of a record as an int. Fields decoded from JSON are float64 or json.Number.
+func (r record) intField(name string) (int, bool) {
+	switch v := r[name].(type) {
+	case int:
+		return v, true
+	case float64:
+		return int(v), true
+	case json.Number:
+		n, err := v.Int64()
+		return int(n), err == nil
+	}
+	return 0, false
+}
+
+// stringField returns a string field of a record, or "" when it is missing.
+func (r record) stringField(name string) string {
+	s, _ := r[name].(string)
+	return s
+}
+
+// etag identifies the current version of a record. Any change to a field changes it, even within
+// the same second, which modifiedDate cannot tell apart.
+func (r record) etag() string {
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func (r record) clone() record {
+	c := make(record, len(r))
+	for k, v := range r {
+		c[k] = v
+	}
+	return c
+}
+
+// apiError is an AvaTax error response.
+type apiError struct {
+	status  int
+	code    string
+	message string
+	target  string
+	details []string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+func notFound(entity string, id int) *apiError {
+	return &apiError{
+		status:  http.StatusNotFound,
+		code:    "EntityNotFoundError",
+		message: fmt.Sprintf("%s not found", entity),
+		target:  "HttpRequest",
+		details: []string{fmt.Sprintf("The %s with the ID %d was not found.", strings.ToLower(entity), id)},
+	}
+}
+
+func invalidField(code, field, message string) *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    code,
+		message: message,
+		target:  field,
+		details: []string{message},
+	}
+}
+
+// store holds the test server's data in memory so that provisioning requests change what later requests return.
+type store struct {
+	mu      sync.Mutex
+	initial *dataset
+
+	accounts  []record
+	companies []record
+	// users are replaced rather than changed, so lists of them can be read without the lock.
+	users        []record
+	userIndex    map[int]int
+	roles        []record
+	permissions  []string
+	entitlements map[int]record
+	auditEvents  []record
+	// licenseKeys holds the private license key of each account whose key was reset.
+	licenseKeys map[int]string
+
+	// now is replaced in tests to make timestamps predictable.
+	now func() time.Time
+}
+
+func newStore(initial *dataset) *store {
+	s := &store{
+		initial: initial,
+		now:     time.Now,
+	}
+	s.reset()
+	return s
+}
+
+// reset discards every change and restores the initial dataset.
+func (s *store) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accounts = cloneRecords(s.initial.Accounts)
+	s.companies = cloneRecords(s.initial.Companies)
+	s.users = cloneRecords(s.initial.Users)
+	s.userIndex = make(map[int]int, len(s.users))
+	for i, u := range s.users {
+		id, _ := u.intField("id")
+		s.userIndex[id] = i
+	}
+	s.roles = cloneRecords(s.initial.SecurityRoles)
+	s.permissions = append([]string(nil), s.initial.Permissions...)
+	s.auditEvents = cloneRecords(s.initial.AuditEvents)
+	s.licenseKeys = make(map[int]string)
+
+	s.entitlements = make(map[int]record, len(s.initial.Entitlements))
+	for _, e := range s.initial.Entitlements {
+		userID, ok := e.intField("userId")
+		if !ok {
+			continue
+		}
+		e = e.clone()
+		delete(e, "userId")
+		s.entitlements[userID] = e
+	}
+}
+
+func cloneRecords(records []record) []record {
+	clones := make([]record, 0, len(records))
+	for _, r := range records {
+		clones = append(clones, r.clone())
+	}
+	return clones
+}
+
+func (s *store) timestamp() string {
+	return s.now().UTC().Format(avalaraTimeLayout)
+}
+
+// The list and get methods return copies, except where noted, so handlers can add fields without changing the store.
+func (s *store) listCompanies() []record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cloneRecords(s.companies)
+}
+
+// listUsers returns the users without copying each of them, which would be slow for large
+// datasets. The users must be cloned before they are changed.
+func (s *store) listUsers() []record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]record(nil), s.users...)
+}
+
+func (s *store) listRoles() []record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cloneRecords(s.roles)
+}
+
+// ping returns the response of the ping endpoint, which identifies the authenticated user.
+func (s *store) ping() record {
+	return s.initial.Ping.clone()
+}
+
+// actor returns the authenticated user, whom audit events record as the actor of every change.
+func (s *store) actor() record {
+	return record{"id": s.initial.Ping["authenticatedUserId"], "userName": s.initial.Ping["authenticatedUserName"]}
+}
+
+func (s *store) listPermissions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.permissions...)
+}
+
+// listAccountUsers returns the users of an account. Like listUsers, it does not copy them.
+func (s *store) listAccountUsers(accountID int) ([]record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findAccount(accountID) == nil {
+		return nil, notFound("Account", accountID)
+	}
+
+	var users []record
+	for _, u := range s.users {
+		if id, _ := u.intField("accountId"); id == accountID {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (s *store) listAuditEvents(accountID int) ([]record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findAccount(accountID) == nil {
+		return nil, notFound("Account", accountID)
+	}
+
+	var events []record
+	for _, e := range s.auditEvents {
+		if id, _ := e.intField("accountId"); id == accountID {
+			events = append(events, e.clone())
+		}
+	}
+	return events, nil
+}
+
+func (s *store) getAccount(accountID int) (record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account := s.findAccount(accountID)
+	if account == nil {
+		return nil, notFound("Account", accountID)
+	}
+	return account.clone(), nil
+}
+
+func (s *store) getUser(accountID, userID int) (record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.findAccountUser(accountID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return user.clone(), nil
+}
+
+func (s *store) getEntitlements(accountID, userID int) (record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.findAccountUser(accountID, userID); err != nil {
+		return nil, err
+	}
+	if e, ok := s.entitlements[userID]; ok {
+		return e.clone(), nil
+	}
+	return s.initial.DefaultEntitlements.clone(), nil
+}
+
+// createUsers validates every user before creating any, as AvaTax does.
+func (s *store) createUsers(accountID int, users []record, actor record) ([]record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findAccount(accountID) == nil {
+		return nil, notFound("Account", accountID)
+	}
+	if len(users) == 0 {
+		return nil, invalidField("ValueRequiredError", "Users", "At least one user is required.")
+	}
+
+	seen := make(map[string]bool, len(users))
+	for _, u := range users {
+		err := s.validateUser(accountID, 0, u)
+		if err != nil {
+			return nil, err
+		}
+		userName := strings.ToLower(u.stringField("userName"))
+		if seen[userName] {
+			return nil, duplicateUserName(u.stringField("userName"))
+		}
+		seen[userName] = true
+	}
+
+	created := make([]record, 0, len(users))
+	for _, u := range users {
+		now := s.timestamp()
+		user := record{
+			"id":                   s.nextUserID(),
+			"accountId":            accountID,
+			"companyId":            0,
+			"userName":             u.stringField("userName"),
+			"firstName":            u.stringField("firstName"),
+			"lastName":             u.stringField("lastName"),
+			"email":                u.stringField("email"),
+			"postalCode":           u.stringField("postalCode"),
+			"securityRoleId":       u.stringField("securityRoleId"),
+			"passwordStatus":       "UserMustChange",
+			"isActive":             true,
+			"suppressNewUserEmail": u["suppressNewUserEmail"] == true,
+			"isDeleted":            false,
+			"createdDate":          now,
+			"modifiedDate":         now,
+		}
+		if companyID, ok := u.intField("companyId"); ok {
+			user["companyId"] = companyID
+		}
+		if user["securityRoleId"] == "" {
+			user["securityRoleId"] = defaultSecurityRole
+		}
+		if isActive, ok := u["isActive"].(bool); ok {
+			user["isActive"] = isActive
+		}
+
+		s.putUser(user)
+		s.recordEvent(accountID, "UserCreated", actor, user, "")
+		created = append(created, user.clone())
+	}
+	return created, nil
+}
+
+// updateUser replaces the editable fields of a user. The ID, account and dates are kept.
+// The update is rejected when the user no longer meets its preconditions.
+func (s *store) updateUser(accountID, userID int, update record, actor record, pre precondition) (record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.findAccountUser(accountID, userID)
+	if err != nil {
+		return nil, err
+	}
+	err = pre.check(user)
+	if err != nil {
+		return nil, err
+	}
+	if user["isDeleted"] == true {
+		return nil, invalidField("CannotModifyDeletedRecords", "User", "Deleted users cannot be modified.")
+	}
+	if id, ok := update.intField("id"); ok && id != 0 && id != userID {
+		return nil, invalidField("InvalidIdentifier", "Id", fmt.Sprintf("The user ID %d does not match the URL.", id))
+	}
+	if id, ok := update.intField("accountId"); ok && id != 0 && id != accountID {
+		return nil, invalidField("CannotChangeAccount", "AccountId", "A user cannot be moved to another account.")
+	}
+	err = s.validateUser(accountID, userID, update)
+	if err != nil {
+		return nil, err
+	}
+
+	user = user.clone()
+	previousRole := user.stringField("securityRoleId")
+	for _, field := range []string{"userName", "firstName", "lastName", "email", "postalCode", "securityRoleId"} {
+		if v, ok := update[field].(string); ok {
+			user[field] = v
+		}
+	}
+	if companyID, ok := update.intField("companyId"); ok {
+		user["companyId"] = companyID
+	}
+	for _, field := range []string{"isActive", "suppressNewUserEmail"} {
+		if v, ok := update[field].(bool); ok {
+			user[field] = v
+		}
+	}
+	user["modifiedDate"] = s.timestamp()
+	s.putUser(user)
+
+	eventType := "UserUpdated"
+	if user.stringField("securityRoleId") != previousRole {
+		eventType = "SecurityRoleChanged"
+	}
+	s.recordEvent(accountID, eventType, actor, user, previousRole)
+
+	return user.clone(), nil
+}
+
+// deleteUser marks a user deleted and inactive. Deleted users are still listed, as in AvaTax.
+func (s *store) deleteUser(accountID, userID int, actor record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.findAccountUser(accountID, userID)
+	if err != nil {
+		return err
+	}
+	if user["isDeleted"] == true {
+		return notFound("User", userID)
+	}
+
+	user = user.clone()
+	user["isDeleted"] = true
+	user["isActive"] = false
+	user["modifiedDate"] = s.timestamp()
+	s.putUser(user)
+	s.recordEvent(accountID, "UserDeleted", actor, user, "")
+	return nil
+}
+
+// resetPassword sets a user's password. The user must change it at their next login.
+func (s *store) resetPassword(userID int, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.findUser(userID)
+	if user == nil || user["isDeleted"] == true {
+		return notFound("User", userID)
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	user = user.clone()
+	user["passwordStatus"] = "UserMustChange"
+	user["modifiedDate"] = s.timestamp()
+	s.putUser(user)
+	return nil
+}
+
+// resetLicenseKey replaces the private license key of an account and returns the new one.
+func (s *store) resetLicenseKey(accountID int, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findAccount(accountID) == nil {
+		return "", notFound("Account", accountID)
+	}
+	s.licenseKeys[accountID] = key
+	return key, nil
+}
+
+func (s *store) findAccount(accountID int) record {
+	for _, a := range s.accounts {
+		if id, _ := a.intField("id"); id == accountID {
+			return a
+		}
+	}
+	return nil
+}
+
+func (s *store) findUser(userID int) record {
+	i, ok := s.userIndex[userID]
+	if !ok {
+		return nil
+	}
+	return s.users[i]
+}
+
+// putUser stores a new or changed user. A changed user replaces the previous record, which
+// lists returned earlier may still hold.
+func (s *store) putUser(user record) {
+	id, _ := user.intField("id")
+	if i, ok := s.userIndex[id]; ok {
+		s.users[i] = user
+		return
+	}
+	s.userIndex[id] = len(s.users)
+	s.users = append(s.users, user)
+}
+
+func (s *store) findAccountUser(accountID, userID int) (record, error) {
+	if s.findAccount(accountID) == nil {
+		return nil, notFound("Account", accountID)
+	}
+	user := s.findUser(userID)
+	if id, _ := user.intField("accountId"); user == nil || id != accountID {
+		return nil, notFound("User", userID)
+	}
+	return user, nil
+}
+
+func (s *store) nextUserID() int {
+	next := 1
+	for _, u := range s.users {
+		if id, _ := u.intField("id"); id >= next {
+			next = id + 1
+		}
+	}
+	return next
+}
+
+// companyScopedRoles can only be held by users assigned to a company.
+var companyScopedRoles = map[string]bool{
+	"CompanyAdmin":   true,
+	"CompanyUser":    true,
+	"ECMCompanyUser": true,
+}
+
+// defaultSecurityRole is given to users created without a security role.
+const defaultSecurityRole = "CompanyUser"
+
+// validateUser checks a user being created, or updated when userID is not zero. Fields
+// missing from an update keep their current value.
+func (s *store) validateUser(accountID, userID int, u record) error {
+	existing := record{}
+	if userID != 0 {
+		existing = s.findUser(userID)
+	}
+	value := func(field string) string {
+		if v, ok := u[field].(string); ok {
+			return v
+		}
+		return existing.stringField(field)
+	}
+
+	for _, field := range []string{"userName", "email", "firstName", "lastName"} {
+		if strings.TrimSpace(value(field)) == "" {
+			return invalidField("ValueRequiredError", field, fmt.Sprintf("Field '%s' is required.", field))
+		}
+	}
+	if len(value("userName")) > 50 {
+		return invalidField("StringLengthError", "userName", "Field 'userName' must be between 1 and 50 characters.")
+	}
+	if !strings.Contains(value("email"), "@") {
+		return invalidField("InvalidEmailAddress", "email", fmt.Sprintf("'%s' is not a valid email address.", value("email")))
+	}
+
+	for _, other := range s.users {
+		if id, _ := other.intField("id"); id != userID && strings.EqualFold(other.stringField("userName"), value("userName")) {
+			return duplicateUserName(value("userName"))
+		}
+	}
+
+	role := value("securityRoleId")
+	if role == "" && userID == 0 {
+		role = defaultSecurityRole
+	}
+	if !s.roleExists(role) {
+		return invalidField("InvalidSecurityRole", "securityRoleId", fmt.Sprintf("'%s' is not a valid security role.", role))
+	}
+
+	companyID, ok := u.intField("companyId")
+	if !ok {
+		companyID, _ = existing.intField("companyId")
+	}
+	if companyID != 0 {
+		company := s.findCompany(companyID)
+		if id, _ := company.intField("accountId"); company == nil || id != accountID {
+			return invalidField("EntityNotFoundError", "companyId", fmt.Sprintf("Company %d does not belong to account %d.", companyID, accountID))
+		}
+	} else if companyScopedRoles[role] {
+		return invalidField("CompanyRequired", "companyId", fmt.Sprintf("Users with the %s security role must be assigned to a company.", role))
+	}
+
+	return nil
+}
+
+func duplicateUserName(userName string) *apiError {
+	return &apiError{
+		status:  http.StatusConflict,
+		code:    "DuplicateEntityError",
+		message: fmt.Sprintf("Duplicate user '%s'", userName),
+		target:  "userName",
+		details: []string{fmt.Sprintf("A user with the user name '%s' already exists.", userName)},
+	}
+}
+
+// validatePassword applies the AvaTax password rules: 8 to 50 characters, with a letter and a digit.
+func validatePassword(password string) error {
+	if len(password) < 8 || len(password) > 50 {
+		return invalidField("PasswordLengthInvalid", "newPassword", "Passwords must be between 8 and 50 characters.")
+	}
+	if !strings.ContainsAny(password, "0123456789") || !strings.ContainsAny(strings.ToLower(password), "abcdefghijklmnopqrstuvwxyz") {
+		return invalidField("PasswordComplexityInvalid", "newPassword", "Passwords must contain at least one letter and one digit.")
+	}
+	return nil
+}
+
+func (s *store) roleExists(description string) bool {
+	for _, r := range s.roles {
+		if r.stringField("description") == description {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *store) findCompany(companyID int) record {
+	for _, c := range s.companies {
+		if id, _ := c.intField("id"); id == companyID {
+			return c
+		}
+	}
+	return nil
+}
+
+// recordEvent appends an audit event for a change to user made by actor.
+func (s *store) recordEvent(accountID int, eventType string, actor, user record, previousRole string) {
+	nextID := 1
+	for _, e := range s.auditEvents {
+		if id, _ := e.intField("id"); id >= nextID {
+			nextID = id + 1
+		}
+	}
+
+	event := record{
+		"id":             nextID,
+		"accountId":      accountID,
+		"eventType":      eventType,
+		"timestamp":      s.timestamp(),
+		"userId":         actor["id"],
+		"userName":       actor["userName"],
+		"targetUserId":   user["id"],
+		"targetUserName": user["userName"],
+		"securityRoleId": user["securityRoleId"],
+	}
+	if previousRole != "" {
+		event["previousSecurityRoleId"] = previousRole
+	}
+	s.auditEvents = append(s.auditEvents, event)
+}
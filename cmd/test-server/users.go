@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (s *server) handleAccountUsers(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}/users", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
+	}
+
+	users, err := s.store.listAccountUsers(accountID)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendUserList(w, r, users)
+}
+
+// handleCreateUsers creates the users in the request body, which is a list as in AvaTax.
+func (s *server) handleCreateUsers(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}/users", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
+	}
+
+	var users []record
+	if !decodeBody(w, r, &users) {
+		return
+	}
+
+	created, err := s.store.createUsers(accountID, users, s.store.actor())
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSONResponseWithStatus(w, http.StatusCreated, created)
+}
+
+func (s *server) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}/users/{userId}", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
+	}
+	userID, ok := pathID(w, r, "userId")
+	if !ok {
+		return
+	}
+
+	user, err := s.store.getUser(accountID, userID)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	w.Header().Set("ETag", user.etag())
+	sendJSONResponse(w, user)
+}
+
+func (s *server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}/users/{userId}", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
+	}
+	userID, ok := pathID(w, r, "userId")
+	if !ok {
+		return
+	}
+
+	var update record
+	if !decodeBody(w, r, &update) {
+		return
+	}
+
+	user, err := s.store.updateUser(accountID, userID, update, s.store.actor(), preconditionOf(r))
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	w.Header().Set("ETag", user.etag())
+	sendJSONResponse(w, user)
+}
+
+// precondition is the version of a record an update was based on, from its If-Match and
+// If-Unmodified-Since headers. A zero precondition always holds.
+type precondition struct {
+	ifMatch           string
+	ifUnmodifiedSince time.Time
+}
+
+// preconditionOf reads the preconditions of a request. An If-Unmodified-Since that is not an HTTP date is ignored.
+func preconditionOf(r *http.Request) precondition {
+	pre := precondition{ifMatch: r.Header.Get("If-Match")}
+	if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil {
+		pre.ifUnmodifiedSince = since
+	}
+	return pre
+}
+
+// check returns a 412 error when the record has changed since the version the precondition names.
+func (pre precondition) check(r record) error {
+	if pre.ifMatch != "" && pre.ifMatch != "*" && pre.ifMatch != r.etag() {
+		return preconditionFailed()
+	}
+	if !pre.ifUnmodifiedSince.IsZero() {
+		modified, err := time.Parse(avalaraTimeLayout, r.stringField("modifiedDate"))
+		if err == nil && modified.After(pre.ifUnmodifiedSince) {
+			return preconditionFailed()
+		}
+	}
+	return nil
+}
+
+func preconditionFailed() *apiError {
+	return &apiError{
+		status:  http.StatusPreconditionFailed,
+		code:    "PreconditionFailed",
+		message: "The record was modified since it was read.",
+	}
+}
+
+func (s *server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}/users/{userId}", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
+	}
+	userID, ok := pathID(w, r, "userId")
+	if !ok {
+		return
+	}
+
+	err := s.store.deleteUser(accountID, userID, s.store.actor())
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSONResponse(w, []record{})
+}
+
+func (s *server) handleUserEntitlements(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}/users/{userId}/entitlements", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
+	}
+	userID, ok := pathID(w, r, "userId")
+	if !ok {
+		return
+	}
+
+	entitlements, err := s.store.getEntitlements(accountID, userID)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSONResponse(w, entitlements)
+}
+
+// handleResetPassword sets a user's password from a body of the form {"newPassword": "..."}.
+func (s *server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/passwords/{userId}/reset", r)
+	userID, ok := pathID(w, r, "userId")
+	if !ok {
+		return
+	}
+
+	var body struct {
+		NewPassword string `json:"newPassword"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+
+	err := s.store.resetPassword(userID, body.NewPassword)
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+	sendJSONResponse(w, "Success")
+}
+
+// handleResetLicenseKey replaces an account's license key. The request must confirm the reset,
+// because the previous key stops working immediately.
+func (s *server) handleResetLicenseKey(w http.ResponseWriter, r *http.Request) {
+	logRequest("/api/v2/accounts/{accountId}/resetlicensekey", r)
+	accountID, ok := pathID(w, r, "accountId")
+	if !ok {
+		return
+	}
+
+	var body struct {
+		AccountID              int  `json:"accountId"`
+		ConfirmResetLicenseKey bool `json:"confirmResetLicenseKey"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.AccountID != accountID {
+		sendAPIError(w, invalidField("InvalidIdentifier", "accountId", fmt.Sprintf("The account ID %d does not match the URL.", body.AccountID)))
+		return
+	}
+	if !body.ConfirmResetLicenseKey {
+		sendAPIError(w, invalidField("ValueRequiredError", "confirmResetLicenseKey", "Resetting the license key must be confirmed."))
+		return
+	}
+
+	key, err := s.store.resetLicenseKey(accountID, strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")))
+	if err != nil {
+		sendAPIError(w, err)
+		return
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", accountID, key)))
+	sendJSONResponse(w, map[string]interface{}{
+		"accountId":         accountID,
+		"privateLicenseKey": key,
+		"httpRequestHeader": "Basic " + credentials,
+	})
+}
+
+// handleReset restores the initial dataset and removes any faults, so tests don't see each other's changes.
+func (s *server) handleReset(w http.ResponseWriter, r *http.Request) {
+	logRequest("/testing/reset", r)
+	s.store.reset()
+	s.faults.set(nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pathID parses a numeric path parameter, and sends an error when it is not a number.
+func pathID(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue(name))
+	if err != nil {
+		sendAPIError(w, invalidField("InvalidIdentifier", name, fmt.Sprintf("'%s' is not a valid %s.", r.PathValue(name), name)))
+		return 0, false
+	}
+	return id, true
+}
+
+// decodeBody decodes a JSON request body, and sends an error when it is not valid JSON.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	err := decoder.Decode(v)
+	if err != nil {
+		sendAPIError(w, invalidField("JsonFormatError", "HttpRequest", fmt.Sprintf("The request body is not valid JSON: %v", err)))
+		return false
+	}
+	return true
+}
+
+// sendAPIError sends an AvaTax error response. Errors that are not API errors are internal server errors.
+func sendAPIError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		log.Printf("Internal error: %v", err)
+		sendErrorResponse(w, http.StatusInternalServerError, "ServerConfiguration", err.Error(), "HttpRequest", nil)
+		return
+	}
+	sendErrorResponse(w, apiErr.status, apiErr.code, apiErr.message, apiErr.target, apiErr.details)
+}
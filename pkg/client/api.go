@@ -0,0 +1,26 @@
+package client
+
+import (
+	"context"
+)
+
+// AvalaraAPI is the part of the Avalara API the connector uses. AvalaraClient implements it
+// against the API itself, and tests can implement it with fixed data.
+type AvalaraAPI interface {
+	Ping(ctx context.Context) (*PingResponse, error)
+	Probe(ctx context.Context, endpoint string, result interface{}) (*ProbeResult, error)
+	GetAccount(ctx context.Context, accountID int) (*AccountModel, error)
+	GetUsers(ctx context.Context, options *PaginationOptions) (*UserResponse, *PaginationOptions, error)
+	GetUser(ctx context.Context, accountID, userID int) (*UserModel, error)
+	UpdateUser(ctx context.Context, accountID, userID int, user *UserModel) (*UserModel, error)
+	GetUserRoles(ctx context.Context, options *PaginationOptions) (*SecurityRoleResponse, *PaginationOptions, error)
+	GetPermissions(ctx context.Context, options *PaginationOptions) (*PermissionResponse, *PaginationOptions, error)
+	GetUserEntitlements(ctx context.Context, accountID, userID int) (*EntitlementResponse, error)
+	GetAuditEvents(ctx context.Context, accountID int, options *PaginationOptions) (*AuditEventResponse, *PaginationOptions, error)
+
+	// MetricsSummary and RecordRetry report on the requests sent through the API.
+	MetricsSummary() MetricsSummary
+	RecordRetry(ctx context.Context, endpoint string)
+}
+
+var _ AvalaraAPI = (*AvalaraClient)(nil)
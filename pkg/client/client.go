@@ -4,16 +4,25 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/conductorone/baton-sdk/pkg/metrics"
 	"github.com/conductorone/baton-sdk/pkg/uhttp"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
 )
 
+// AvalaraTimeLayout is the layout AvaTax uses for dates, in UTC without a zone designator.
+const AvalaraTimeLayout = "2006-01-02T15:04:05"
+
 const (
 	SandboxBaseDomain = "sandbox-rest.avatax.com"
 	ProductionBaseURL = "https://rest.avatax.com"
@@ -27,15 +36,24 @@ type AvalaraClient struct {
 	httpClient   *uhttp.BaseHttpClient
 	credentials  string
 	clientHeader string
+	dryRun       bool
+	pageSizer    *pageSizer
+	// allowedOrigins holds the scheme://host:port origins next links may point at.
+	allowedOrigins map[string]bool
+	metrics        *clientMetrics
 }
 
 // PaginationOptions represents the pagination parameters.
+// A zero Top requests the client's configured page size. A PageToken returned by a
+// previous call takes precedence over every other field. A NextLink, whether set by the
+// caller or returned by the API, must point at an allowed host.
 type PaginationOptions struct {
-	Top      int
-	Skip     int
-	OrderBy  string
-	Filter   string
-	NextLink string
+	Top       int
+	Skip      int
+	OrderBy   string
+	Filter    string
+	NextLink  string
+	PageToken string
 }
 
 // PaginatedResponse is a generic interface for paginated responses.
@@ -64,11 +82,18 @@ func NewAvalaraClient(environment string, httpClient *uhttp.BaseHttpClient) *Ava
 
 	clientID := fmt.Sprintf("%s; %s; Go SDK; API_VERSION", appName, appVersion)
 
-	return &AvalaraClient{
+	c := &AvalaraClient{
 		baseURL:      baseURL,
 		httpClient:   httpClient,
 		clientHeader: clientID,
+		pageSizer:    newPageSizer(DefaultPageSize, false),
+		metrics:      newClientMetrics(metrics.NewNoOpHandler(context.Background())),
+	}
+	c.SetAllowedHosts(nil)
+	if httpClient != nil && httpClient.HttpClient != nil {
+		meterTransport(httpClient.HttpClient)
 	}
+	return c
 }
 
 // AddCredentials configures the client with username and password.
@@ -76,6 +101,70 @@ func (c *AvalaraClient) AddCredentials(username, password string) {
 	c.credentials = base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
 }
 
+// SetPageSize configures the page size used when PaginationOptions.Top is zero, capped at MaxPageSize.
+// In adaptive mode the page size shrinks after timeouts and server errors and grows back on healthy responses.
+func (c *AvalaraClient) SetPageSize(pageSize int, adaptive bool) {
+	c.pageSizer = newPageSizer(pageSize, adaptive)
+}
+
+// SetMetricsHandler records request metrics through handler. Totals are restarted.
+func (c *AvalaraClient) SetMetricsHandler(handler metrics.Handler) {
+	c.metrics = newClientMetrics(handler)
+}
+
+// MetricsSummary returns the totals of the requests sent so far.
+func (c *AvalaraClient) MetricsSummary() MetricsSummary {
+	return c.metrics.summary()
+}
+
+// RecordRetry counts a request to endpoint that the caller is about to retry.
+func (c *AvalaraClient) RecordRetry(ctx context.Context, endpoint string) {
+	c.metrics.recordRetry(ctx, endpoint)
+}
+
+// SetAllowedHosts lets next links point at hosts other than the base URL's, such as a proxy
+// that rewrites them. Entries are host names or host:port pairs over the base URL's scheme,
+// and a host name without a port allows only that scheme's default port. The base URL's
+// host and port are always allowed.
+func (c *AvalaraClient) SetAllowedHosts(hosts []string) {
+	c.allowedOrigins = make(map[string]bool, len(hosts)+1)
+	base, err := url.Parse(c.baseURL)
+	if err != nil || base.Host == "" {
+		return
+	}
+	c.allowedOrigins[origin(base.Scheme, base.Host)] = true
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host != "" {
+			c.allowedOrigins[origin(base.Scheme, host)] = true
+		}
+	}
+}
+
+// origin returns scheme://host:port in lower case, with the scheme's default port when host
+// has none, so that a host written with or without its default port compares equal.
+func origin(scheme, host string) string {
+	scheme = strings.ToLower(scheme)
+	hostname, port, err := net.SplitHostPort(strings.ToLower(host))
+	if err != nil {
+		hostname, port = strings.Trim(strings.ToLower(host), "[]"), ""
+	}
+	if port == "" {
+		switch scheme {
+		case "https":
+			port = "443"
+		case "http":
+			port = "80"
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(hostname, port)
+}
+
+// SetDryRun configures whether mutating requests are logged instead of sent.
+func (c *AvalaraClient) SetDryRun(dryRun bool) {
+	c.dryRun = dryRun
+}
+
 // AvalaraError represents an error returned by the Avalara API.
 type AvalaraError struct {
 	Code    string `json:"code"`
@@ -88,6 +177,12 @@ func (e *AvalaraError) Error() string {
 	return fmt.Sprintf("AvalaraError: %s (Code: %s, Target: %s, Details: %s)", e.Message, e.Code, e.Target, e.Details)
 }
 
+// ErrUntrustedNextLink is returned when a next link points at a host the client does not trust.
+var ErrUntrustedNextLink = errors.New("avalara-connector: refusing to follow next link to an untrusted host")
+
+// ErrConcurrentModification is returned when a user changed between being read and being updated.
+var ErrConcurrentModification = errors.New("avalara-connector: resource was modified concurrently")
+
 // AvalaraErrorResponse represents the structure of an error response.
 type AvalaraErrorResponse struct {
 	Error AvalaraError `json:"error"`
@@ -97,8 +192,21 @@ func (c *AvalaraClient) get(ctx context.Context, endpoint string, options *Pagin
 	var u *url.URL
 	var err error
 
+	if options != nil && options.PageToken != "" {
+		options, err = c.optionsFromPageToken(endpoint, options.PageToken)
+		if err != nil {
+			return err
+		}
+	}
+
 	if options != nil && options.NextLink != "" {
 		u, err = url.Parse(options.NextLink)
+		if err == nil {
+			err = c.checkNextLink(u)
+			if err != nil {
+				return err
+			}
+		}
 	} else {
 		u, err = url.Parse(c.baseURL + endpoint)
 	}
@@ -106,10 +214,19 @@ func (c *AvalaraClient) get(ctx context.Context, endpoint string, options *Pagin
 		return fmt.Errorf("error parsing URL: %w", err)
 	}
 
+	// Adaptive page sizes override the $top baked into a next link, which still carries the right $skip.
+	if options != nil && options.NextLink != "" && c.pageSizer.adaptive {
+		query := u.Query()
+		query.Set("$top", strconv.Itoa(c.pageSizer.size()))
+		u.RawQuery = query.Encode()
+	}
+
 	if options != nil && options.NextLink == "" {
 		query := u.Query()
 		if options.Top > 0 {
-			query.Set("$top", strconv.Itoa(options.Top))
+			query.Set("$top", strconv.Itoa(min(options.Top, MaxPageSize)))
+		} else {
+			query.Set("$top", strconv.Itoa(c.pageSizer.size()))
 		}
 		if options.Skip > 0 {
 			query.Set("$skip", strconv.Itoa(options.Skip))
@@ -123,9 +240,132 @@ func (c *AvalaraClient) get(ctx context.Context, endpoint string, options *Pagin
 		u.RawQuery = query.Encode()
 	}
 
-	req, err := c.httpClient.NewRequest(ctx, "GET", u)
+	_, err = c.do(ctx, http.MethodGet, u, nil, result, requestOptions{})
+	if options != nil {
+		c.pageSizer.observe(err)
+		if err == nil {
+			c.metrics.recordPage(ctx, endpoint)
+		}
+	}
+	return err
+}
+
+// checkNextLink returns an error unless a next link uses the base URL's scheme and
+// points at an allowed host and port. Next links come from response bodies and page
+// tokens, so they are checked before they are followed with our credentials.
+func (c *AvalaraClient) checkNextLink(u *url.URL) error {
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return fmt.Errorf("error parsing URL: %w", err)
+	}
+
+	if !strings.EqualFold(u.Scheme, base.Scheme) {
+		return fmt.Errorf("%w: expected scheme %s, got %q", ErrUntrustedNextLink, base.Scheme, u.Scheme)
+	}
+
+	if c.allowedOrigins[origin(u.Scheme, u.Host)] {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrUntrustedNextLink, u.Host)
+}
+
+// optionsFromPageToken rebuilds the options of the next page request from a page token.
+// Tokens written before page tokens were introduced are raw next links and are followed as such.
+func (c *AvalaraClient) optionsFromPageToken(endpoint string, token string) (*PaginationOptions, error) {
+	if strings.HasPrefix(token, "http://") || strings.HasPrefix(token, "https://") {
+		u, err := url.Parse(token)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPageToken, err)
+		}
+		err = c.checkNextLink(u)
+		if err != nil {
+			return nil, err
+		}
+		return &PaginationOptions{NextLink: token}, nil
+	}
+
+	t, err := decodePageToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if t.Endpoint != endpoint {
+		return nil, fmt.Errorf("%w: issued for %s, not %s", ErrInvalidPageToken, t.Endpoint, endpoint)
+	}
+
+	options := &PaginationOptions{
+		Top:     t.Top,
+		Skip:    t.Skip,
+		OrderBy: t.OrderBy,
+		Filter:  t.Filter,
+	}
+	if c.pageSizer.adaptive {
+		options.Top = 0
+	}
+
+	return options, nil
+}
+
+// requestOptions tunes how a single request is sent.
+type requestOptions struct {
+	// headers are added to the request on top of the standard Avalara headers.
+	headers map[string]string
+	// skipCache bypasses the response cache, for reads that must reflect the latest state.
+	skipCache bool
+}
+
+// send issues a mutating request against the Avalara API. When the client is in
+// dry-run mode the request is logged and never sent, and the request body is
+// echoed back as the response so callers can rehearse end-to-end flows.
+func (c *AvalaraClient) send(ctx context.Context, method, endpoint string, body interface{}, result interface{}, opts requestOptions) error {
+	u, err := url.Parse(c.baseURL + endpoint)
+	if err != nil {
+		return fmt.Errorf("error parsing URL: %w", err)
+	}
+
+	if c.dryRun {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("error encoding request body: %w", err)
+		}
+
+		ctxzap.Extract(ctx).Info(
+			"avalara-connector: dry run, request not sent",
+			zap.String("method", method),
+			zap.String("url", u.String()),
+			zap.Any("headers", opts.headers),
+			zap.ByteString("body", bodyBytes),
+		)
+
+		if result == nil || body == nil {
+			return nil
+		}
+		if err := json.Unmarshal(bodyBytes, result); err != nil {
+			return fmt.Errorf("error decoding dry run response: %w", err)
+		}
+		return nil
+	}
+
+	_, err = c.do(ctx, method, u, body, result, opts)
+	return err
+}
+
+func (c *AvalaraClient) do(
+	ctx context.Context,
+	method string,
+	u *url.URL,
+	body interface{},
+	result interface{},
+	opts requestOptions,
+) (http.Header, error) {
+	var reqOptions []uhttp.RequestOption
+	if body != nil {
+		reqOptions = append(reqOptions, uhttp.WithJSONBody(body))
+	}
+
+	req, err := c.httpClient.NewRequest(withClientMetrics(ctx, c.metrics), method, u, reqOptions...)
 	if err != nil {
-		return fmt.Errorf("error creating request: %w", err)
+		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 
 	// Set headers manually.
@@ -133,44 +373,73 @@ func (c *AvalaraClient) get(ctx context.Context, endpoint string, options *Pagin
 	req.Header.Set("X-Avalara-Client", c.clientHeader)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+	for key, value := range opts.headers {
+		req.Header.Set(key, value)
+	}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("error sending request: %w", err)
+	var resp *http.Response
+	if opts.skipCache {
+		resp, err = c.httpClient.HttpClient.Do(req)
+	} else {
+		resp, err = c.httpClient.Do(req)
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, ErrConcurrentModification
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		var errorResp AvalaraErrorResponse
 		if err := json.Unmarshal(bodyBytes, &errorResp); err == nil && errorResp.Error.Code != "" {
-			return &errorResp.Error
+			return nil, &errorResp.Error
 		}
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if result == nil {
+		return resp.Header, nil
 	}
 
 	if err := json.Unmarshal(bodyBytes, result); err != nil {
-		return &AvalaraError{
+		return nil, &AvalaraError{
 			Code:    "FormatException",
 			Message: "The server returned the response in an unexpected format",
 			Details: err.Error(),
 		}
 	}
 
-	return nil
+	return resp.Header, nil
 }
 
-// Helper function to update PaginationOptions.
-func updatePaginationOptions(options *PaginationOptions, response PaginatedResponse) *PaginationOptions {
+// Helper function to update PaginationOptions. The next link is also captured as an opaque page token.
+func (c *AvalaraClient) updatePaginationOptions(options *PaginationOptions, response PaginatedResponse) (*PaginationOptions, error) {
 	if options == nil {
 		options = &PaginationOptions{}
 	}
 	options.NextLink = response.GetNextLink()
-	return options
+	options.PageToken = ""
+
+	if options.NextLink != "" {
+		token, err := c.pageTokenFromNextLink(options.NextLink)
+		if err != nil {
+			return options, err
+		}
+		options.PageToken = token
+	}
+
+	return options, nil
 }
 
 // GetUserRoles retrieves the security roles for the authenticated user with pagination.
@@ -180,7 +449,11 @@ func (c *AvalaraClient) GetUserRoles(ctx context.Context, options *PaginationOpt
 	if err != nil {
 		return nil, options, err
 	}
-	return &result, updatePaginationOptions(options, &result), nil
+	nextOptions, err := c.updatePaginationOptions(options, &result)
+	if err != nil {
+		return nil, nextOptions, err
+	}
+	return &result, nextOptions, nil
 }
 
 // GetAccounts retrieves the accounts associated with the authenticated user with pagination.
@@ -190,7 +463,21 @@ func (c *AvalaraClient) GetAccounts(ctx context.Context, options *PaginationOpti
 	if err != nil {
 		return nil, options, err
 	}
-	return &result, updatePaginationOptions(options, &result), nil
+	nextOptions, err := c.updatePaginationOptions(options, &result)
+	if err != nil {
+		return nil, nextOptions, err
+	}
+	return &result, nextOptions, nil
+}
+
+// GetAccount retrieves a single account.
+func (c *AvalaraClient) GetAccount(ctx context.Context, accountID int) (*AccountModel, error) {
+	var result AccountModel
+	err := c.get(ctx, fmt.Sprintf("/api/v2/accounts/%d", accountID), nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
 }
 
 // GetUsers retrieves the users associated with the authenticated user with pagination.
@@ -200,7 +487,11 @@ func (c *AvalaraClient) GetUsers(ctx context.Context, options *PaginationOptions
 	if err != nil {
 		return nil, options, err
 	}
-	return &result, updatePaginationOptions(options, &result), nil
+	nextOptions, err := c.updatePaginationOptions(options, &result)
+	if err != nil {
+		return nil, nextOptions, err
+	}
+	return &result, nextOptions, nil
 }
 
 // GetPermissions retrieves the list of permissions with pagination.
@@ -210,7 +501,11 @@ func (c *AvalaraClient) GetPermissions(ctx context.Context, options *PaginationO
 	if err != nil {
 		return nil, options, err
 	}
-	return &result, updatePaginationOptions(options, &result), nil
+	nextOptions, err := c.updatePaginationOptions(options, &result)
+	if err != nil {
+		return nil, nextOptions, err
+	}
+	return &result, nextOptions, nil
 }
 
 // GetUserEntitlements retrieves all entitlements for a single user.
@@ -224,6 +519,71 @@ func (c *AvalaraClient) GetUserEntitlements(ctx context.Context, accountID, user
 	return &result, nil
 }
 
+// GetUser retrieves a single user within an account. The user is always read from the
+// API rather than the response cache, since it is used to check state before a mutation.
+func (c *AvalaraClient) GetUser(ctx context.Context, accountID, userID int) (*UserModel, error) {
+	u, err := url.Parse(c.baseURL + fmt.Sprintf("/api/v2/accounts/%d/users/%d", accountID, userID))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing URL: %w", err)
+	}
+
+	var result UserModel
+	header, err := c.do(ctx, http.MethodGet, u, nil, &result, requestOptions{skipCache: true})
+	if err != nil {
+		return nil, err
+	}
+	result.ETag = header.Get("ETag")
+	return &result, nil
+}
+
+// UpdateUser replaces a user within an account, including its security role.
+// The user should come from GetUser. The user is read again just before the update, and
+// ErrConcurrentModification is returned if its ETag or modifiedDate changed in between. The
+// update is also sent with If-Match, or If-Unmodified-Since when there is no ETag, so an API
+// that honors them rejects a change made between that read and the PUT. AvaTax does not
+// always honor them, and If-Unmodified-Since only has whole seconds, so a change landing in
+// that window can still be overwritten.
+func (c *AvalaraClient) UpdateUser(ctx context.Context, accountID, userID int, user *UserModel) (*UserModel, error) {
+	opts := requestOptions{}
+	if user.ETag != "" || user.ModifiedDate != "" {
+		current, err := c.GetUser(ctx, accountID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if (user.ETag != "" && current.ETag != user.ETag) || (user.ModifiedDate != "" && current.ModifiedDate != user.ModifiedDate) {
+			return nil, ErrConcurrentModification
+		}
+	}
+	if user.ETag != "" {
+		opts.headers = map[string]string{"If-Match": user.ETag}
+	} else if modified, err := time.Parse(AvalaraTimeLayout, user.ModifiedDate); err == nil {
+		opts.headers = map[string]string{"If-Unmodified-Since": modified.UTC().Format(http.TimeFormat)}
+	}
+
+	endpoint := fmt.Sprintf("/api/v2/accounts/%d/users/%d", accountID, userID)
+	var result UserModel
+	err := c.send(ctx, http.MethodPut, endpoint, user, &result, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetAuditEvents retrieves administrative events recorded for an account with pagination.
+func (c *AvalaraClient) GetAuditEvents(ctx context.Context, accountID int, options *PaginationOptions) (*AuditEventResponse, *PaginationOptions, error) {
+	endpoint := fmt.Sprintf("/api/v2/accounts/%d/auditevents", accountID)
+	var result AuditEventResponse
+	err := c.get(ctx, endpoint, options, &result)
+	if err != nil {
+		return nil, options, err
+	}
+	nextOptions, err := c.updatePaginationOptions(options, &result)
+	if err != nil {
+		return nil, nextOptions, err
+	}
+	return &result, nextOptions, nil
+}
+
 // AccountModel represents the structure of an account in the API response.
 type AccountModel struct {
 	ID              int    `json:"id"`
@@ -263,6 +623,11 @@ type UserModel struct {
 	IsActive             bool   `json:"isActive"`
 	SuppressNewUserEmail bool   `json:"suppressNewUserEmail"`
 	IsDeleted            bool   `json:"isDeleted"`
+	CreatedDate          string `json:"createdDate,omitempty"`
+	ModifiedDate         string `json:"modifiedDate,omitempty"`
+	ModifiedUserID       int    `json:"modifiedUserId,omitempty"`
+	// ETag is taken from the response headers of GetUser, when the API provides one.
+	ETag string `json:"-"`
 }
 
 // UserResponse represents the structure of the API response for user queries.
@@ -317,6 +682,43 @@ type EntitlementResponse struct {
 	Companies   []int    `json:"companies"`
 }
 
+// Audit event types recorded by Avalara.
+const (
+	AuditEventUserLogin           = "UserLogin"
+	AuditEventUserCreated         = "UserCreated"
+	AuditEventUserUpdated         = "UserUpdated"
+	AuditEventUserDeleted         = "UserDeleted"
+	AuditEventSecurityRoleChanged = "SecurityRoleChanged"
+)
+
+// AuditEventModel represents the structure of an audit event in the API response.
+// UserID identifies the user who performed the action and TargetUserID the user it was performed on.
+type AuditEventModel struct {
+	ID                     int    `json:"id"`
+	AccountID              int    `json:"accountId"`
+	EventType              string `json:"eventType"`
+	Timestamp              string `json:"timestamp"`
+	UserID                 int    `json:"userId"`
+	UserName               string `json:"userName"`
+	TargetUserID           int    `json:"targetUserId"`
+	TargetUserName         string `json:"targetUserName"`
+	PreviousSecurityRoleID string `json:"previousSecurityRoleId"`
+	SecurityRoleID         string `json:"securityRoleId"`
+}
+
+// AuditEventResponse represents the structure of the API response for audit event queries.
+type AuditEventResponse struct {
+	RecordsetCount int               `json:"@recordsetCount,omitempty"`
+	Value          []AuditEventModel `json:"value"`
+	NextLink       string            `json:"@nextLink,omitempty"`
+	PageKey        string            `json:"pageKey,omitempty"`
+}
+
+// Implement GetNextLink() for each response type.
+func (r *AuditEventResponse) GetNextLink() string {
+	return r.NextLink
+}
+
 // PingResponse represents the response from the Avalara Ping API.
 type PingResponse struct {
 	Version                string `json:"version"`
@@ -341,7 +743,13 @@ func (c *AvalaraClient) Ping(ctx context.Context) (*PingResponse, error) {
 
 // GetAvalaraClient creates and returns a configured AvalaraClient.
 func GetAvalaraClient(ctx context.Context, environment, username, password string) (*AvalaraClient, error) {
-	httpClient, err := uhttp.NewClient(ctx, uhttp.WithLogger(true, ctxzap.Extract(ctx)))
+	return GetAvalaraClientWithTransport(ctx, environment, username, password, TransportConfig{})
+}
+
+// GetAvalaraClientWithTransport creates and returns a configured AvalaraClient that connects
+// through the given proxy and TLS settings.
+func GetAvalaraClientWithTransport(ctx context.Context, environment, username, password string, transport TransportConfig) (*AvalaraClient, error) {
+	httpClient, err := NewHTTPClient(ctx, transport)
 	if err != nil {
 		return nil, fmt.Errorf("error creating HTTP client: %w", err)
 	}
@@ -1,19 +1,27 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/conductorone/baton-sdk/pkg/metrics"
 	"github.com/conductorone/baton-sdk/pkg/uhttp"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 const (
@@ -245,6 +253,7 @@ func TestAvalaraClient_GetUserRoles_RequestDetails(t *testing.T) {
 	baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
 	client := NewAvalaraClient("sandbox", baseHttpClient)
 	client.AddCredentials("testuser", "testpass")
+	client.SetAllowedHosts([]string{"SandboxBaseDomain"})
 
 	// Call GetUserRoles with nextLink.
 	ctx := context.Background()
@@ -1192,3 +1201,1016 @@ func TestAvalaraClient_Ping_RequestDetails(t *testing.T) {
 		}
 	}
 }
+
+func TestAvalaraClient_UpdateUser_RequestDetails(t *testing.T) {
+	// Create a custom RoundTripper to capture the request.
+	var capturedRequest *http.Request
+	var capturedBody string
+	mockTransport := &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"id": 12345, "accountId": 123456789, "securityRoleId": "AccountAdmin"}`)),
+		},
+		err: nil,
+	}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		capturedRequest = req
+		bodyBytes, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		capturedBody = string(bodyBytes)
+		return mockTransport.response, mockTransport.err
+	}
+
+	// Create a test client with the mock transport.
+	httpClient := &http.Client{Transport: mockTransport}
+	baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
+	client := NewAvalaraClient("sandbox", baseHttpClient)
+	client.AddCredentials("testuser", "testpass")
+
+	// Call UpdateUser.
+	ctx := context.Background()
+	user := &UserModel{ID: 12345, AccountID: 123456789, SecurityRoleID: "AccountAdmin"}
+	result, err := client.UpdateUser(ctx, 123456789, 12345, user)
+
+	// Check for errors.
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Verify the request details.
+	if capturedRequest == nil {
+		t.Fatal("No request was captured")
+	}
+
+	if capturedRequest.Method != http.MethodPut {
+		t.Errorf("Expected method %s, got %s", http.MethodPut, capturedRequest.Method)
+	}
+
+	expectedPath := "/api/v2/accounts/123456789/users/12345"
+	if capturedRequest.URL.Path != expectedPath {
+		t.Errorf("Expected path %s, got %s", expectedPath, capturedRequest.URL.Path)
+	}
+
+	if !strings.Contains(capturedBody, `"securityRoleId":"AccountAdmin"`) {
+		t.Errorf("Expected request body to contain the security role, got %s", capturedBody)
+	}
+
+	if result.SecurityRoleID != "AccountAdmin" {
+		t.Errorf("Expected SecurityRoleID to be AccountAdmin, got %s", result.SecurityRoleID)
+	}
+}
+
+func TestAvalaraClient_UpdateUser_DryRun(t *testing.T) {
+	// Fail the test if any request reaches the transport.
+	mockTransport := &mockRoundTripper{}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		t.Errorf("Expected no request in dry run mode, got %s %s", req.Method, req.URL.String())
+		return nil, fmt.Errorf("unexpected request")
+	}
+
+	httpClient := &http.Client{Transport: mockTransport}
+	baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
+	client := NewAvalaraClient("sandbox", baseHttpClient)
+	client.AddCredentials("testuser", "testpass")
+	client.SetDryRun(true)
+
+	ctx := context.Background()
+	user := &UserModel{ID: 12345, AccountID: 123456789, UserName: "bobExample", SecurityRoleID: "AccountAdmin"}
+	result, err := client.UpdateUser(ctx, 123456789, 12345, user)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The request body is echoed back as the response.
+	if !reflect.DeepEqual(result, user) {
+		t.Errorf("Unexpected result: got %+v, want %+v", result, user)
+	}
+}
+
+func TestAvalaraClient_UpdateUser_ConcurrentModification(t *testing.T) {
+	testCases := []struct {
+		name string
+		user *UserModel
+		// current is the user the API returns when it is read again before the update.
+		current                   string
+		currentETag               string
+		putStatusCode             int
+		expectedMethods           string
+		expectedIfMatch           string
+		expectedIfUnmodifiedSince string
+		expectedErr               error
+	}{
+		{
+			name:            "unchanged ETag sent as If-Match",
+			user:            &UserModel{ID: 12345, ETag: `"v1"`, ModifiedDate: "2024-01-01T00:00:00"},
+			current:         `{"id": 12345, "modifiedDate": "2024-01-01T00:00:00"}`,
+			currentETag:     `"v1"`,
+			putStatusCode:   http.StatusOK,
+			expectedMethods: "GET,PUT",
+			expectedIfMatch: `"v1"`,
+		},
+		{
+			name:            "changed ETag",
+			user:            &UserModel{ID: 12345, ETag: `"v1"`, ModifiedDate: "2024-01-01T00:00:00"},
+			current:         `{"id": 12345, "modifiedDate": "2024-01-01T00:00:00"}`,
+			currentETag:     `"v2"`,
+			expectedMethods: "GET",
+			expectedErr:     ErrConcurrentModification,
+		},
+		{
+			name:                      "unchanged modifiedDate sent as If-Unmodified-Since",
+			user:                      &UserModel{ID: 12345, ModifiedDate: "2024-01-01T08:30:00"},
+			current:                   `{"id": 12345, "modifiedDate": "2024-01-01T08:30:00"}`,
+			putStatusCode:             http.StatusOK,
+			expectedMethods:           "GET,PUT",
+			expectedIfUnmodifiedSince: "Mon, 01 Jan 2024 08:30:00 GMT",
+		},
+		{
+			name:            "changed modifiedDate",
+			user:            &UserModel{ID: 12345, ModifiedDate: "2024-01-01T08:30:00"},
+			current:         `{"id": 12345, "modifiedDate": "2024-01-01T08:30:01"}`,
+			expectedMethods: "GET",
+			expectedErr:     ErrConcurrentModification,
+		},
+		{
+			name:                      "changed after the read and rejected by the API",
+			user:                      &UserModel{ID: 12345, ModifiedDate: "2024-01-01T08:30:00"},
+			current:                   `{"id": 12345, "modifiedDate": "2024-01-01T08:30:00"}`,
+			putStatusCode:             http.StatusPreconditionFailed,
+			expectedMethods:           "GET,PUT",
+			expectedIfUnmodifiedSince: "Mon, 01 Jan 2024 08:30:00 GMT",
+			expectedErr:               ErrConcurrentModification,
+		},
+		{
+			name:            "no version",
+			user:            &UserModel{ID: 12345},
+			putStatusCode:   http.StatusOK,
+			expectedMethods: "PUT",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var methods []string
+			mockTransport := &mockRoundTripper{}
+			mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+				methods = append(methods, req.Method)
+				if req.Method == http.MethodGet {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     http.Header{"Etag": []string{tc.currentETag}},
+						Body:       io.NopCloser(strings.NewReader(tc.current)),
+					}, nil
+				}
+
+				if ifMatch := req.Header.Get("If-Match"); ifMatch != tc.expectedIfMatch {
+					t.Errorf("Expected If-Match to be %s, got %s", tc.expectedIfMatch, ifMatch)
+				}
+				if since := req.Header.Get("If-Unmodified-Since"); since != tc.expectedIfUnmodifiedSince {
+					t.Errorf("Expected If-Unmodified-Since to be %s, got %s", tc.expectedIfUnmodifiedSince, since)
+				}
+				return &http.Response{
+					StatusCode: tc.putStatusCode,
+					Body:       io.NopCloser(strings.NewReader(`{"id": 12345}`)),
+				}, nil
+			}
+
+			httpClient := &http.Client{Transport: mockTransport}
+			baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
+			client := NewAvalaraClient("sandbox", baseHttpClient)
+			client.AddCredentials("testuser", "testpass")
+
+			_, err := client.UpdateUser(context.Background(), 123456789, 12345, tc.user)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if strings.Join(methods, ",") != tc.expectedMethods {
+				t.Errorf("Expected requests %s, got %v", tc.expectedMethods, methods)
+			}
+		})
+	}
+}
+
+func TestAvalaraClient_GetUser(t *testing.T) {
+	requests := 0
+	mockTransport := &mockRoundTripper{}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		requests++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Etag": []string{`"v2"`}},
+			Body:       io.NopCloser(strings.NewReader(`{"id": 12345, "securityRoleId": "AccountUser", "modifiedDate": "2024-01-01T00:00:00"}`)),
+		}, nil
+	}
+
+	httpClient := &http.Client{Transport: mockTransport}
+	baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
+	client := NewAvalaraClient("sandbox", baseHttpClient)
+	client.AddCredentials("testuser", "testpass")
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		result, err := client.GetUser(ctx, 123456789, 12345)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if result.ETag != `"v2"` {
+			t.Errorf("Expected ETag to be %s, got %s", `"v2"`, result.ETag)
+		}
+		if result.ModifiedDate != "2024-01-01T00:00:00" {
+			t.Errorf("Expected ModifiedDate to be 2024-01-01T00:00:00, got %s", result.ModifiedDate)
+		}
+	}
+
+	// GetUser must bypass the response cache.
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+}
+
+func TestAvalaraClient_GetAccount(t *testing.T) {
+	var capturedRequest *http.Request
+	mockTransport := &mockRoundTripper{}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		capturedRequest = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"id": 123456789, "name": "Example Inc.", "accountStatusId": "Active"}`)),
+		}, nil
+	}
+
+	httpClient := &http.Client{Transport: mockTransport}
+	client := NewAvalaraClient("sandbox", uhttp.NewBaseHttpClient(httpClient))
+	client.AddCredentials("testuser", "testpass")
+
+	result, err := client.GetAccount(context.Background(), 123456789)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expectedURL := "https://sandbox-rest.avatax.com/api/v2/accounts/123456789"
+	if capturedRequest.URL.String() != expectedURL {
+		t.Errorf("Expected URL to be %s, got %s", expectedURL, capturedRequest.URL.String())
+	}
+	if result.Name != "Example Inc." {
+		t.Errorf("Expected account name to be Example Inc., got %s", result.Name)
+	}
+}
+
+func TestAvalaraClient_GetAuditEvents_RequestDetails(t *testing.T) {
+	// Create a custom RoundTripper to capture the request.
+	var capturedRequest *http.Request
+	mockTransport := &mockRoundTripper{
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body: io.NopCloser(strings.NewReader(`{
+				"@recordsetCount": 1,
+				"value": [
+					{
+						"id": 1001,
+						"accountId": 123456789,
+						"eventType": "SecurityRoleChanged",
+						"timestamp": "2024-08-01T10:00:00",
+						"userId": 67890,
+						"userName": "aliceExample",
+						"targetUserId": 12345,
+						"targetUserName": "bobExample",
+						"previousSecurityRoleId": "AccountUser",
+						"securityRoleId": "AccountAdmin"
+					}
+				]
+			}`)),
+		},
+		err: nil,
+	}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		capturedRequest = req
+		return mockTransport.response, mockTransport.err
+	}
+
+	httpClient := &http.Client{Transport: mockTransport}
+	baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
+	client := NewAvalaraClient("sandbox", baseHttpClient)
+	client.AddCredentials("testuser", "testpass")
+
+	ctx := context.Background()
+	options := &PaginationOptions{
+		Top:    50,
+		Filter: "timestamp gt '2024-08-01T00:00:00'",
+	}
+	result, nextOptions, err := client.GetAuditEvents(ctx, 123456789, options)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expectedPath := "/api/v2/accounts/123456789/auditevents"
+	if capturedRequest.URL.Path != expectedPath {
+		t.Errorf("Expected path %s, got %s", expectedPath, capturedRequest.URL.Path)
+	}
+
+	expectedQuery := url.Values{
+		"$top":    []string{"50"},
+		"$filter": []string{"timestamp gt '2024-08-01T00:00:00'"},
+	}
+	if !reflect.DeepEqual(capturedRequest.URL.Query(), expectedQuery) {
+		t.Errorf("Expected query %v, got %v", expectedQuery, capturedRequest.URL.Query())
+	}
+
+	expectedEvent := AuditEventModel{
+		ID:                     1001,
+		AccountID:              123456789,
+		EventType:              AuditEventSecurityRoleChanged,
+		Timestamp:              "2024-08-01T10:00:00",
+		UserID:                 67890,
+		UserName:               "aliceExample",
+		TargetUserID:           12345,
+		TargetUserName:         "bobExample",
+		PreviousSecurityRoleID: "AccountUser",
+		SecurityRoleID:         "AccountAdmin",
+	}
+	if len(result.Value) != 1 || !reflect.DeepEqual(result.Value[0], expectedEvent) {
+		t.Errorf("Unexpected events: got %+v, want %+v", result.Value, expectedEvent)
+	}
+
+	if nextOptions.NextLink != "" {
+		t.Errorf("Expected empty NextLink, got %s", nextOptions.NextLink)
+	}
+}
+
+func TestAvalaraClient_SetPageSize(t *testing.T) {
+	testCases := []struct {
+		name        string
+		pageSize    int
+		adaptive    bool
+		statusCodes []int
+		expectedTop []string
+	}{
+		{
+			name:        "Configured page size",
+			pageSize:    250,
+			statusCodes: []int{http.StatusOK, http.StatusOK},
+			expectedTop: []string{"250", "250"},
+		},
+		{
+			name:        "Capped at the API maximum",
+			pageSize:    5000,
+			statusCodes: []int{http.StatusOK},
+			expectedTop: []string{"1000"},
+		},
+		{
+			name:        "Fixed page size ignores server errors",
+			pageSize:    400,
+			statusCodes: []int{http.StatusServiceUnavailable, http.StatusOK},
+			expectedTop: []string{"400", "400"},
+		},
+		{
+			name:        "Adaptive page size shrinks and grows",
+			pageSize:    400,
+			adaptive:    true,
+			statusCodes: []int{http.StatusInternalServerError, http.StatusGatewayTimeout, http.StatusOK, http.StatusOK, http.StatusOK},
+			expectedTop: []string{"400", "200", "100", "200", "400"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var capturedTops []string
+			mockTransport := &mockRoundTripper{}
+			mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+				capturedTops = append(capturedTops, req.URL.Query().Get("$top"))
+				return &http.Response{
+					StatusCode: tc.statusCodes[len(capturedTops)-1],
+					Body:       io.NopCloser(strings.NewReader(`{"value": []}`)),
+				}, nil
+			}
+
+			t.Setenv("BATON_DISABLE_HTTP_CACHE", "true")
+			httpClient := &http.Client{Transport: mockTransport}
+			baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
+			client := NewAvalaraClient("sandbox", baseHttpClient)
+			client.SetPageSize(tc.pageSize, tc.adaptive)
+
+			ctx := context.Background()
+			for range tc.statusCodes {
+				_, _, _ = client.GetUsers(ctx, &PaginationOptions{})
+			}
+
+			if !reflect.DeepEqual(capturedTops, tc.expectedTop) {
+				t.Errorf("Expected $top values %v, got %v", tc.expectedTop, capturedTops)
+			}
+		})
+	}
+}
+
+func TestAvalaraClient_PageToken(t *testing.T) {
+	var capturedRequest *http.Request
+	mockTransport := &mockRoundTripper{}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		capturedRequest = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body: io.NopCloser(strings.NewReader(`{
+				"value": [{"id": 1, "userName": "user1"}],
+				"@nextLink": "https://old-host.example.com/api/v2/users?$filter=modifiedDate+gt+%272024-01-01%27&$skip=2&$top=2"
+			}`)),
+		}, nil
+	}
+
+	httpClient := &http.Client{Transport: mockTransport}
+	baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
+	client := NewAvalaraClient("sandbox", baseHttpClient)
+	client.AddCredentials("testuser", "testpass")
+	// The next link comes from an allowed host, such as the host the checkpoint was taken against.
+	client.SetAllowedHosts([]string{"old-host.example.com"})
+
+	ctx := context.Background()
+	_, nextOptions, err := client.GetUsers(ctx, &PaginationOptions{Top: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if nextOptions.PageToken == "" {
+		t.Fatal("Expected a page token")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(nextOptions.PageToken)
+	if err != nil {
+		t.Fatalf("Expected a base64 page token, got %v", err)
+	}
+	if strings.Contains(string(decoded), "old-host") {
+		t.Errorf("Expected page token not to contain the host, got %s", decoded)
+	}
+
+	// The token is replayed against the client's base URL, not the host in the next link.
+	_, _, err = client.GetUsers(ctx, &PaginationOptions{PageToken: nextOptions.PageToken})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expectedURL := "https://sandbox-rest.avatax.com/api/v2/users?%24filter=modifiedDate+gt+%272024-01-01%27&%24skip=2&%24top=2"
+	if capturedRequest.URL.String() != expectedURL {
+		t.Errorf("Expected URL to be %s, got %s", expectedURL, capturedRequest.URL.String())
+	}
+
+	_, _, err = client.GetUserRoles(ctx, &PaginationOptions{PageToken: nextOptions.PageToken})
+	if !errors.Is(err, ErrInvalidPageToken) {
+		t.Errorf("Expected ErrInvalidPageToken for a token from another endpoint, got %v", err)
+	}
+
+	_, _, err = client.GetUsers(ctx, &PaginationOptions{PageToken: "not-a-token"})
+	if !errors.Is(err, ErrInvalidPageToken) {
+		t.Errorf("Expected ErrInvalidPageToken for a malformed token, got %v", err)
+	}
+}
+
+func TestAvalaraClient_NextLinkHostValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		nextLink     string
+		allowedHosts []string
+		expectError  bool
+	}{
+		{
+			name:     "Same host",
+			nextLink: "https://sandbox-rest.avatax.com/api/v2/users?$skip=2&$top=2",
+		},
+		{
+			name:     "Host differs only in case",
+			nextLink: "https://Sandbox-Rest.Avatax.com/api/v2/users?$skip=2&$top=2",
+		},
+		{
+			name:        "Foreign host",
+			nextLink:    "https://attacker.example.com/api/v2/users?$skip=2&$top=2",
+			expectError: true,
+		},
+		{
+			name:        "Scheme downgrade",
+			nextLink:    "http://sandbox-rest.avatax.com/api/v2/users?$skip=2&$top=2",
+			expectError: true,
+		},
+		{
+			name:        "Base host on another port",
+			nextLink:    "https://sandbox-rest.avatax.com:8443/api/v2/users?$skip=2&$top=2",
+			expectError: true,
+		},
+		{
+			name:     "Base host with its default port",
+			nextLink: "https://sandbox-rest.avatax.com:443/api/v2/users?$skip=2&$top=2",
+		},
+		{
+			name:         "Allowed proxy host",
+			nextLink:     "https://proxy.internal/api/v2/users?$skip=2&$top=2",
+			allowedHosts: []string{"proxy.internal"},
+		},
+		{
+			name:         "Allowed proxy host on another port",
+			nextLink:     "https://proxy.internal:8443/api/v2/users?$skip=2&$top=2",
+			allowedHosts: []string{"proxy.internal"},
+			expectError:  true,
+		},
+		{
+			name:         "Allowed proxy host and port",
+			nextLink:     "https://proxy.internal:8443/api/v2/users?$skip=2&$top=2",
+			allowedHosts: []string{"proxy.internal:8443"},
+		},
+		{
+			name:         "Allowed proxy host over http",
+			nextLink:     "http://proxy.internal/api/v2/users?$skip=2&$top=2",
+			allowedHosts: []string{"proxy.internal"},
+			expectError:  true,
+		},
+		{
+			name:         "Base host stays allowed alongside a proxy",
+			nextLink:     "https://sandbox-rest.avatax.com/api/v2/users?$skip=2&$top=2",
+			allowedHosts: []string{"proxy.internal"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []string
+			mockTransport := &mockRoundTripper{}
+			mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+				requests = append(requests, req.URL.Host)
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(`{"value": [], "@nextLink": "` + tt.nextLink + `"}`)),
+				}, nil
+			}
+
+			newClient := func() *AvalaraClient {
+				httpClient := &http.Client{Transport: mockTransport}
+				client := NewAvalaraClient("sandbox", uhttp.NewBaseHttpClient(httpClient))
+				client.AddCredentials("testuser", "testpass")
+				client.SetAllowedHosts(tt.allowedHosts)
+				return client
+			}
+			ctx := context.Background()
+
+			// A next link in a response is checked before it becomes a page token.
+			_, nextOptions, err := newClient().GetUsers(ctx, &PaginationOptions{})
+			if tt.expectError {
+				if !errors.Is(err, ErrUntrustedNextLink) {
+					t.Errorf("Expected ErrUntrustedNextLink, got %v", err)
+				}
+			} else if err != nil || nextOptions.PageToken == "" {
+				t.Errorf("Expected a page token, got %v", err)
+			}
+
+			// A next link saved as a page token before page tokens were opaque, or set by the caller,
+			// is checked before it is followed. Each gets a new client so that neither is served from the cache.
+			for _, options := range []*PaginationOptions{{PageToken: tt.nextLink}, {NextLink: tt.nextLink}} {
+				requests = nil
+				_, _, err = newClient().GetUsers(ctx, options)
+				if tt.expectError {
+					if !errors.Is(err, ErrUntrustedNextLink) {
+						t.Errorf("Expected ErrUntrustedNextLink, got %v", err)
+					}
+					if len(requests) != 0 {
+						t.Errorf("Expected no request to be sent, got %v", requests)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				if len(requests) != 1 {
+					t.Errorf("Expected the next link to be followed, got %v", requests)
+				}
+			}
+		})
+	}
+}
+
+// recordingMetricsHandler records the tags of every value added to a counter, keyed by metric name.
+type recordingMetricsHandler struct {
+	counters map[string][]map[string]string
+}
+
+type recordingCounter struct {
+	name    string
+	handler *recordingMetricsHandler
+}
+
+func (c *recordingCounter) Add(_ context.Context, _ int64, tags map[string]string) {
+	c.handler.counters[c.name] = append(c.handler.counters[c.name], tags)
+}
+
+func (c *recordingCounter) Record(_ context.Context, _ int64, _ map[string]string) {}
+
+func (c *recordingCounter) Observe(_ context.Context, _ int64, _ map[string]string) {}
+
+func (h *recordingMetricsHandler) Int64Counter(name string, _ string, _ metrics.Unit) metrics.Int64Counter {
+	return &recordingCounter{name: name, handler: h}
+}
+
+func (h *recordingMetricsHandler) Int64Gauge(name string, _ string, _ metrics.Unit) metrics.Int64Gauge {
+	return &recordingCounter{name: name, handler: h}
+}
+
+func (h *recordingMetricsHandler) Int64Histogram(name string, _ string, _ metrics.Unit) metrics.Int64Histogram {
+	return &recordingCounter{name: name, handler: h}
+}
+
+func (h *recordingMetricsHandler) WithTags(_ map[string]string) metrics.Handler {
+	return h
+}
+
+func TestAvalaraClient_Probe(t *testing.T) {
+	tests := []struct {
+		name                  string
+		statusCode            int
+		body                  string
+		expectedErrorCode     string
+		expectedAccessLevel   string
+		expectedCorrelationID string
+	}{
+		{
+			name:                  "Success",
+			statusCode:            http.StatusOK,
+			body:                  `{"permissions": ["AccountFetch"], "accessLevel": "SingleAccount"}`,
+			expectedAccessLevel:   "SingleAccount",
+			expectedCorrelationID: "c0ffee",
+		},
+		{
+			name:                  "Forbidden",
+			statusCode:            http.StatusForbidden,
+			body:                  `{"error": {"code": "PermissionRequired", "message": "AccountFetch is required"}}`,
+			expectedErrorCode:     "PermissionRequired",
+			expectedCorrelationID: "c0ffee",
+		},
+		{
+			name:                  "Malformed response",
+			statusCode:            http.StatusOK,
+			body:                  `{"permissions":`,
+			expectedErrorCode:     "FormatException",
+			expectedCorrelationID: "c0ffee",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var capturedRequest *http.Request
+			mockTransport := &mockRoundTripper{}
+			mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+				capturedRequest = req
+				return &http.Response{
+					StatusCode: tt.statusCode,
+					Header:     http.Header{"X-Correlation-Id": []string{"c0ffee"}},
+					Body:       io.NopCloser(strings.NewReader(tt.body)),
+				}, nil
+			}
+
+			httpClient := &http.Client{Transport: mockTransport}
+			client := NewAvalaraClient("sandbox", uhttp.NewBaseHttpClient(httpClient))
+			client.AddCredentials("testuser", "testpass")
+
+			var result EntitlementResponse
+			probe, err := client.Probe(context.Background(), "/api/v2/accounts/1/users/2/entitlements", &result)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if probe.StatusCode != tt.statusCode {
+				t.Errorf("Expected status code %d, got %d", tt.statusCode, probe.StatusCode)
+			}
+			if probe.CorrelationID != tt.expectedCorrelationID {
+				t.Errorf("Expected correlation ID %s, got %s", tt.expectedCorrelationID, probe.CorrelationID)
+			}
+
+			var errorCode string
+			if probe.Error != nil {
+				errorCode = probe.Error.Code
+			}
+			if errorCode != tt.expectedErrorCode {
+				t.Errorf("Expected error code %q, got %q", tt.expectedErrorCode, errorCode)
+			}
+			if result.AccessLevel != tt.expectedAccessLevel {
+				t.Errorf("Expected access level %q, got %q", tt.expectedAccessLevel, result.AccessLevel)
+			}
+
+			if capturedRequest.URL.Query().Get("$top") != "1" {
+				t.Errorf("Expected $top to be 1, got %s", capturedRequest.URL.Query().Get("$top"))
+			}
+			if capturedRequest.Header.Get("Authorization") == "" {
+				t.Error("Expected Authorization header to be set")
+			}
+		})
+	}
+}
+
+func TestAvalaraClient_Metrics(t *testing.T) {
+	mockTransport := &mockRoundTripper{}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/entitlements") {
+			return &http.Response{
+				StatusCode: http.StatusNotFound,
+				Body:       io.NopCloser(strings.NewReader(`{}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"value": []}`)),
+		}, nil
+	}
+
+	httpClient := &http.Client{Transport: mockTransport}
+	baseHttpClient := uhttp.NewBaseHttpClient(httpClient)
+	client := NewAvalaraClient("sandbox", baseHttpClient)
+	client.AddCredentials("testuser", "testpass")
+	handler := &recordingMetricsHandler{counters: make(map[string][]map[string]string)}
+	client.SetMetricsHandler(handler)
+
+	ctx := context.Background()
+	_, _, err := client.GetUsers(ctx, &PaginationOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = client.GetUserEntitlements(ctx, 123456789, 12345)
+	if err == nil {
+		t.Fatal("Expected an error for a missing user")
+	}
+	client.RecordRetry(ctx, "/api/v2/accounts/123456789/users/12345/entitlements")
+
+	requests := handler.counters[requestsCounterName]
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests to be recorded, got %d", len(requests))
+	}
+	expectedEndpoint := "/api/v2/accounts/{id}/users/{id}/entitlements"
+	if requests[1]["endpoint"] != expectedEndpoint {
+		t.Errorf("Expected endpoint to be %s, got %s", expectedEndpoint, requests[1]["endpoint"])
+	}
+	if requests[1]["status_code"] != "404" {
+		t.Errorf("Expected status_code to be 404, got %s", requests[1]["status_code"])
+	}
+
+	pages := handler.counters[pagesCounterName]
+	if len(pages) != 1 || pages[0]["resource_type"] != "users" {
+		t.Errorf("Expected one page of users to be recorded, got %v", pages)
+	}
+
+	summary := client.MetricsSummary()
+	if summary.Requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", summary.Requests)
+	}
+	if summary.FailedRequests != 1 {
+		t.Errorf("Expected 1 failed request, got %d", summary.FailedRequests)
+	}
+	if summary.Retries != 1 {
+		t.Errorf("Expected 1 retry, got %d", summary.Retries)
+	}
+	if summary.StatusCodes["200"] != 1 || summary.StatusCodes["404"] != 1 {
+		t.Errorf("Unexpected status codes: %v", summary.StatusCodes)
+	}
+	if summary.PagesByType["users"] != 1 {
+		t.Errorf("Expected 1 page of users, got %d", summary.PagesByType["users"])
+	}
+	// The body of the 404 is read from the network too.
+	expectedBytes := int64(len(`{"value": []}`) + len(`{}`))
+	if summary.BytesRead != expectedBytes {
+		t.Errorf("Expected %d bytes read, got %d", expectedBytes, summary.BytesRead)
+	}
+}
+
+func TestAvalaraClient_Metrics_CacheHit(t *testing.T) {
+	ctx := context.Background()
+	var sent int
+	mockTransport := &mockRoundTripper{}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"value": []}`)),
+		}, nil
+	}
+
+	httpClient, err := uhttp.NewBaseHttpClientWithContext(ctx, &http.Client{Transport: mockTransport})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	client := NewAvalaraClient("sandbox", httpClient)
+	handler := &recordingMetricsHandler{counters: make(map[string][]map[string]string)}
+	client.SetMetricsHandler(handler)
+
+	for i := 0; i < 2; i++ {
+		_, _, err := client.GetUserRoles(ctx, &PaginationOptions{Top: 10})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	if sent != 1 {
+		t.Fatalf("Expected the second request to be served from the cache, got %d requests sent", sent)
+	}
+	if len(handler.counters[requestsCounterName]) != 1 {
+		t.Errorf("Expected 1 request to be recorded, got %d", len(handler.counters[requestsCounterName]))
+	}
+	summary := client.MetricsSummary()
+	if summary.Requests != 1 {
+		t.Errorf("Expected 1 request, got %d", summary.Requests)
+	}
+	if summary.BytesRead != int64(len(`{"value": []}`)) {
+		t.Errorf("Expected %d bytes read, got %d", len(`{"value": []}`), summary.BytesRead)
+	}
+	if summary.PagesByType["securityroles"] != 2 {
+		t.Errorf("Expected 2 pages of roles, got %d", summary.PagesByType["securityroles"])
+	}
+}
+
+func TestAvalaraClient_Metrics_SharedHTTPClient(t *testing.T) {
+	ctx := context.Background()
+	mockTransport := &mockRoundTripper{}
+	mockTransport.roundTrip = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"value": []}`)),
+		}, nil
+	}
+
+	httpClient := &http.Client{Transport: mockTransport}
+	first := NewAvalaraClient("sandbox", uhttp.NewBaseHttpClient(httpClient))
+	second := NewAvalaraClient("sandbox", uhttp.NewBaseHttpClient(httpClient))
+
+	_, _, err := first.GetUsers(ctx, &PaginationOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if first.MetricsSummary().Requests != 1 {
+		t.Errorf("Expected 1 request for the first client, got %d", first.MetricsSummary().Requests)
+	}
+	if second.MetricsSummary().Requests != 0 {
+		t.Errorf("Expected no requests for the second client, got %d", second.MetricsSummary().Requests)
+	}
+}
+
+func TestGetAvalaraClientWithTransport_Proxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version": "24.8.2", "authenticated": true}`)
+	}))
+	defer proxy.Close()
+
+	ctx := context.Background()
+	client, err := GetAvalaraClientWithTransport(ctx, "http://avalara.invalid", "testuser", "testpass", TransportConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ping, err := client.Ping(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !ping.Authenticated {
+		t.Error("Expected Authenticated to be true")
+	}
+	if proxiedHost != "avalara.invalid" {
+		t.Errorf("Expected the request for avalara.invalid to go through the proxy, got %q", proxiedHost)
+	}
+}
+
+func TestNewHTTPClient_Logging(t *testing.T) {
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.UserAgent())
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version": "24.8.2", "authenticated": true}`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		baseURL string
+		config  TransportConfig
+	}{
+		{name: "Direct", baseURL: server.URL},
+		{name: "Proxy", baseURL: "http://avalara.invalid", config: TransportConfig{ProxyURL: server.URL}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userAgents = nil
+			var logs bytes.Buffer
+			logger := zap.New(zapcore.NewCore(
+				zapcore.NewJSONEncoder(zap.NewDevelopmentEncoderConfig()),
+				zapcore.AddSync(&logs),
+				zap.DebugLevel,
+			))
+			ctx := ctxzap.ToContext(context.Background(), logger)
+
+			client, err := GetAvalaraClientWithTransport(ctx, tt.baseURL, "testuser", "testpass", tt.config)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			_, err = client.Ping(ctx)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			// Both paths log each request and send the SDK's user agent, as uhttp's transport does.
+			for _, expected := range []string{`"Request started"`, `"Request complete"`, `"http.status_code":200`} {
+				if !strings.Contains(logs.String(), expected) {
+					t.Errorf("Expected the logs to contain %s, got %s", expected, logs.String())
+				}
+			}
+			if len(userAgents) != 1 || !strings.Contains(userAgents[0], "baton-sdk/") {
+				t.Errorf("Expected the SDK user agent, got %v", userAgents)
+			}
+		})
+	}
+}
+
+func TestGetAvalaraClientWithTransport_CABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version": "24.8.2", "authenticated": true}`)
+	}))
+	defer server.Close()
+
+	caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err := os.WriteFile(caBundlePath, caBundle, 0o600)
+	if err != nil {
+		t.Fatalf("Expected to write CA bundle, got %v", err)
+	}
+
+	ctx := context.Background()
+
+	// The test server's certificate is not trusted by the system roots.
+	untrusted, err := GetAvalaraClientWithTransport(ctx, server.URL, "testuser", "testpass", TransportConfig{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = untrusted.Ping(ctx)
+	if err == nil {
+		t.Error("Expected an error without the CA bundle")
+	}
+
+	trusted, err := GetAvalaraClientWithTransport(ctx, server.URL, "testuser", "testpass", TransportConfig{CABundlePath: caBundlePath})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = trusted.Ping(ctx)
+	if err != nil {
+		t.Errorf("Expected no error with the CA bundle, got %v", err)
+	}
+}
+
+func TestTransportConfig_Errors(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "not-pem.txt")
+	err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	if err != nil {
+		t.Fatalf("Expected to write file, got %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		config        TransportConfig
+		expectedError string
+	}{
+		{
+			name:          "Unsupported proxy scheme",
+			config:        TransportConfig{ProxyURL: "ftp://proxy.example.com"},
+			expectedError: "must use http, https or socks5",
+		},
+		{
+			name:          "Proxy without host",
+			config:        TransportConfig{ProxyURL: "http://"},
+			expectedError: "has no host",
+		},
+		{
+			name:          "Unreadable CA bundle",
+			config:        TransportConfig{CABundlePath: filepath.Join(t.TempDir(), "missing.pem")},
+			expectedError: "failed to read CA bundle",
+		},
+		{
+			name:          "CA bundle without certificates",
+			config:        TransportConfig{CABundlePath: notPEM},
+			expectedError: "contains no PEM certificates",
+		},
+		{
+			name:          "Client certificate without key",
+			config:        TransportConfig{ClientCertPath: notPEM},
+			expectedError: "both a client certificate and key are required",
+		},
+		{
+			name:          "Invalid client certificate",
+			config:        TransportConfig{ClientCertPath: notPEM, ClientKeyPath: notPEM},
+			expectedError: "failed to load client certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHTTPClient(context.Background(), tt.config)
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("Expected error containing %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/conductorone/baton-sdk/pkg/metrics"
+)
+
+const (
+	requestsCounterName  = "baton_avalara.requests"
+	requestsCounterDesc  = "number of requests sent to the Avalara API by endpoint, method and status code"
+	retriesCounterName   = "baton_avalara.retries"
+	retriesCounterDesc   = "number of requests to the Avalara API that were retried, by endpoint"
+	latencyHistoName     = "baton_avalara.request_latency"
+	latencyHistoDesc     = "duration of requests to the Avalara API by endpoint and method"
+	bytesReadCounterName = "baton_avalara.bytes_read"
+	bytesReadCounterDesc = "number of response bytes read from the Avalara API by endpoint"
+	pagesCounterName     = "baton_avalara.pages"
+	pagesCounterDesc     = "number of list pages fetched from the Avalara API by resource type"
+)
+
+// MetricsSummary totals the requests a client has sent since it was created.
+type MetricsSummary struct {
+	Requests       int64
+	FailedRequests int64
+	Retries        int64
+	BytesRead      int64
+	Elapsed        time.Duration
+	StatusCodes    map[string]int64
+	PagesByType    map[string]int64
+}
+
+// clientMetrics records request metrics through the SDK metrics handler, and keeps
+// running totals for the summary logged at the end of a sync.
+type clientMetrics struct {
+	requests  metrics.Int64Counter
+	retries   metrics.Int64Counter
+	latency   metrics.Int64Histogram
+	bytesRead metrics.Int64Counter
+	pages     metrics.Int64Counter
+
+	started        time.Time
+	totalRequests  atomic.Int64
+	failedRequests atomic.Int64
+	totalRetries   atomic.Int64
+	totalBytesRead atomic.Int64
+
+	mu          sync.Mutex
+	statusCodes map[string]int64
+	pagesByType map[string]int64
+}
+
+func newClientMetrics(handler metrics.Handler) *clientMetrics {
+	return &clientMetrics{
+		requests:    handler.Int64Counter(requestsCounterName, requestsCounterDesc, metrics.Dimensionless),
+		retries:     handler.Int64Counter(retriesCounterName, retriesCounterDesc, metrics.Dimensionless),
+		latency:     handler.Int64Histogram(latencyHistoName, latencyHistoDesc, metrics.Milliseconds),
+		bytesRead:   handler.Int64Counter(bytesReadCounterName, bytesReadCounterDesc, metrics.Bytes),
+		pages:       handler.Int64Counter(pagesCounterName, pagesCounterDesc, metrics.Dimensionless),
+		started:     time.Now(),
+		statusCodes: make(map[string]int64),
+		pagesByType: make(map[string]int64),
+	}
+}
+
+// meteredTransport records the requests that reach the network. Responses served from the
+// HTTP cache never get here, so they are not counted. Requests are attributed to the client
+// whose metrics are in the request context, which lets clients share an http.Client.
+type meteredTransport struct {
+	next http.RoundTripper
+}
+
+type clientMetricsKey struct{}
+
+// withClientMetrics attributes the requests sent with ctx to m.
+func withClientMetrics(ctx context.Context, m *clientMetrics) context.Context {
+	return context.WithValue(ctx, clientMetricsKey{}, m)
+}
+
+// meterTransport wraps the transport of httpClient unless it is already metered.
+func meterTransport(httpClient *http.Client) {
+	if _, ok := httpClient.Transport.(*meteredTransport); ok {
+		return
+	}
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpClient.Transport = &meteredTransport{next: next}
+}
+
+func (t *meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m, ok := req.Context().Value(clientMetricsKey{}).(*clientMetrics)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	m.recordRequest(req.Context(), req.Method, req.URL.Path, resp, time.Since(start))
+	if resp != nil && resp.Body != nil {
+		resp.Body = &meteredBody{ReadCloser: resp.Body, ctx: req.Context(), metrics: m, path: req.URL.Path}
+	}
+	return resp, err
+}
+
+// meteredBody records the bytes read from a response body when it is closed.
+type meteredBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	metrics *clientMetrics
+	path    string
+	n       int
+	once    sync.Once
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += n
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	b.once.Do(func() {
+		b.metrics.recordBytesRead(b.ctx, b.path, b.n)
+	})
+	return b.ReadCloser.Close()
+}
+
+// recordRequest records a request sent over the network, timed until its response headers arrived.
+// A nil response means the request failed before a status was received.
+func (m *clientMetrics) recordRequest(ctx context.Context, method, path string, resp *http.Response, latency time.Duration) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	endpoint := endpointTemplate(path)
+
+	m.requests.Add(ctx, 1, map[string]string{"endpoint": endpoint, "method": method, "status_code": status})
+	m.latency.Record(ctx, latency.Milliseconds(), map[string]string{"endpoint": endpoint, "method": method})
+
+	m.totalRequests.Add(1)
+	if resp == nil || resp.StatusCode >= http.StatusBadRequest {
+		m.failedRequests.Add(1)
+	}
+
+	m.mu.Lock()
+	m.statusCodes[status]++
+	m.mu.Unlock()
+}
+
+func (m *clientMetrics) recordBytesRead(ctx context.Context, path string, n int) {
+	m.bytesRead.Add(ctx, int64(n), map[string]string{"endpoint": endpointTemplate(path)})
+	m.totalBytesRead.Add(int64(n))
+}
+
+func (m *clientMetrics) recordPage(ctx context.Context, path string) {
+	resourceType := resourceTypeOf(path)
+	m.pages.Add(ctx, 1, map[string]string{"resource_type": resourceType})
+
+	m.mu.Lock()
+	m.pagesByType[resourceType]++
+	m.mu.Unlock()
+}
+
+func (m *clientMetrics) recordRetry(ctx context.Context, path string) {
+	m.retries.Add(ctx, 1, map[string]string{"endpoint": endpointTemplate(path)})
+	m.totalRetries.Add(1)
+}
+
+func (m *clientMetrics) summary() MetricsSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := MetricsSummary{
+		Requests:       m.totalRequests.Load(),
+		FailedRequests: m.failedRequests.Load(),
+		Retries:        m.totalRetries.Load(),
+		BytesRead:      m.totalBytesRead.Load(),
+		Elapsed:        time.Since(m.started),
+		StatusCodes:    make(map[string]int64, len(m.statusCodes)),
+		PagesByType:    make(map[string]int64, len(m.pagesByType)),
+	}
+	for k, v := range m.statusCodes {
+		s.StatusCodes[k] = v
+	}
+	for k, v := range m.pagesByType {
+		s.PagesByType[k] = v
+	}
+	return s
+}
+
+// endpointTemplate replaces the IDs in a request path so that metrics are tagged per endpoint rather than per record.
+func endpointTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// resourceTypeOf returns the last non-ID segment of a request path, such as "users" or "securityroles".
+func resourceTypeOf(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if _, err := strconv.Atoi(segments[i]); err != nil {
+			return segments[i]
+		}
+	}
+	return path
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultPageSize is the number of records requested per page unless configured otherwise.
+	DefaultPageSize = 100
+	// MaxPageSize is the most records the Avalara API returns from a single call.
+	MaxPageSize = 1000
+
+	minAdaptivePageSize = 10
+)
+
+// pageSizer picks the $top used for list requests. In adaptive mode it halves the page
+// size after a timeout or server error, and doubles it after each healthy response up to the configured size.
+type pageSizer struct {
+	mu       sync.Mutex
+	limit    int
+	current  int
+	adaptive bool
+}
+
+func newPageSizer(pageSize int, adaptive bool) *pageSizer {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+
+	return &pageSizer{
+		limit:    pageSize,
+		current:  pageSize,
+		adaptive: adaptive,
+	}
+}
+
+// size returns the page size to request next.
+func (p *pageSizer) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.current
+}
+
+// observe adjusts the page size based on the outcome of a list request.
+func (p *pageSizer) observe(err error) {
+	if !p.adaptive {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case err == nil:
+		p.current = min(p.current*2, p.limit)
+	case isOverloaded(err):
+		p.current = max(p.current/2, min(minAdaptivePageSize, p.limit))
+	}
+}
+
+// isOverloaded reports whether a request failed in a way that a smaller page might avoid.
+// uhttp reports timeouts as DeadlineExceeded and 5xx responses as Unavailable.
+func isOverloaded(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return false
+	}
+
+	code := grpcErr.GRPCStatus().Code()
+	return code == codes.DeadlineExceeded || code == codes.Unavailable
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const pageTokenVersion = 1
+
+var ErrInvalidPageToken = errors.New("avalara-connector: invalid page token")
+
+// pageToken is the position of a paginated list request. It is stored in the sync
+// checkpoint instead of the raw @nextLink, so it carries no hostname and resumes
+// against whichever base URL the client is configured with.
+type pageToken struct {
+	Version  int    `json:"v"`
+	Endpoint string `json:"e"`
+	Skip     int    `json:"s,omitempty"`
+	Top      int    `json:"t,omitempty"`
+	Filter   string `json:"f,omitempty"`
+	OrderBy  string `json:"o,omitempty"`
+}
+
+func (t *pageToken) encode() (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("avalara-connector: failed to encode page token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageToken(token string) (*pageToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPageToken, err)
+	}
+
+	var t pageToken
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPageToken, err)
+	}
+
+	if t.Version != pageTokenVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidPageToken, t.Version)
+	}
+
+	return &t, nil
+}
+
+// pageTokenFromNextLink captures the endpoint and OData query of a next link. The
+// base URL's path is stripped from the endpoint so that the token stays relative to it.
+// Next links to untrusted hosts are rejected rather than silently rebased.
+func (c *AvalaraClient) pageTokenFromNextLink(nextLink string) (string, error) {
+	u, err := url.Parse(nextLink)
+	if err != nil {
+		return "", fmt.Errorf("avalara-connector: failed to parse next link: %w", err)
+	}
+
+	err = c.checkNextLink(u)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := u.Path
+	base, err := url.Parse(c.baseURL)
+	if err == nil {
+		basePath := strings.TrimSuffix(base.Path, "/")
+		if basePath != "" && strings.HasPrefix(endpoint, basePath+"/") {
+			endpoint = strings.TrimPrefix(endpoint, basePath)
+		}
+	}
+
+	query := u.Query()
+	t := &pageToken{
+		Version:  pageTokenVersion,
+		Endpoint: endpoint,
+		Filter:   query.Get("$filter"),
+		OrderBy:  query.Get("$orderby"),
+	}
+
+	t.Skip, err = queryInt(query, "$skip")
+	if err != nil {
+		return "", err
+	}
+	if t.Skip == 0 {
+		return "", fmt.Errorf("avalara-connector: next link has no $skip: %s", endpoint)
+	}
+
+	t.Top, err = queryInt(query, "$top")
+	if err != nil {
+		return "", err
+	}
+
+	return t.encode()
+}
+
+func queryInt(query url.Values, key string) (int, error) {
+	value := query.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("avalara-connector: invalid %s in next link: %w", key, err)
+	}
+
+	return n, nil
+}
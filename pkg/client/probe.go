@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProbeResult describes the response to a diagnostic request.
+type ProbeResult struct {
+	StatusCode    int
+	CorrelationID string
+	// Error is the error the API responded with, if any.
+	Error *AvalaraError
+}
+
+// Probe sends an authenticated GET request for at most one record of endpoint and reports
+// how the API responded. Unlike other requests, it bypasses the cache and does not turn error
+// statuses into errors, so the status and correlation ID of every response can be reported.
+// result is decoded from successful responses when it is not nil.
+func (c *AvalaraClient) Probe(ctx context.Context, endpoint string, result interface{}) (*ProbeResult, error) {
+	u, err := url.Parse(c.baseURL + endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("$top", "1")
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Basic "+c.credentials)
+	req.Header.Set("X-Avalara-Client", c.clientHeader)
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	resp, err := c.httpClient.HttpClient.Do(req)
+	c.metrics.recordRequest(ctx, http.MethodGet, u.Path, resp, time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	c.metrics.recordBytesRead(ctx, u.Path, len(bodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	probe := &ProbeResult{
+		StatusCode:    resp.StatusCode,
+		CorrelationID: resp.Header.Get("X-Correlation-Id"),
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errorResp AvalaraErrorResponse
+		if err := json.Unmarshal(bodyBytes, &errorResp); err == nil && errorResp.Error.Code != "" {
+			probe.Error = &errorResp.Error
+		}
+		return probe, nil
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(bodyBytes, result); err != nil {
+			probe.Error = &AvalaraError{
+				Code:    "FormatException",
+				Message: "The server returned the response in an unexpected format",
+				Details: err.Error(),
+			}
+		}
+	}
+
+	return probe, nil
+}
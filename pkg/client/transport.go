@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/conductorone/baton-sdk/pkg/sdk"
+	"github.com/conductorone/baton-sdk/pkg/uhttp"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+// httpClientTimeout matches the timeout of the clients uhttp creates.
+const httpClientTimeout = 300 * time.Second
+
+// TransportConfig configures how the client connects to the Avalara API.
+type TransportConfig struct {
+	// ProxyURL sends requests through an HTTP(S) proxy instead of the one set in the environment.
+	ProxyURL string
+	// CABundlePath is a PEM file of CA certificates trusted in addition to the system roots.
+	CABundlePath string
+	// ClientCertPath and ClientKeyPath are a PEM certificate and key presented for mutual TLS.
+	ClientCertPath string
+	ClientKeyPath  string
+}
+
+// Proxy parses the proxy URL. It returns nil when no proxy is configured.
+func (t *TransportConfig) Proxy() (*url.URL, error) {
+	if t.ProxyURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(t.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("avalara-connector: proxy URL %q must use http, https or socks5", u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("avalara-connector: proxy URL %q has no host", u.Redacted())
+	}
+
+	return u, nil
+}
+
+// TLSConfig loads the CA bundle and client certificate into a TLS configuration.
+func (t *TransportConfig) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if t.CABundlePath != "" {
+		pem, err := os.ReadFile(t.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("avalara-connector: failed to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("avalara-connector: CA bundle %s contains no PEM certificates", t.CABundlePath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.ClientCertPath != "" || t.ClientKeyPath != "" {
+		if t.ClientCertPath == "" || t.ClientKeyPath == "" {
+			return nil, fmt.Errorf("avalara-connector: both a client certificate and key are required for mutual TLS")
+		}
+
+		cert, err := tls.LoadX509KeyPair(t.ClientCertPath, t.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("avalara-connector: failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewHTTPClient creates the HTTP client used to reach the Avalara API. Requests are logged the
+// same way whether or not a proxy is configured.
+func NewHTTPClient(ctx context.Context, cfg TransportConfig) (*http.Client, error) {
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := cfg.Proxy()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := ctxzap.Extract(ctx)
+	if proxy == nil {
+		return uhttp.NewClient(ctx, uhttp.WithLogger(true, logger), uhttp.WithTLSClientConfig(tlsConfig))
+	}
+
+	// uhttp's transport always takes the proxy from the environment, and this SDK release cannot
+	// give uhttp a transport of its own, so the proxy transport is wrapped to log like uhttp does.
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("avalara-connector: unexpected default transport %T", http.DefaultTransport)
+	}
+	transport = transport.Clone()
+	transport.Proxy = http.ProxyURL(proxy)
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Timeout: httpClientTimeout,
+		Transport: &loggingTransport{
+			next:      transport,
+			logger:    logger,
+			userAgent: " baton-sdk/" + sdk.Version,
+		},
+	}, nil
+}
+
+// loggingTransport logs each request and sets the default user agent the way uhttp's transport does.
+type loggingTransport struct {
+	next      http.RoundTripper
+	logger    *zap.Logger
+	userAgent string
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+
+	fields := []zap.Field{
+		zap.String("http.method", req.Method),
+		zap.String("http.url_details.host", req.URL.Host),
+		zap.String("http.url_details.path", req.URL.Path),
+	}
+	t.logger.Debug("Request started", fields...)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	if resp != nil {
+		fields = append(fields, zap.Int("http.status_code", resp.StatusCode))
+	}
+	t.logger.Debug("Request complete", fields...)
+
+	return resp, err
+}
@@ -0,0 +1,88 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-sdk/pkg/annotations"
+	"github.com/conductorone/baton-sdk/pkg/pagination"
+	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
+)
+
+type accountBuilder struct {
+	resourceType *v2.ResourceType
+	tenants      *tenantSet
+}
+
+func (a *accountBuilder) ResourceType(ctx context.Context) *v2.ResourceType {
+	return a.resourceType
+}
+
+// List returns an account resource for each tenant. Users, roles and permissions are listed as its children.
+func (a *accountBuilder) List(
+	ctx context.Context,
+	parentResourceID *v2.ResourceId,
+	pToken *pagination.Token,
+) ([]*v2.Resource, string, annotations.Annotations, error) {
+	var rv []*v2.Resource
+
+	for _, t := range a.tenants.tenants {
+		resource, err := accountResource(ctx, t)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		rv = append(rv, resource)
+	}
+
+	return rv, "", nil, nil
+}
+
+// Entitlements always returns an empty slice for accounts.
+func (a *accountBuilder) Entitlements(
+	_ context.Context,
+	resource *v2.Resource,
+	_ *pagination.Token,
+) ([]*v2.Entitlement, string, annotations.Annotations, error) {
+	return nil, "", nil, nil
+}
+
+// Grants always returns an empty slice for accounts.
+func (a *accountBuilder) Grants(
+	_ context.Context,
+	resource *v2.Resource,
+	_ *pagination.Token,
+) ([]*v2.Grant, string, annotations.Annotations, error) {
+	return nil, "", nil, nil
+}
+
+func newAccountBuilder(tenants *tenantSet) *accountBuilder {
+	return &accountBuilder{
+		resourceType: accountResourceType,
+		tenants:      tenants,
+	}
+}
+
+func accountResource(ctx context.Context, t *tenant) (*v2.Resource, error) {
+	accountID, err := t.homeAccountID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resource, err := rs.NewResource(
+		t.name,
+		accountResourceType,
+		t.accountResourceID().Resource,
+		rs.WithDescription(fmt.Sprintf("Avalara account %d", accountID)),
+		rs.WithAnnotation(
+			&v2.ChildResourceType{ResourceTypeId: userResourceType.Id},
+			&v2.ChildResourceType{ResourceTypeId: roleResourceType.Id},
+			&v2.ChildResourceType{ResourceTypeId: permissionResourceType.Id},
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to create account resource: %w", err)
+	}
+
+	return resource, nil
+}
@@ -4,23 +4,36 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
-	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 	"github.com/conductorone/baton-sdk/pkg/annotations"
 	"github.com/conductorone/baton-sdk/pkg/connectorbuilder"
+	"github.com/conductorone/baton-sdk/pkg/metrics"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type Avalara struct {
-	client *avalaraclient.AvalaraClient
+	tenants  *tenantSet
+	progress *syncProgress
+	dryRun   bool
 }
 
 // ResourceSyncers returns a ResourceSyncer for each resource type that should be synced from the upstream service.
+// Account resources are only synced for a tenants list. Otherwise users, roles and permissions are
+// listed at the top level, so their IDs and parents match syncs from before tenants were supported.
 func (d *Avalara) ResourceSyncers(ctx context.Context) []connectorbuilder.ResourceSyncer {
-	return []connectorbuilder.ResourceSyncer{
-		newUserBuilder(d.client),
-		newRoleBuilder(d.client),
+	var syncers []connectorbuilder.ResourceSyncer
+	if d.tenants.namespaced() {
+		syncers = append(syncers, newAccountBuilder(d.tenants))
 	}
+	return append(syncers,
+		newUserBuilder(d.tenants, d.progress),
+		newRoleBuilder(d.tenants, d.progress),
+		newPermissionBuilder(d.tenants, d.progress),
+	)
 }
 
 // Asset takes an input AssetRef and attempts to fetch it using the connector's authenticated http client.
@@ -29,43 +42,186 @@ func (d *Avalara) Asset(ctx context.Context, asset *v2.AssetRef) (string, io.Rea
 	return "", nil, nil
 }
 
-// Metadata returns metadata about the connector.
+// Metadata returns metadata about the connector, including the account, environment and API version of each tenant.
 func (d *Avalara) Metadata(ctx context.Context) (*v2.ConnectorMetadata, error) {
+	tenants := make([]interface{}, 0, len(d.tenants.tenants))
+	var accountNames []string
+	for _, t := range d.tenants.tenants {
+		details := t.metadata(ctx)
+		if name, ok := details["accountName"].(string); ok && name != "" {
+			accountNames = append(accountNames, name)
+		}
+		tenants = append(tenants, details)
+	}
+
+	profile, err := structpb.NewStruct(map[string]interface{}{
+		"tenants":               tenants,
+		"accountCreationSchema": accountCreationSchema(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to create metadata profile: %w", err)
+	}
+
 	return &v2.ConnectorMetadata{
 		DisplayName: "Avalara",
-		Description: "The Avalara connector allows you to sync users, roles, and entitlements from your Avalara account.",
+		Description: d.description(accountNames),
+		Profile:     profile,
 	}, nil
 }
 
 // Validate is called to ensure that the connector is properly configured. It should exercise any API credentials.
 // to be sure that they are valid.
 func (d *Avalara) Validate(ctx context.Context) (annotations.Annotations, error) {
-	// Use the Ping method to validate the connection.
-	pingResponse, err := d.client.Ping(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to validate Avalara connection: %w", err)
+	// The SDK validates the connector at the start of every sync.
+	d.progress.begin()
+
+	var annos annotations.Annotations
+	for _, t := range d.tenants.tenants {
+		// Use the Ping method to validate the connection.
+		pingResponse, err := t.client.Ping(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate Avalara connection for tenant %s: %w", t.name, err)
+		}
+
+		// Check if the ping response indicates successful authentication.
+		if !pingResponse.Authenticated {
+			return nil, fmt.Errorf("Avalara authentication failed for tenant %s", t.name)
+		}
+
+		t.discoverHomeAccount(ctx, pingResponse)
+		err = d.tenants.checkAccounts()
+		if err != nil {
+			return nil, err
+		}
+
+		// Credentials that cannot list every user in scope would produce a partial sync.
+		p, err := t.checkPrivilege(ctx, pingResponse)
+		if err != nil {
+			return nil, err
+		}
+		p.log(ctx, t)
+
+		annotation, err := p.annotation(t)
+		if err != nil {
+			return nil, err
+		}
+		annos.Append(annotation)
 	}
 
-	// Check if the ping response indicates successful authentication.
-	if !pingResponse.Authenticated {
-		return nil, fmt.Errorf("Avalara authentication failed")
+	return annos, nil
+}
+
+// LogSyncSummary logs the totals of the requests sent to the Avalara API since the connector was created, per tenant.
+// It is called when the sync progress sees the end of a sync.
+func (d *Avalara) LogSyncSummary(ctx context.Context) {
+	for _, t := range d.tenants.tenants {
+		summary := t.client.MetricsSummary()
+		ctxzap.Extract(ctx).Info(
+			"avalara-connector: sync summary",
+			zap.String("tenant", t.name),
+			zap.Int64("requests", summary.Requests),
+			zap.Int64("failed_requests", summary.FailedRequests),
+			zap.Int64("retries", summary.Retries),
+			zap.Int64("bytes_read", summary.BytesRead),
+			zap.Any("status_codes", summary.StatusCodes),
+			zap.Any("pages", summary.PagesByType),
+			zap.Duration("elapsed", summary.Elapsed),
+		)
 	}
+}
+
+// Config holds the settings the connector is created with.
+type Config struct {
+	Environment string
+	// BaseURL replaces the environment's API URL when set.
+	BaseURL string
+	// AccountID overrides the home account discovered from the credentials.
+	AccountID int
+	Username  string
+	Password  string
+	// DryRun logs provisioning requests instead of sending them.
+	DryRun bool
+	// UserSyncStatePath enables incremental user sync when set.
+	UserSyncStatePath      string
+	FullSyncInterval       time.Duration
+	EntitlementConcurrency int
+	PageSize               int
+	AdaptivePageSize       bool
+	// AllowedHosts lists hosts, other than the API host, that next links may point at.
+	AllowedHosts []string
+	// ProxyURL, CABundlePath, ClientCertPath and ClientKeyPath configure how the Avalara API is reached.
+	ProxyURL       string
+	CABundlePath   string
+	ClientCertPath string
+	ClientKeyPath  string
+
+	// Empty include lists sync every account or company.
+	IncludeAccountIDs []int
+	ExcludeAccountIDs []int
+	IncludeCompanyIDs []int
+	ExcludeCompanyIDs []int
+	SyncInactiveUsers bool
+	SyncDeletedUsers  bool
+
+	// Tenants are synced into one c1z, each under its own account resource. When empty, a single
+	// tenant is configured from Environment, BaseURL, AccountID, Username and Password, and its
+	// resources are listed without an account resource.
+	Tenants []TenantConfig
 
-	return nil, nil
+	// MetricsHandler receives the client's request metrics. Metrics are only totalled for the sync summary when nil.
+	MetricsHandler metrics.Handler
 }
 
 // New returns a new instance of the connector.
-func New(
-	ctx context.Context,
-	environment string,
-	username, password string,
-) (*Avalara, error) {
-	client, err := avalaraclient.GetAvalaraClient(ctx, environment, username, password)
+func New(ctx context.Context, cfg Config, opts ...Option) (*Avalara, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	tenantConfigs := cfg.Tenants
+	namespaced := len(tenantConfigs) > 0
+	if !namespaced {
+		tenantConfigs = []TenantConfig{
+			{
+				Name:        defaultTenantName,
+				Environment: cfg.Environment,
+				BaseURL:     cfg.BaseURL,
+				Username:    cfg.Username,
+				Password:    cfg.Password,
+				AccountID:   cfg.AccountID,
+			},
+		}
+	}
+
+	tenants := make([]*tenant, 0, len(tenantConfigs))
+	for _, tc := range tenantConfigs {
+		t, err := newTenant(ctx, tc, namespaced, &cfg, o)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+
+	d := &Avalara{
+		tenants: newTenantSet(tenants),
+		dryRun:  cfg.DryRun,
+	}
+	err := d.tenants.checkAccounts()
 	if err != nil {
 		return nil, err
 	}
+	tenantNames := make([]string, 0, len(tenants))
+	for _, t := range tenants {
+		tenantNames = append(tenantNames, t.name)
+	}
+	// Users skip entitlements and grants, so the sync ends with the grants of roles and permissions.
+	d.progress = newSyncProgress(
+		d.LogSyncSummary,
+		tenantNames,
+		[]string{userResourceType.Id, roleResourceType.Id, permissionResourceType.Id},
+		roleResourceType.Id, permissionResourceType.Id,
+	)
 
-	return &Avalara{
-		client: client,
-	}, nil
+	return d, nil
 }
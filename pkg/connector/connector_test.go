@@ -0,0 +1,2594 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-sdk/pkg/annotations"
+	"github.com/conductorone/baton-sdk/pkg/connectorbuilder"
+	"github.com/conductorone/baton-sdk/pkg/pagination"
+	"github.com/conductorone/baton-sdk/pkg/types/entitlement"
+	"github.com/conductorone/baton-sdk/pkg/types/grant"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeAPI serves fixed users, roles and audit events, and records the filters and updates it receives.
+type fakeAPI struct {
+	users       []avalaraclient.UserModel
+	roles       []avalaraclient.SecurityRoleModel
+	auditEvents []avalaraclient.AuditEventModel
+	// userPageSize pages users by an offset page token when set.
+	userPageSize int
+
+	userFilters  []string
+	userTokens   []string
+	auditFilters []string
+	roleLists    int
+	updates      []avalaraclient.UserModel
+}
+
+func (f *fakeAPI) Ping(ctx context.Context) (*avalaraclient.PingResponse, error) {
+	return &avalaraclient.PingResponse{Authenticated: true, AuthenticatedAccountID: 1}, nil
+}
+
+func (f *fakeAPI) Probe(ctx context.Context, endpoint string, result interface{}) (*avalaraclient.ProbeResult, error) {
+	return &avalaraclient.ProbeResult{StatusCode: http.StatusOK}, nil
+}
+
+func (f *fakeAPI) GetAccount(ctx context.Context, accountID int) (*avalaraclient.AccountModel, error) {
+	return &avalaraclient.AccountModel{ID: accountID}, nil
+}
+
+func (f *fakeAPI) GetUsers(ctx context.Context, options *avalaraclient.PaginationOptions) (*avalaraclient.UserResponse, *avalaraclient.PaginationOptions, error) {
+	f.userFilters = append(f.userFilters, options.Filter)
+	f.userTokens = append(f.userTokens, options.PageToken)
+	if f.userPageSize == 0 {
+		return &avalaraclient.UserResponse{Value: f.users}, nil, nil
+	}
+
+	start, _ := strconv.Atoi(options.PageToken)
+	end := min(start+f.userPageSize, len(f.users))
+	var next *avalaraclient.PaginationOptions
+	if end < len(f.users) {
+		next = &avalaraclient.PaginationOptions{PageToken: strconv.Itoa(end)}
+	}
+	return &avalaraclient.UserResponse{Value: f.users[start:end]}, next, nil
+}
+
+func (f *fakeAPI) GetUser(ctx context.Context, accountID, userID int) (*avalaraclient.UserModel, error) {
+	for _, user := range f.users {
+		if user.ID == userID && user.AccountID == accountID {
+			return &user, nil
+		}
+	}
+	return nil, &avalaraclient.AvalaraError{Code: "EntityNotFoundError", Message: "user not found"}
+}
+
+func (f *fakeAPI) UpdateUser(ctx context.Context, accountID, userID int, user *avalaraclient.UserModel) (*avalaraclient.UserModel, error) {
+	f.updates = append(f.updates, *user)
+	for i := range f.users {
+		if f.users[i].ID == userID && f.users[i].AccountID == accountID {
+			f.users[i] = *user
+		}
+	}
+	return user, nil
+}
+
+func (f *fakeAPI) GetUserRoles(ctx context.Context, options *avalaraclient.PaginationOptions) (*avalaraclient.SecurityRoleResponse, *avalaraclient.PaginationOptions, error) {
+	f.roleLists++
+	return &avalaraclient.SecurityRoleResponse{Value: f.roles}, nil, nil
+}
+
+func (f *fakeAPI) GetPermissions(ctx context.Context, options *avalaraclient.PaginationOptions) (*avalaraclient.PermissionResponse, *avalaraclient.PaginationOptions, error) {
+	return &avalaraclient.PermissionResponse{}, nil, nil
+}
+
+func (f *fakeAPI) GetUserEntitlements(ctx context.Context, accountID, userID int) (*avalaraclient.EntitlementResponse, error) {
+	return &avalaraclient.EntitlementResponse{}, nil
+}
+
+func (f *fakeAPI) GetAuditEvents(ctx context.Context, accountID int, options *avalaraclient.PaginationOptions) (*avalaraclient.AuditEventResponse, *avalaraclient.PaginationOptions, error) {
+	f.auditFilters = append(f.auditFilters, options.Filter)
+	return &avalaraclient.AuditEventResponse{Value: f.auditEvents}, nil, nil
+}
+
+func (f *fakeAPI) MetricsSummary() avalaraclient.MetricsSummary {
+	return avalaraclient.MetricsSummary{}
+}
+
+func (f *fakeAPI) RecordRetry(ctx context.Context, endpoint string) {}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{
+		users: []avalaraclient.UserModel{
+			{ID: 10, AccountID: 1, CompanyID: 100, UserName: "admin", SecurityRoleID: "AccountAdmin", IsActive: true},
+			{ID: 11, AccountID: 1, CompanyID: 100, UserName: "clerk", SecurityRoleID: "CompanyUser", IsActive: true},
+			{ID: 12, AccountID: 1, CompanyID: 200, UserName: "inactive", SecurityRoleID: "CompanyUser"},
+			{ID: 13, AccountID: 2, CompanyID: 300, UserName: "other", SecurityRoleID: "AccountAdmin", IsActive: true},
+		},
+		roles: []avalaraclient.SecurityRoleModel{
+			{ID: 1, Description: "AccountAdmin"},
+			{ID: 2, Description: "CompanyUser"},
+		},
+	}
+}
+
+// newTestSyncers builds the connector on api and returns its syncers by resource type.
+func newTestSyncers(t *testing.T, cfg Config, api avalaraclient.AvalaraAPI) map[string]connectorbuilder.ResourceSyncer {
+	t.Helper()
+
+	ctx := context.Background()
+	d, err := New(ctx, cfg, WithAPI(api))
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+
+	syncers := make(map[string]connectorbuilder.ResourceSyncer)
+	for _, syncer := range d.ResourceSyncers(ctx) {
+		syncers[syncer.ResourceType(ctx).Id] = syncer
+	}
+	return syncers
+}
+
+func TestUserBuilder_List(t *testing.T) {
+	account := func(id string) *v2.ResourceId {
+		return &v2.ResourceId{ResourceType: accountResourceType.Id, Resource: id}
+	}
+
+	testCases := []struct {
+		name     string
+		cfg      Config
+		parent   *v2.ResourceId
+		expected []string
+	}{
+		{
+			name:     "home account",
+			cfg:      Config{AccountID: 1},
+			parent:   nil,
+			expected: []string{"10", "11"},
+		},
+		{
+			name:     "account parent without a tenants list",
+			cfg:      Config{AccountID: 1},
+			parent:   account("1"),
+			expected: []string{},
+		},
+		{
+			name:     "inactive users",
+			cfg:      Config{AccountID: 1, SyncInactiveUsers: true},
+			parent:   nil,
+			expected: []string{"10", "11", "12"},
+		},
+		{
+			name:     "excluded company",
+			cfg:      Config{AccountID: 1, SyncInactiveUsers: true, ExcludeCompanyIDs: []int{200}},
+			parent:   nil,
+			expected: []string{"10", "11"},
+		},
+		{
+			name:     "included accounts",
+			cfg:      Config{AccountID: 1, IncludeAccountIDs: []int{2}},
+			parent:   nil,
+			expected: []string{"13"},
+		},
+		{
+			name:     "namespaced tenant",
+			cfg:      Config{Tenants: []TenantConfig{{Name: "parent", AccountID: 1}}},
+			parent:   account("1"),
+			expected: []string{"parent/10", "parent/11"},
+		},
+		{
+			name:     "namespaced tenant without parent",
+			cfg:      Config{Tenants: []TenantConfig{{Name: "parent", AccountID: 1}}},
+			parent:   nil,
+			expected: []string{},
+		},
+		{
+			name:     "unknown account",
+			cfg:      Config{Tenants: []TenantConfig{{Name: "parent", AccountID: 1}}},
+			parent:   account("2"),
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			syncers := newTestSyncers(t, tc.cfg, newFakeAPI())
+
+			users, _, _, err := syncers[userResourceType.Id].List(context.Background(), tc.parent, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			ids := resourceIDs(users)
+			if strings.Join(ids, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("Expected users %v, got %v", tc.expected, ids)
+			}
+			for _, user := range users {
+				if user.ParentResourceId.GetResource() != tc.parent.GetResource() {
+					t.Errorf("Expected parent %v, got %v", tc.parent, user.ParentResourceId)
+				}
+			}
+		})
+	}
+}
+
+func TestRoleBuilder_Grants(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	syncers := newTestSyncers(t, Config{AccountID: 1, SyncInactiveUsers: true}, api)
+	roleSyncer := syncers[roleResourceType.Id]
+
+	roles, _, _, err := roleSyncer.List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(roles) != 2 {
+		t.Fatalf("Expected 2 roles, got %d", len(roles))
+	}
+
+	testCases := []struct {
+		role     *v2.Resource
+		expected []string
+	}{
+		{role: roles[0], expected: []string{"10"}},
+		{role: roles[1], expected: []string{"11", "12"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.role.DisplayName, func(t *testing.T) {
+			grants, _, _, err := roleSyncer.Grants(ctx, tc.role, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			var principals []string
+			for _, g := range grants {
+				principals = append(principals, g.Principal.Id.Resource)
+			}
+			if strings.Join(principals, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("Expected principals %v, got %v", tc.expected, principals)
+			}
+		})
+	}
+
+	// The users are listed once for the grants of every role.
+	if len(api.userFilters) != 1 {
+		t.Errorf("Expected the users to be listed once, got %d listings", len(api.userFilters))
+	}
+}
+
+func TestRoleBuilder_GrantsPaging(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	for id := 100; id < 100+avalaraclient.DefaultPageSize; id++ {
+		api.users = append(api.users, avalaraclient.UserModel{ID: id, AccountID: 1, SecurityRoleID: "CompanyUser", IsActive: true})
+	}
+	api.userPageSize = 40
+	roleSyncer := newTestSyncers(t, Config{AccountID: 1, SyncInactiveUsers: true}, api)[roleResourceType.Id]
+
+	roles, _, _, err := roleSyncer.List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The grants are paged from the one listing of the users, which follows every page of users.
+	var principals []string
+	var pages int
+	token := ""
+	for {
+		grants, next, _, err := roleSyncer.Grants(ctx, roles[1], &pagination.Token{Token: token})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		pages++
+		for _, g := range grants {
+			principals = append(principals, g.Principal.Id.Resource)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	expected := 2 + avalaraclient.DefaultPageSize
+	if len(principals) != expected || principals[0] != "11" || principals[1] != "12" {
+		t.Errorf("Expected %d principals starting with 11 and 12, got %v", expected, principals)
+	}
+	if pages != 2 {
+		t.Errorf("Expected 2 pages of grants, got %d", pages)
+	}
+	if strings.Join(api.userTokens, ",") != ",40,80" {
+		t.Errorf("Expected one listing of the users, got page tokens %q", api.userTokens)
+	}
+}
+
+func TestRoleBuilder_GrantAndRevoke(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Tenants: []TenantConfig{{Name: "parent", AccountID: 1}, {Name: "subsidiary", AccountID: 2}}}
+	accounts := map[string]string{"parent": "1", "subsidiary": "2"}
+
+	role := func(tenantName, description string) *v2.Resource {
+		syncers := newTestSyncers(t, cfg, newFakeAPI())
+		roles, _, _, err := syncers[roleResourceType.Id].List(ctx, &v2.ResourceId{ResourceType: accountResourceType.Id, Resource: accounts[tenantName]}, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		for _, r := range roles {
+			if r.DisplayName == description {
+				return r
+			}
+		}
+		t.Fatalf("Expected role %s", description)
+		return nil
+	}
+
+	user := func(tenantName, id string) *v2.Resource {
+		syncers := newTestSyncers(t, cfg, newFakeAPI())
+		users, _, _, err := syncers[userResourceType.Id].List(ctx, &v2.ResourceId{ResourceType: accountResourceType.Id, Resource: accounts[tenantName]}, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		for _, u := range users {
+			if u.Id.Resource == tenantName+tenantIDSeparator+id {
+				return u
+			}
+		}
+		t.Fatalf("Expected user %s", id)
+		return nil
+	}
+
+	testCases := []struct {
+		name       string
+		revoke     bool
+		user       *v2.Resource
+		role       *v2.Resource
+		annotation string
+		update     string
+		err        string
+	}{
+		{
+			name:   "grant",
+			user:   user("parent", "11"),
+			role:   role("parent", "AccountAdmin"),
+			update: "AccountAdmin",
+		},
+		{
+			name:       "grant already held",
+			user:       user("parent", "10"),
+			role:       role("parent", "AccountAdmin"),
+			annotation: "GrantAlreadyExists",
+		},
+		{
+			name: "grant across tenants",
+			user: user("parent", "11"),
+			role: role("subsidiary", "AccountAdmin"),
+			err:  "belongs to tenant parent",
+		},
+		{
+			name:   "revoke",
+			revoke: true,
+			user:   user("parent", "10"),
+			role:   role("parent", "AccountAdmin"),
+			update: fallbackSecurityRole,
+		},
+		{
+			name:       "revoke not held",
+			revoke:     true,
+			user:       user("parent", "11"),
+			role:       role("parent", "AccountAdmin"),
+			annotation: "GrantAlreadyRevoked",
+		},
+		{
+			name:   "revoke fallback role",
+			revoke: true,
+			user:   user("parent", "11"),
+			role:   role("parent", fallbackSecurityRole),
+			err:    "every user must hold a security role",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newFakeAPI()
+			roleSyncer, ok := newTestSyncers(t, cfg, api)[roleResourceType.Id].(connectorbuilder.ResourceProvisioner)
+			if !ok {
+				t.Fatalf("Expected the role builder to provision grants")
+			}
+
+			ent := entitlement.NewAssignmentEntitlement(tc.role, RoleMemberEntitlement)
+			var annos annotations.Annotations
+			var err error
+			if tc.revoke {
+				annos, err = roleSyncer.Revoke(ctx, grant.NewGrant(tc.role, RoleMemberEntitlement, tc.user))
+			} else {
+				annos, err = roleSyncer.Grant(ctx, tc.user, ent)
+			}
+
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("Expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if tc.annotation != "" {
+				if len(annos) != 1 || !strings.HasSuffix(annos[0].TypeUrl, "."+tc.annotation) {
+					t.Errorf("Expected annotation %s, got %v", tc.annotation, annos)
+				}
+			}
+
+			switch {
+			case tc.update == "" && len(api.updates) != 0:
+				t.Errorf("Expected no update, got %v", api.updates)
+			case tc.update != "" && (len(api.updates) != 1 || api.updates[0].SecurityRoleID != tc.update):
+				t.Errorf("Expected the user to be updated to %s, got %v", tc.update, api.updates)
+			}
+		})
+	}
+}
+
+// TestRoleBuilder_RepeatedProvisioning retries each grant and revoke, as the SDK does when a
+// task is redelivered, and checks that only the first of each changes the user.
+func TestRoleBuilder_RepeatedProvisioning(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	syncers := newTestSyncers(t, Config{AccountID: 1}, api)
+
+	roles, _, _, err := syncers[roleResourceType.Id].List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	users, _, _, err := syncers[userResourceType.Id].List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	role, user := roles[0], users[1]
+	provisioner, ok := syncers[roleResourceType.Id].(connectorbuilder.ResourceProvisioner)
+	if !ok {
+		t.Fatalf("Expected the role builder to provision grants")
+	}
+
+	steps := []struct {
+		revoke     bool
+		annotation string
+		updates    int
+	}{
+		{revoke: false, annotation: "", updates: 1},
+		{revoke: false, annotation: "GrantAlreadyExists", updates: 1},
+		{revoke: true, annotation: "", updates: 2},
+		{revoke: true, annotation: "GrantAlreadyRevoked", updates: 2},
+	}
+
+	for i, step := range steps {
+		var annos annotations.Annotations
+		if step.revoke {
+			annos, err = provisioner.Revoke(ctx, grant.NewGrant(role, RoleMemberEntitlement, user))
+		} else {
+			annos, err = provisioner.Grant(ctx, user, entitlement.NewAssignmentEntitlement(role, RoleMemberEntitlement))
+		}
+		if err != nil {
+			t.Fatalf("step %d: Expected no error, got %v", i, err)
+		}
+
+		var got string
+		if len(annos) == 1 {
+			got = annos[0].TypeUrl[strings.LastIndex(annos[0].TypeUrl, ".")+1:]
+		}
+		if got != step.annotation || len(annos) > 1 {
+			t.Errorf("step %d: Expected annotation %q, got %v", i, step.annotation, annos)
+		}
+		if len(api.updates) != step.updates {
+			t.Errorf("step %d: Expected %d updates, got %d", i, step.updates, len(api.updates))
+		}
+	}
+
+	if api.users[1].SecurityRoleID != fallbackSecurityRole {
+		t.Errorf("Expected the user to end with role %s, got %s", fallbackSecurityRole, api.users[1].SecurityRoleID)
+	}
+}
+
+func TestNew_WithRoundTripper(t *testing.T) {
+	var requested []string
+	roundTripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"authenticated": true, "authenticatedAccountId": 7}`)),
+			Request:    req,
+		}, nil
+	})
+
+	ctx := context.Background()
+	d, err := New(ctx, Config{
+		Environment: "sandbox",
+		Username:    "testuser",
+		Password:    "testpass",
+		// The proxy is ignored because requests go through the round tripper.
+		ProxyURL: "http://proxy.invalid:3128",
+	}, WithRoundTripper(roundTripper))
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+
+	accountID, err := d.tenants.tenants[0].homeAccountID(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if accountID != 7 {
+		t.Errorf("Expected account 7, got %d", accountID)
+	}
+	if len(requested) != 1 || requested[0] != avalaraclient.SandboxBaseURL+"/api/v2/utilities/ping" {
+		t.Errorf("Expected a ping to the sandbox, got %v", requested)
+	}
+}
+
+func TestNew_BaseURL(t *testing.T) {
+	testCases := []struct {
+		name        string
+		environment string
+		baseURL     string
+		expected    string
+	}{
+		{name: "production", environment: "production", expected: avalaraclient.ProductionBaseURL},
+		{name: "sandbox", environment: "sandbox", expected: avalaraclient.SandboxBaseURL},
+		{name: "test server", environment: "test", expected: avalaraclient.TestBaseURL},
+		{name: "base URL replaces the environment", environment: "sandbox", baseURL: "https://avatax.proxy.example.com/", expected: "https://avatax.proxy.example.com"},
+		{name: "loopback base URL", baseURL: "http://127.0.0.1:9090", expected: "http://127.0.0.1:9090"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requested []string
+			roundTripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				requested = append(requested, req.URL.String())
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{"application/json"}},
+					Body:       io.NopCloser(strings.NewReader(`{"authenticated": true, "authenticatedAccountId": 7}`)),
+					Request:    req,
+				}, nil
+			})
+
+			ctx := context.Background()
+			d, err := New(ctx, Config{Environment: tc.environment, BaseURL: tc.baseURL}, WithRoundTripper(roundTripper))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+
+			_, err = d.tenants.tenants[0].homeAccountID(ctx)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			expected := tc.expected + "/api/v2/utilities/ping"
+			if len(requested) != 1 || requested[0] != expected {
+				t.Errorf("Expected a ping to %s, got %v", expected, requested)
+			}
+		})
+	}
+}
+
+// pingAPI answers Ping with ping and counts the calls.
+type pingAPI struct {
+	*fakeAPI
+	ping  *avalaraclient.PingResponse
+	pings int
+}
+
+func (p *pingAPI) Ping(ctx context.Context) (*avalaraclient.PingResponse, error) {
+	p.pings++
+	return p.ping, nil
+}
+
+func TestTenant_HomeAccount(t *testing.T) {
+	testCases := []struct {
+		name          string
+		accountID     int
+		pingAccountID int
+		expected      int
+		expectedPings int
+		expectedErr   bool
+	}{
+		{name: "discovered from the credentials", pingAccountID: 7, expected: 7, expectedPings: 1},
+		{name: "configured account is kept", accountID: 5, pingAccountID: 7, expected: 5},
+		{name: "credentials without an account", expectedPings: 1, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			api := &pingAPI{
+				fakeAPI: newFakeAPI(),
+				ping:    &avalaraclient.PingResponse{Authenticated: true, AuthenticatedAccountID: tc.pingAccountID},
+			}
+			d, err := New(ctx, Config{AccountID: tc.accountID}, WithAPI(api))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+			tenant := d.tenants.tenants[0]
+
+			// The second lookup is served from the scope.
+			for i := 0; i < 2; i++ {
+				accountID, err := tenant.homeAccountID(ctx)
+				if tc.expectedErr {
+					if err == nil {
+						t.Fatalf("Expected an error, got account %d", accountID)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if accountID != tc.expected {
+					t.Errorf("Expected account %d, got %d", tc.expected, accountID)
+				}
+			}
+			if tc.expectedErr {
+				return
+			}
+			if api.pings != tc.expectedPings {
+				t.Errorf("Expected %d pings, got %d", tc.expectedPings, api.pings)
+			}
+
+			// A later Validate does not move the scope off a configured account.
+			tenant.discoverHomeAccount(ctx, api.ping)
+			expectedFilter := fmt.Sprintf("accountId in (%d) and isActive eq true and isDeleted eq false", tc.expected)
+			if filter := tenant.scope.userFilter(); filter != expectedFilter {
+				t.Errorf("Expected filter %q, got %q", expectedFilter, filter)
+			}
+		})
+	}
+}
+
+func TestValidate_DiscoversHomeAccount(t *testing.T) {
+	ctx := context.Background()
+	api := &pingAPI{
+		fakeAPI: newFakeAPI(),
+		ping:    &avalaraclient.PingResponse{Authenticated: true, AuthenticatedAccountID: 7, AuthenticatedCompanyID: 70},
+	}
+	d, err := New(ctx, Config{}, WithAPI(api))
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+
+	_, err = d.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	accountID, err := d.tenants.tenants[0].homeAccountID(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if accountID != 7 {
+		t.Errorf("Expected account 7, got %d", accountID)
+	}
+	if api.pings != 1 {
+		t.Errorf("Expected the account discovered by Validate to be reused, got %d pings", api.pings)
+	}
+}
+
+func TestTenants_Routing(t *testing.T) {
+	var requested []string
+	roundTripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.Host+req.URL.Path)
+		body := `{"value": [{"id": 10, "accountId": 1, "userName": "admin", "isActive": true}]}`
+		if strings.HasSuffix(req.URL.Path, "/ping") {
+			body = `{"authenticated": true, "authenticatedAccountId": 2}`
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+
+	ctx := context.Background()
+	d, err := New(ctx, Config{
+		Tenants: []TenantConfig{
+			{Name: "parent", BaseURL: "https://parent.example.com"},
+			{Name: "subsidiary", BaseURL: "https://subsidiary.example.com", AccountID: 1},
+		},
+	}, WithRoundTripper(roundTripper))
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+	syncers := make(map[string]connectorbuilder.ResourceSyncer)
+	for _, syncer := range d.ResourceSyncers(ctx) {
+		syncers[syncer.ResourceType(ctx).Id] = syncer
+	}
+
+	accounts, _, _, err := syncers[accountResourceType.Id].List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// Accounts are identified by their Avalara account ID, whether it was configured or discovered.
+	if ids := strings.Join(resourceIDs(accounts), ","); ids != "2,1" {
+		t.Errorf("Expected an account for each tenant, got %s", ids)
+	}
+
+	// Each tenant's users come from its own API and are namespaced under its account.
+	requested = nil
+	users, _, _, err := syncers[userResourceType.Id].List(ctx, accounts[1].Id, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if ids := strings.Join(resourceIDs(users), ","); ids != "subsidiary/10" {
+		t.Errorf("Expected user subsidiary/10, got %s", ids)
+	}
+	if users[0].ParentResourceId.Resource != "1" {
+		t.Errorf("Expected the user to belong to the subsidiary account, got %s", users[0].ParentResourceId.Resource)
+	}
+	if len(requested) != 1 || requested[0] != "subsidiary.example.com/api/v2/users" {
+		t.Errorf("Expected users to be listed from the subsidiary, got %v", requested)
+	}
+
+	testCases := []struct {
+		resource string
+		tenant   string
+		id       string
+		err      bool
+	}{
+		{resource: "parent/10", tenant: "parent", id: "10"},
+		{resource: "subsidiary/CompanyFetch", tenant: "subsidiary", id: "CompanyFetch"},
+		{resource: "other/10", err: true},
+		{resource: "10", err: true},
+	}
+	for _, tc := range testCases {
+		tenant, id, err := d.tenants.forResource(&v2.ResourceId{ResourceType: userResourceType.Id, Resource: tc.resource})
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error for %s, got tenant %s", tc.resource, tenant.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", tc.resource, err)
+		}
+		if tenant.name != tc.tenant || id != tc.id {
+			t.Errorf("Expected %s to be %s of tenant %s, got %s of tenant %s", tc.resource, tc.id, tc.tenant, id, tenant.name)
+		}
+	}
+
+	if path := d.tenants.byName["parent"].userSyncStatePath("/var/lib/baton/users.json"); path != "/var/lib/baton/users.parent.json" {
+		t.Errorf("Expected a state file per tenant, got %s", path)
+	}
+
+	// Tenants for the same account would have account resources with the same ID.
+	_, err = New(ctx, Config{
+		Tenants: []TenantConfig{{Name: "parent", AccountID: 1}, {Name: "subsidiary", AccountID: 1}},
+	}, WithRoundTripper(roundTripper))
+	if err == nil || !strings.Contains(err.Error(), "both for account 1") {
+		t.Errorf("Expected an error for tenants with the same account, got %v", err)
+	}
+	d, err = New(ctx, Config{
+		Tenants: []TenantConfig{{Name: "parent", BaseURL: "https://parent.example.com"}, {Name: "subsidiary", AccountID: 2}},
+	}, WithRoundTripper(roundTripper))
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+	_, err = d.Validate(ctx)
+	if err == nil || !strings.Contains(err.Error(), "both for account 2") {
+		t.Errorf("Expected an error for a discovered account another tenant has, got %v", err)
+	}
+}
+
+func TestResourceSyncers_Layout(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		name     string
+		cfg      Config
+		expected string
+	}{
+		{name: "without a tenants list", cfg: Config{AccountID: 1}, expected: "user,role,permission"},
+		{name: "tenants list", cfg: Config{Tenants: []TenantConfig{{Name: "parent", AccountID: 1}}}, expected: "account,user,role,permission"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := New(ctx, tc.cfg, WithAPI(newFakeAPI()))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+
+			var types []string
+			for _, syncer := range d.ResourceSyncers(ctx) {
+				types = append(types, syncer.ResourceType(ctx).Id)
+			}
+			if strings.Join(types, ",") != tc.expected {
+				t.Errorf("Expected resource types %s, got %v", tc.expected, types)
+			}
+		})
+	}
+
+	// Accounts only group the resources of a tenant, so they have no entitlements or grants.
+	annos := annotations.Annotations(accountResourceType.Annotations)
+	if !annos.Contains(&v2.SkipEntitlementsAndGrants{}) {
+		t.Errorf("Expected accounts to skip entitlements and grants, got %v", accountResourceType.Annotations)
+	}
+}
+
+func TestNew_Transport(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"authenticated": true, "authenticatedAccountId": 7}`))
+	}))
+	defer proxy.Close()
+
+	ctx := context.Background()
+	d, err := New(ctx, Config{
+		Tenants: []TenantConfig{
+			{Name: "parent", BaseURL: "http://parent.example.com"},
+			{Name: "subsidiary", BaseURL: "http://subsidiary.example.com"},
+		},
+		ProxyURL: proxy.URL,
+	})
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+
+	// Every tenant's requests go through the proxy.
+	for _, tenant := range d.tenants.tenants {
+		_, err := tenant.homeAccountID(ctx)
+		if err != nil {
+			t.Fatalf("Expected no error for tenant %s, got %v", tenant.name, err)
+		}
+	}
+	expected := []string{"http://parent.example.com/api/v2/utilities/ping", "http://subsidiary.example.com/api/v2/utilities/ping"}
+	if !reflect.DeepEqual(proxied, expected) {
+		t.Errorf("Expected %v to be proxied, got %v", expected, proxied)
+	}
+
+	_, err = New(ctx, Config{Environment: "sandbox", CABundlePath: filepath.Join(t.TempDir(), "missing.pem")})
+	if err == nil || !strings.Contains(err.Error(), "tenant default") {
+		t.Errorf("Expected an error naming the tenant for an unreadable CA bundle, got %v", err)
+	}
+}
+
+func TestNew_PageSize(t *testing.T) {
+	testCases := []struct {
+		name      string
+		pageSize  int
+		eventSize int
+		expected  string
+		events    string
+	}{
+		{name: "default", expected: "100", events: "100"},
+		{name: "configured", pageSize: 250, expected: "250", events: "250"},
+		{name: "above the API maximum", pageSize: 5000, expected: "1000", events: "1000"},
+		{name: "stream token size", pageSize: 250, eventSize: 25, expected: "250", events: "25"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tops []string
+			roundTripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				tops = append(tops, req.URL.Query().Get("$top"))
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{"application/json"}},
+					Body:       io.NopCloser(strings.NewReader(`{"value": []}`)),
+					Request:    req,
+				}, nil
+			})
+
+			ctx := context.Background()
+			d, err := New(ctx, Config{Environment: "sandbox", AccountID: 1, PageSize: tc.pageSize}, WithRoundTripper(roundTripper))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+
+			syncers := make(map[string]connectorbuilder.ResourceSyncer)
+			for _, syncer := range d.ResourceSyncers(ctx) {
+				syncers[syncer.ResourceType(ctx).Id] = syncer
+			}
+			_, _, _, err = syncers[userResourceType.Id].List(ctx, nil, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			_, _, _, err = d.ListEvents(ctx, nil, &pagination.StreamToken{Size: tc.eventSize})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			// The audit events are requested before the roles they refer to.
+			if len(tops) < 2 || tops[0] != tc.expected || tops[1] != tc.events {
+				t.Errorf("Expected page sizes %s and %s, got %v", tc.expected, tc.events, tops)
+			}
+		})
+	}
+}
+
+func TestUserBuilder_PageToken(t *testing.T) {
+	ctx := context.Background()
+
+	var requested []*url.URL
+	roundTripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL)
+		body := `{"value": [{"id": 11, "accountId": 1, "userName": "clerk", "isActive": true}]}`
+		if req.URL.Query().Get("$skip") == "" {
+			body = `{"value": [{"id": 10, "accountId": 1, "userName": "admin", "isActive": true}],
+				"@nextLink": "` + req.URL.Scheme + "://" + req.URL.Host + `/api/v2/users?$top=1&$skip=1&$filter=isActive%20eq%20true"}`
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+	newUserSyncer := func(baseURL string) connectorbuilder.ResourceSyncer {
+		d, err := New(ctx, Config{BaseURL: baseURL, AccountID: 1, PageSize: 1}, WithRoundTripper(roundTripper))
+		if err != nil {
+			t.Fatalf("Expected to create the connector, got %v", err)
+		}
+		for _, syncer := range d.ResourceSyncers(ctx) {
+			if syncer.ResourceType(ctx).Id == userResourceType.Id {
+				return syncer
+			}
+		}
+		t.Fatalf("Expected a user syncer")
+		return nil
+	}
+
+	users, token, _, err := newUserSyncer("https://first.example.com").List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(users) != 1 || token == "" {
+		t.Fatalf("Expected one user and a page token, got %d and %q", len(users), token)
+	}
+	if strings.Contains(token, "first.example.com") || strings.Contains(token, "/api/v2") {
+		t.Errorf("Expected an opaque page token, got %q", token)
+	}
+
+	// The token holds no host, so a sync resumed against another base URL continues there.
+	users, token, _, err = newUserSyncer("https://second.example.com").List(ctx, nil, &pagination.Token{Token: token})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(users) != 1 || users[0].Id.Resource != "11" || token != "" {
+		t.Errorf("Expected the last page with user 11, got %v and token %q", resourceIDs(users), token)
+	}
+	last := requested[len(requested)-1]
+	if last.Host != "second.example.com" || last.Query().Get("$skip") != "1" || last.Query().Get("$filter") != "isActive eq true" {
+		t.Errorf("Expected the second page from the new base URL, got %s", last)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestAuditEventToEvents(t *testing.T) {
+	roleIDs := map[string]string{"AccountAdmin": "1", "CompanyUser": "2"}
+
+	testCases := []struct {
+		name     string
+		event    avalaraclient.AuditEventModel
+		expected []string
+		err      error
+	}{
+		{
+			name:     "login",
+			event:    avalaraclient.AuditEventModel{ID: 1, EventType: avalaraclient.AuditEventUserLogin, UserID: 10},
+			expected: []string{"1 usage user:10"},
+		},
+		{
+			name:     "user created",
+			event:    avalaraclient.AuditEventModel{ID: 2, EventType: avalaraclient.AuditEventUserCreated, TargetUserID: 11, SecurityRoleID: "CompanyUser"},
+			expected: []string{"2:grant grant role:2 user:11"},
+		},
+		{
+			name:     "user deleted",
+			event:    avalaraclient.AuditEventModel{ID: 3, EventType: avalaraclient.AuditEventUserDeleted, TargetUserID: 11, PreviousSecurityRoleID: "CompanyUser"},
+			expected: []string{"3:revoke revoke role:2 user:11"},
+		},
+		{
+			name: "role changed",
+			event: avalaraclient.AuditEventModel{
+				ID: 4, EventType: avalaraclient.AuditEventSecurityRoleChanged, TargetUserID: 11,
+				PreviousSecurityRoleID: "CompanyUser", SecurityRoleID: "AccountAdmin",
+			},
+			expected: []string{"4:revoke revoke role:2 user:11", "4:grant grant role:1 user:11"},
+		},
+		{
+			name: "user updated without a role change",
+			event: avalaraclient.AuditEventModel{
+				ID: 5, EventType: avalaraclient.AuditEventUserUpdated, TargetUserID: 11,
+				PreviousSecurityRoleID: "CompanyUser", SecurityRoleID: "CompanyUser",
+			},
+			expected: []string{},
+		},
+		{
+			name:     "other event type",
+			event:    avalaraclient.AuditEventModel{ID: 6, EventType: "CompanyCreated", UserID: 10},
+			expected: []string{},
+		},
+		{
+			name:  "unknown role",
+			event: avalaraclient.AuditEventModel{ID: 7, EventType: avalaraclient.AuditEventUserCreated, TargetUserID: 11, SecurityRoleID: "NewRole"},
+			err:   errUnknownRole,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.event.Timestamp = "2024-08-01T10:00:00"
+			events, err := auditEventToEvents(&tenant{name: defaultTenantName}, &tc.event, roleIDs)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected error %v, got %v", tc.err, err)
+			}
+			if tc.err != nil {
+				return
+			}
+
+			summaries := eventSummaries(events)
+			if strings.Join(summaries, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("Expected events %v, got %v", tc.expected, summaries)
+			}
+		})
+	}
+}
+
+func TestListEvents_Cursor(t *testing.T) {
+	earliest := timestamppb.New(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+
+	testCases := []struct {
+		name           string
+		cfg            Config
+		cursor         string
+		expectedFilter string
+	}{
+		{
+			name:           "first call",
+			cfg:            Config{AccountID: 1},
+			expectedFilter: "timestamp gt '2024-01-01T00:00:00' or (timestamp eq '2024-01-01T00:00:00' and id gt 0)",
+		},
+		{
+			name:           "tenant cursor",
+			cfg:            Config{AccountID: 1},
+			cursor:         `{"tenants":{"default":{"timestamp":"2024-08-01T10:00:00","id":2001}}}`,
+			expectedFilter: "timestamp gt '2024-08-01T10:00:00' or (timestamp eq '2024-08-01T10:00:00' and id gt 2001)",
+		},
+		{
+			name:           "cursor saved before tenants",
+			cfg:            Config{AccountID: 1},
+			cursor:         `{"timestamp":"2024-08-01T10:00:00","id":2001}`,
+			expectedFilter: "timestamp gt '2024-08-01T10:00:00' or (timestamp eq '2024-08-01T10:00:00' and id gt 2001)",
+		},
+		{
+			name:           "tenant added since the cursor",
+			cfg:            Config{Tenants: []TenantConfig{{Name: "parent", AccountID: 1}}},
+			cursor:         `{"tenants":{"other":{"timestamp":"2024-08-01T10:00:00","id":2001}}}`,
+			expectedFilter: "timestamp gt '2024-01-01T00:00:00' or (timestamp eq '2024-01-01T00:00:00' and id gt 0)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			api := newFakeAPI()
+			api.auditEvents = []avalaraclient.AuditEventModel{
+				{ID: 2002, EventType: avalaraclient.AuditEventUserLogin, Timestamp: "2024-08-01T10:00:00", UserID: 10},
+				{ID: 2003, EventType: avalaraclient.AuditEventUserLogin, Timestamp: "2024-08-02T10:00:00", UserID: 11},
+			}
+			d, err := New(ctx, tc.cfg, WithAPI(api))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+
+			var token *pagination.StreamToken
+			if tc.cursor != "" {
+				token = &pagination.StreamToken{Cursor: tc.cursor}
+			}
+			events, state, _, err := d.ListEvents(ctx, earliest, token)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if len(api.auditFilters) != 1 || api.auditFilters[0] != tc.expectedFilter {
+				t.Errorf("Expected filter %q, got %q", tc.expectedFilter, api.auditFilters)
+			}
+			if len(events) != 2 {
+				t.Errorf("Expected 2 events, got %d", len(events))
+			}
+
+			// The next call resumes after the last event, whichever tenant the cursor held before.
+			cursors, err := parseEventCursors(state.Cursor)
+			if err != nil {
+				t.Fatalf("Expected a valid cursor, got %v", err)
+			}
+			name := d.tenants.tenants[0].name
+			expected := eventCursor{Timestamp: "2024-08-02T10:00:00", ID: 2003}
+			if cursors.Tenants[name] != expected {
+				t.Errorf("Expected cursor %v, got %v", expected, cursors.Tenants[name])
+			}
+		})
+	}
+}
+
+func TestListEvents_Roles(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	api.auditEvents = []avalaraclient.AuditEventModel{
+		{ID: 1, EventType: avalaraclient.AuditEventUserLogin, Timestamp: "2024-08-01T10:00:00", UserID: 10},
+		{ID: 2, EventType: avalaraclient.AuditEventUserCreated, Timestamp: "2024-08-01T10:00:00", TargetUserID: 14, SecurityRoleID: "NewRole"},
+		{ID: 3, EventType: avalaraclient.AuditEventUserLogin, Timestamp: "2024-08-01T11:00:00", UserID: 11},
+	}
+	d, err := New(ctx, Config{AccountID: 1}, WithAPI(api))
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+
+	// The unknown role is looked up again, and its event is skipped when the role is still unknown.
+	events, state, _, err := d.ListEvents(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if summaries := eventSummaries(events); strings.Join(summaries, ",") != "1 usage user:10,3 usage user:11" {
+		t.Errorf("Expected the events around the unknown role, got %v", summaries)
+	}
+	if api.roleLists != 2 {
+		t.Errorf("Expected roles to be listed 2 times, got %d", api.roleLists)
+	}
+	cursors, err := parseEventCursors(state.Cursor)
+	if err != nil {
+		t.Fatalf("Expected a valid cursor, got %v", err)
+	}
+	expectedCursor := eventCursor{Timestamp: "2024-08-01T11:00:00", ID: 3}
+	if cursors.Tenants[defaultTenantName] != expectedCursor {
+		t.Errorf("Expected the cursor to move past the unknown role to %v, got %v", expectedCursor, cursors.Tenants[defaultTenantName])
+	}
+
+	// A role created since the roles were listed is found by looking it up again.
+	api.roles = append(api.roles, avalaraclient.SecurityRoleModel{ID: 3, Description: "NewRole"})
+	api.auditEvents = []avalaraclient.AuditEventModel{
+		{ID: 4, EventType: avalaraclient.AuditEventUserCreated, Timestamp: "2024-08-01T12:00:00", TargetUserID: 14, SecurityRoleID: "NewRole"},
+	}
+	events, state, _, err = d.ListEvents(ctx, nil, &pagination.StreamToken{Cursor: state.Cursor})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := "4:grant grant role:3 user:14"
+	if summaries := eventSummaries(events); strings.Join(summaries, ",") != expected {
+		t.Errorf("Expected events %s, got %v", expected, summaries)
+	}
+	if !strings.Contains(api.auditFilters[1], "id gt 3)") {
+		t.Errorf("Expected the second call to resume after event 3, got %q", api.auditFilters[1])
+	}
+	if api.roleLists != 3 {
+		t.Errorf("Expected roles to be listed 3 times, got %d", api.roleLists)
+	}
+
+	// Known roles are cached until a sync lists the roles again.
+	_, _, _, err = d.ListEvents(ctx, nil, &pagination.StreamToken{Cursor: state.Cursor})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if api.roleLists != 3 {
+		t.Errorf("Expected cached roles, got %d role lists", api.roleLists)
+	}
+
+	syncers := make(map[string]connectorbuilder.ResourceSyncer)
+	for _, syncer := range d.ResourceSyncers(ctx) {
+		syncers[syncer.ResourceType(ctx).Id] = syncer
+	}
+	_, _, _, err = syncers[roleResourceType.Id].List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, _, _, err = d.ListEvents(ctx, nil, &pagination.StreamToken{Cursor: state.Cursor})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if api.roleLists != 5 {
+		t.Errorf("Expected roles to be listed again after a sync, got %d role lists", api.roleLists)
+	}
+}
+
+// eventSummaries describes events as "<id> <kind> <resource>...", to compare them in tests.
+func eventSummaries(events []*v2.Event) []string {
+	summaries := make([]string, 0, len(events))
+	for _, event := range events {
+		var summary string
+		switch {
+		case event.GetUsageEvent() != nil:
+			e := event.GetUsageEvent()
+			summary = "usage " + e.TargetResource.Id.ResourceType + ":" + e.TargetResource.Id.Resource
+		case event.GetGrantEvent() != nil:
+			g := event.GetGrantEvent().Grant
+			summary = "grant " + g.Entitlement.Resource.Id.ResourceType + ":" + g.Entitlement.Resource.Id.Resource + " " +
+				g.Principal.Id.ResourceType + ":" + g.Principal.Id.Resource
+		case event.GetRevokeEvent() != nil:
+			r := event.GetRevokeEvent()
+			summary = "revoke " + r.Entitlement.Resource.Id.ResourceType + ":" + r.Entitlement.Resource.Id.Resource + " " +
+				r.Principal.Id.ResourceType + ":" + r.Principal.Id.Resource
+		}
+		summaries = append(summaries, event.Id+" "+summary)
+	}
+	return summaries
+}
+
+func TestUserSyncState_FullSyncDue(t *testing.T) {
+	now := time.Date(2024, time.August, 2, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		state    userSyncState
+		scope    string
+		expected bool
+	}{
+		{
+			name:     "no state",
+			state:    userSyncState{fullSyncInterval: 24 * time.Hour},
+			expected: true,
+		},
+		{
+			name:     "recent full sync",
+			state:    userSyncState{fullSyncInterval: 24 * time.Hour, HighWaterMark: "2024-08-01T10:00:00", LastFullSync: now.Add(-time.Hour)},
+			expected: false,
+		},
+		{
+			name:     "full sync interval elapsed",
+			state:    userSyncState{fullSyncInterval: 24 * time.Hour, HighWaterMark: "2024-08-01T10:00:00", LastFullSync: now.Add(-24 * time.Hour)},
+			expected: true,
+		},
+		{
+			name:     "no users seen",
+			state:    userSyncState{fullSyncInterval: 24 * time.Hour, LastFullSync: now.Add(-time.Hour)},
+			expected: true,
+		},
+		{
+			name:     "scope changed",
+			state:    userSyncState{fullSyncInterval: 24 * time.Hour, HighWaterMark: "2024-08-01T10:00:00", LastFullSync: now.Add(-time.Hour)},
+			scope:    "isActive eq true",
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if due := tc.state.fullSyncDue(now, tc.scope); due != tc.expected {
+				t.Errorf("Expected full sync due %v, got %v", tc.expected, due)
+			}
+		})
+	}
+}
+
+func TestUserSyncState_Merge(t *testing.T) {
+	state := &userSyncState{Users: make(map[string]avalaraclient.UserModel)}
+	state.replace(map[string]avalaraclient.UserModel{
+		"10": {ID: 10, UserName: "admin", ModifiedDate: "2024-08-01T10:00:00"},
+		"11": {ID: 11, UserName: "clerk", ModifiedDate: "2024-07-01T10:00:00"},
+	}, time.Now(), "")
+	if state.HighWaterMark != "2024-08-01T10:00:00" {
+		t.Fatalf("Expected high-water mark 2024-08-01T10:00:00, got %s", state.HighWaterMark)
+	}
+
+	testCases := []struct {
+		name          string
+		users         []avalaraclient.UserModel
+		highWaterMark string
+		userNames     string
+	}{
+		{
+			name:          "modified in the same second as the mark",
+			users:         []avalaraclient.UserModel{{ID: 11, UserName: "clerk2", ModifiedDate: "2024-08-01T10:00:00"}},
+			highWaterMark: "2024-08-01T10:00:00",
+			userNames:     "admin,clerk2",
+		},
+		{
+			name:          "same users listed again",
+			users:         []avalaraclient.UserModel{{ID: 11, UserName: "clerk2", ModifiedDate: "2024-08-01T10:00:00"}},
+			highWaterMark: "2024-08-01T10:00:00",
+			userNames:     "admin,clerk2",
+		},
+		{
+			name:          "new user",
+			users:         []avalaraclient.UserModel{{ID: 12, UserName: "new", ModifiedDate: "2024-08-02T09:00:00"}},
+			highWaterMark: "2024-08-02T09:00:00",
+			userNames:     "admin,clerk2,new",
+		},
+		{
+			name:          "older or undated changes keep the mark",
+			users:         []avalaraclient.UserModel{{ID: 10, UserName: "admin2", ModifiedDate: "2024-01-01T00:00:00"}, {ID: 13, UserName: "undated"}},
+			highWaterMark: "2024-08-02T09:00:00",
+			userNames:     "admin2,clerk2,new,undated",
+		},
+	}
+
+	// Each case merges into the state left by the one before.
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state.merge(tc.users)
+
+			if state.HighWaterMark != tc.highWaterMark {
+				t.Errorf("Expected high-water mark %s, got %s", tc.highWaterMark, state.HighWaterMark)
+			}
+			var userNames []string
+			for _, user := range state.sortedUsers() {
+				userNames = append(userNames, user.UserName)
+			}
+			if strings.Join(userNames, ",") != tc.userNames {
+				t.Errorf("Expected users %s, got %v", tc.userNames, userNames)
+			}
+		})
+	}
+}
+
+func TestUserSyncState_Save(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	state, err := loadUserSyncState(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected a missing file to load as an empty state, got %v", err)
+	}
+	if !state.fullSyncDue(time.Now(), "") {
+		t.Errorf("Expected an empty state to need a full sync")
+	}
+
+	state.replace(map[string]avalaraclient.UserModel{
+		"10": {ID: 10, UserName: "admin", ModifiedDate: "2024-08-01T10:00:00"},
+	}, time.Now(), "isActive eq true")
+	err = state.save()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	loaded, err := loadUserSyncState(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if loaded.HighWaterMark != state.HighWaterMark || loaded.Scope != state.Scope || loaded.Users["10"].UserName != "admin" {
+		t.Errorf("Expected the saved state back, got %+v", loaded)
+	}
+	if loaded.fullSyncDue(time.Now(), "isActive eq true") {
+		t.Errorf("Expected the saved full sync to be current")
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the state file to be left behind, got %d files", len(entries))
+	}
+
+	err = os.WriteFile(path, []byte("{"), 0o600)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = loadUserSyncState(path, time.Hour)
+	if err == nil {
+		t.Errorf("Expected an error for a corrupt state file")
+	}
+}
+
+func TestUserBuilder_IncrementalSync(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{
+		AccountID:         1,
+		UserSyncStatePath: filepath.Join(t.TempDir(), "users.json"),
+		FullSyncInterval:  24 * time.Hour,
+	}
+
+	// Enough users for the cached users to be listed in more than one page.
+	api := newFakeAPI()
+	api.users = nil
+	for i := 0; i < avalaraclient.DefaultPageSize+50; i++ {
+		api.users = append(api.users, avalaraclient.UserModel{
+			ID: 1000 + i, AccountID: 1, CompanyID: 100, UserName: fmt.Sprintf("user%d", i),
+			SecurityRoleID: "CompanyUser", IsActive: true, ModifiedDate: "2024-08-01T10:00:00",
+		})
+	}
+
+	// The first sync lists every user from the API and saves them.
+	users, next, _, err := newTestSyncers(t, cfg, api)[userResourceType.Id].List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(users) != len(api.users) || next != "" {
+		t.Fatalf("Expected %d users in one page, got %d and token %q", len(api.users), len(users), next)
+	}
+	if _, err := os.Stat(cfg.UserSyncStatePath); err != nil {
+		t.Fatalf("Expected the sync state to be saved, got %v", err)
+	}
+
+	// The next sync asks for users modified since the mark, including in the same second.
+	api.userFilters = nil
+	api.users = []avalaraclient.UserModel{
+		{ID: 1000, AccountID: 1, CompanyID: 100, UserName: "renamed", SecurityRoleID: "CompanyUser", IsActive: true, ModifiedDate: "2024-08-01T10:00:00"},
+		{ID: 1001, AccountID: 1, CompanyID: 100, UserName: "deactivated", SecurityRoleID: "CompanyUser", ModifiedDate: "2024-08-02T10:00:00"},
+	}
+	syncer := newTestSyncers(t, cfg, api)[userResourceType.Id]
+	users, next, _, err = syncer.List(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expectedFilter := "modifiedDate ge '2024-08-01T10:00:00' and accountId in (1)"
+	if len(api.userFilters) != 1 || api.userFilters[0] != expectedFilter {
+		t.Errorf("Expected filter %q, got %q", expectedFilter, api.userFilters)
+	}
+	if users[0].DisplayName != "renamed" {
+		t.Errorf("Expected the modified user, got %s", users[0].DisplayName)
+	}
+
+	// The rest of the cached users are paged by offset, and the deactivated user is left out.
+	testCases := []struct {
+		token    string
+		count    int
+		next     string
+		hasError bool
+	}{
+		{token: next, count: 49, next: ""},
+		{token: cachedUsersTokenPrefix + "1000", count: 0, next: ""},
+		{token: cachedUsersTokenPrefix + "x", hasError: true},
+	}
+	if next != cachedUsersTokenPrefix+strconv.Itoa(avalaraclient.DefaultPageSize) {
+		t.Fatalf("Expected a cached page token, got %q", next)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.token, func(t *testing.T) {
+			users, next, _, err := syncer.List(ctx, nil, &pagination.Token{Token: tc.token})
+			if tc.hasError {
+				if err == nil {
+					t.Errorf("Expected an error for token %q", tc.token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(users) != tc.count || next != tc.next {
+				t.Errorf("Expected %d users and token %q, got %d and %q", tc.count, tc.next, len(users), next)
+			}
+			for _, user := range users {
+				if user.DisplayName == "deactivated" {
+					t.Errorf("Expected the deactivated user to be left out")
+				}
+			}
+		})
+	}
+}
+
+// entitlementsAPI serves user entitlements through a function, and records how many requests
+// were in flight at once and how many retries were reported.
+type entitlementsAPI struct {
+	*fakeAPI
+	get func(attempt, userID int) (*avalaraclient.EntitlementResponse, error)
+
+	mu          sync.Mutex
+	attempts    map[int]int
+	inFlight    int
+	maxInFlight int
+	calls       int
+	retries     int
+}
+
+func newEntitlementsAPI(get func(attempt, userID int) (*avalaraclient.EntitlementResponse, error)) *entitlementsAPI {
+	return &entitlementsAPI{fakeAPI: newFakeAPI(), get: get, attempts: make(map[int]int)}
+}
+
+func (a *entitlementsAPI) GetUserEntitlements(ctx context.Context, accountID, userID int) (*avalaraclient.EntitlementResponse, error) {
+	a.mu.Lock()
+	attempt := a.attempts[userID]
+	a.attempts[userID]++
+	a.calls++
+	a.inFlight++
+	a.maxInFlight = max(a.maxInFlight, a.inFlight)
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.inFlight--
+		a.mu.Unlock()
+	}()
+
+	return a.get(attempt, userID)
+}
+
+func (a *entitlementsAPI) RecordRetry(ctx context.Context, endpoint string) {
+	a.mu.Lock()
+	a.retries++
+	a.mu.Unlock()
+}
+
+func TestUserEntitlementFetcher_Fetch(t *testing.T) {
+	granted := func(userID int) *avalaraclient.EntitlementResponse {
+		return &avalaraclient.EntitlementResponse{Permissions: []string{strconv.Itoa(userID)}}
+	}
+	slow := func(attempt, userID int) (*avalaraclient.EntitlementResponse, error) {
+		time.Sleep(5 * time.Millisecond)
+		return granted(userID), nil
+	}
+
+	testCases := []struct {
+		name        string
+		users       int
+		concurrency int
+		get         func(attempt, userID int) (*avalaraclient.EntitlementResponse, error)
+		// maxCalls bounds the requests made, which is less than the users when an error cancels the rest.
+		maxCalls       int
+		maxInFlight    int
+		retries        int
+		minElapsed     time.Duration
+		expectedErr    codes.Code
+		expectedResult bool
+		// skipped lists the users expected to be left out of the result.
+		skipped []int
+	}{
+		{
+			name:           "bounded by the concurrency",
+			users:          20,
+			concurrency:    3,
+			get:            slow,
+			maxCalls:       20,
+			maxInFlight:    3,
+			expectedResult: true,
+		},
+		{
+			name:           "one worker",
+			users:          5,
+			concurrency:    1,
+			get:            slow,
+			maxCalls:       5,
+			maxInFlight:    1,
+			expectedResult: true,
+		},
+		{
+			name:        "retries when unavailable, with a growing backoff",
+			users:       1,
+			concurrency: 4,
+			get: func(attempt, userID int) (*avalaraclient.EntitlementResponse, error) {
+				if attempt < 3 {
+					return nil, status.Error(codes.Unavailable, "too many requests")
+				}
+				return granted(userID), nil
+			},
+			maxCalls:       4,
+			maxInFlight:    1,
+			retries:        3,
+			minElapsed:     70 * time.Millisecond,
+			expectedResult: true,
+		},
+		{
+			name:        "retries when resource exhausted",
+			users:       2,
+			concurrency: 2,
+			get: func(attempt, userID int) (*avalaraclient.EntitlementResponse, error) {
+				if attempt == 0 {
+					return nil, fmt.Errorf("wrapped: %w", status.Error(codes.ResourceExhausted, "quota"))
+				}
+				return granted(userID), nil
+			},
+			maxCalls:       4,
+			maxInFlight:    2,
+			retries:        2,
+			expectedResult: true,
+		},
+		{
+			name:        "gives up after the last retry",
+			users:       1,
+			concurrency: 1,
+			get: func(attempt, userID int) (*avalaraclient.EntitlementResponse, error) {
+				return nil, status.Error(codes.Unavailable, "too many requests")
+			},
+			maxCalls:    maxEntitlementRetries + 1,
+			maxInFlight: 1,
+			retries:     maxEntitlementRetries,
+			expectedErr: codes.Unavailable,
+		},
+		{
+			name:        "users that no longer exist are skipped",
+			users:       5,
+			concurrency: 2,
+			get: func(attempt, userID int) (*avalaraclient.EntitlementResponse, error) {
+				if userID == 3 {
+					return nil, fmt.Errorf("wrapped: %w", status.Error(codes.NotFound, "user not found"))
+				}
+				return granted(userID), nil
+			},
+			maxCalls:       5,
+			maxInFlight:    2,
+			skipped:        []int{3},
+			expectedResult: true,
+		},
+		{
+			name:        "first error cancels the rest",
+			users:       50,
+			concurrency: 2,
+			get: func(attempt, userID int) (*avalaraclient.EntitlementResponse, error) {
+				if userID == 0 {
+					return nil, status.Error(codes.PermissionDenied, "forbidden")
+				}
+				time.Sleep(5 * time.Millisecond)
+				return granted(userID), nil
+			},
+			maxCalls:    10,
+			maxInFlight: 2,
+			expectedErr: codes.PermissionDenied,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newEntitlementsAPI(tc.get)
+			fetcher := newUserEntitlementFetcher(api, &syncScope{}, tc.concurrency)
+			fetcher.initialBackoff = 10 * time.Millisecond
+			fetcher.maxBackoff = 40 * time.Millisecond
+
+			users := make([]avalaraclient.UserModel, tc.users)
+			for i := range users {
+				users[i] = avalaraclient.UserModel{ID: i, AccountID: 1}
+			}
+
+			start := time.Now()
+			entitlements, err := fetcher.fetch(context.Background(), users)
+			elapsed := time.Since(start)
+
+			if tc.expectedResult {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				for _, user := range users {
+					e := entitlements[user.ID]
+					if slices.Contains(tc.skipped, user.ID) {
+						if e != nil {
+							t.Errorf("Expected user %d to be skipped, got %v", user.ID, e)
+						}
+					} else if e == nil || e.Permissions[0] != strconv.Itoa(user.ID) {
+						t.Errorf("Expected the entitlements of user %d, got %v", user.ID, e)
+					}
+				}
+			} else if status.Code(errors.Unwrap(err)) != tc.expectedErr {
+				t.Errorf("Expected a %s error, got %v", tc.expectedErr, err)
+			}
+
+			if api.calls > tc.maxCalls {
+				t.Errorf("Expected at most %d requests, got %d", tc.maxCalls, api.calls)
+			}
+			if api.maxInFlight > tc.maxInFlight {
+				t.Errorf("Expected at most %d requests in flight, got %d", tc.maxInFlight, api.maxInFlight)
+			}
+			if api.retries != tc.retries {
+				t.Errorf("Expected %d retries, got %d", tc.retries, api.retries)
+			}
+			if elapsed < tc.minElapsed {
+				t.Errorf("Expected the backoff to take at least %s, got %s", tc.minElapsed, elapsed)
+			}
+		})
+	}
+}
+
+func TestUserEntitlementFetcher_SharedBackoff(t *testing.T) {
+	fetcher := newUserEntitlementFetcher(newFakeAPI(), &syncScope{}, 4)
+	fetcher.initialBackoff = 20 * time.Millisecond
+	fetcher.maxBackoff = 50 * time.Millisecond
+
+	testCases := []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}
+	for _, expected := range testCases {
+		if backoff := fetcher.increaseBackoff(); backoff != expected {
+			t.Errorf("Expected a backoff of %s, got %s", expected, backoff)
+		}
+	}
+
+	// Every worker waits out the pause set by the one that was rate limited.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fetcher.waitForBackoff(context.Background()); err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected every worker to wait for the backoff, waited %s", elapsed)
+	}
+
+	fetcher.resetBackoff()
+	if backoff := fetcher.increaseBackoff(); backoff != 20*time.Millisecond {
+		t.Errorf("Expected the backoff to start over after a success, got %s", backoff)
+	}
+}
+
+func TestUserEntitlementFetcher_ContextCanceled(t *testing.T) {
+	api := newEntitlementsAPI(func(attempt, userID int) (*avalaraclient.EntitlementResponse, error) {
+		return nil, status.Error(codes.Unavailable, "too many requests")
+	})
+	fetcher := newUserEntitlementFetcher(api, &syncScope{}, 2)
+	fetcher.initialBackoff = time.Hour
+	fetcher.maxBackoff = time.Hour
+
+	// A canceled sync stops waiting for the backoff instead of sleeping it out.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	users := []avalaraclient.UserModel{{ID: 1, AccountID: 1}, {ID: 2, AccountID: 1}, {ID: 3, AccountID: 1}}
+	start := time.Now()
+	_, err := fetcher.fetch(ctx, users)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the fetch to stop with the context, took %s", elapsed)
+	}
+}
+
+func TestIsRateLimited(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{err: status.Error(codes.Unavailable, "unavailable"), expected: true},
+		{err: status.Error(codes.ResourceExhausted, "exhausted"), expected: true},
+		{err: fmt.Errorf("wrapped: %w", status.Error(codes.Unavailable, "unavailable")), expected: true},
+		{err: status.Error(codes.NotFound, "not found"), expected: false},
+		{err: errors.New("plain"), expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			if limited := isRateLimited(tc.err); limited != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, limited)
+			}
+		})
+	}
+}
+
+func TestPermissionBuilder_Grants(t *testing.T) {
+	ctx := context.Background()
+	api := newEntitlementsAPI(func(attempt, userID int) (*avalaraclient.EntitlementResponse, error) {
+		if userID == 10 {
+			return &avalaraclient.EntitlementResponse{Permissions: []string{"CompanyFetch", "CompanySave"}}, nil
+		}
+		return &avalaraclient.EntitlementResponse{Permissions: []string{"CompanyFetch"}}, nil
+	})
+	syncers := newTestSyncers(t, Config{AccountID: 1}, api)
+	permissionSyncer := syncers[permissionResourceType.Id]
+
+	permissions := []*v2.Resource{
+		{Id: &v2.ResourceId{ResourceType: permissionResourceType.Id, Resource: "CompanyFetch"}},
+		{Id: &v2.ResourceId{ResourceType: permissionResourceType.Id, Resource: "CompanySave"}},
+	}
+	expected := map[string]string{"CompanyFetch": "10,11", "CompanySave": "10"}
+
+	// Each sync lists the users and fetches each user's entitlements once, however many permissions there are.
+	for sync := 1; sync <= 2; sync++ {
+		_, _, _, err := permissionSyncer.List(ctx, nil, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		for _, permission := range permissions {
+			grants, _, _, err := permissionSyncer.Grants(ctx, permission, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			var principals []string
+			for _, g := range grants {
+				principals = append(principals, g.Principal.Id.Resource)
+			}
+			if strings.Join(principals, ",") != expected[permission.Id.Resource] {
+				t.Errorf("Expected principals %s for %s, got %v", expected[permission.Id.Resource], permission.Id.Resource, principals)
+			}
+		}
+
+		if api.calls != 2*sync {
+			t.Errorf("Expected %d entitlement requests after sync %d, got %d", 2*sync, sync, api.calls)
+		}
+		if len(api.userFilters) != sync {
+			t.Errorf("Expected %d user listings after sync %d, got %d", sync, sync, len(api.userFilters))
+		}
+	}
+}
+
+func TestODataBuilders(t *testing.T) {
+	testCases := []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{name: "and of nothing", actual: odataAnd(), expected: ""},
+		{name: "and of empty clauses", actual: odataAnd("", ""), expected: ""},
+		{name: "and of one clause", actual: odataAnd("", "isActive eq true"), expected: "isActive eq true"},
+		{name: "and of several clauses", actual: odataAnd("isActive eq true", "", "isDeleted eq false"), expected: "isActive eq true and isDeleted eq false"},
+		{name: "and of an or clause", actual: odataAnd("a eq 1 or b eq 2", "c eq 3"), expected: "(a eq 1 or b eq 2) and c eq 3"},
+		{name: "in nothing", actual: odataIn("accountId", nil), expected: ""},
+		{name: "in one value", actual: odataIn("accountId", []int{1}), expected: "accountId in (1)"},
+		{name: "in several values", actual: odataIn("accountId", []int{1, 2, 3}), expected: "accountId in (1, 2, 3)"},
+		{name: "not in nothing", actual: odataNotIn("companyId", []int{}), expected: ""},
+		{name: "not in one value", actual: odataNotIn("companyId", []int{200}), expected: "companyId ne 200"},
+		{name: "not in several values", actual: odataNotIn("companyId", []int{200, 300}), expected: "companyId ne 200 and companyId ne 300"},
+		{name: "string", actual: odataString("CompanyUser"), expected: "'CompanyUser'"},
+		{name: "string with a quote", actual: odataString("O'Brien"), expected: "'O''Brien'"},
+		{name: "string of quotes", actual: odataString("''"), expected: "''''''"},
+		{
+			name:     "quoted value that looks like an or",
+			actual:   odataAnd("userName eq "+odataString("a' or '1' eq '1"), "isActive eq true"),
+			expected: "(userName eq 'a'' or ''1'' eq ''1') and isActive eq true",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.actual != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, tc.actual)
+			}
+		})
+	}
+}
+
+func TestSyncScope(t *testing.T) {
+	testCases := []struct {
+		name     string
+		scope    *syncScope
+		expected string
+		// included lists which of newFakeAPI's users the scope includes.
+		included string
+	}{
+		{
+			name:     "empty scope",
+			scope:    &syncScope{inactiveUsers: true, deletedUsers: true},
+			expected: "",
+			included: "10,11,12,13",
+		},
+		{
+			name:     "home account",
+			scope:    &syncScope{homeAccountID: 1},
+			expected: "accountId in (1) and isActive eq true and isDeleted eq false",
+			included: "10,11",
+		},
+		{
+			name:     "one included account replaces the home account",
+			scope:    &syncScope{homeAccountID: 1, includeAccountIDs: []int{2}},
+			expected: "accountId in (2) and isActive eq true and isDeleted eq false",
+			included: "13",
+		},
+		{
+			name:     "several accounts and companies",
+			scope:    &syncScope{includeAccountIDs: []int{1, 2}, excludeCompanyIDs: []int{100, 300}, inactiveUsers: true},
+			expected: "accountId in (1, 2) and companyId ne 100 and companyId ne 300 and isDeleted eq false",
+			included: "12",
+		},
+		{
+			name:     "excluded account",
+			scope:    &syncScope{excludeAccountIDs: []int{2}, includeCompanyIDs: []int{100}, deletedUsers: true},
+			expected: "accountId ne 2 and companyId in (100) and isActive eq true",
+			included: "10,11",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if filter := tc.scope.userFilter(); filter != tc.expected {
+				t.Errorf("Expected filter %q, got %q", tc.expected, filter)
+			}
+
+			var included []string
+			for _, user := range newFakeAPI().users {
+				if tc.scope.includesUser(&user) {
+					included = append(included, strconv.Itoa(user.ID))
+				}
+			}
+			if strings.Join(included, ",") != tc.included {
+				t.Errorf("Expected users %s, got %v", tc.included, included)
+			}
+		})
+	}
+
+	deleted := avalaraclient.UserModel{ID: 14, AccountID: 1, IsActive: true, IsDeleted: true}
+	if (&syncScope{homeAccountID: 1}).includesUser(&deleted) {
+		t.Errorf("Expected deleted users to be left out by default")
+	}
+	if !(&syncScope{homeAccountID: 1, deletedUsers: true}).includesUser(&deleted) {
+		t.Errorf("Expected deleted users to be included when configured")
+	}
+}
+
+func TestSyncProgress(t *testing.T) {
+	type step struct {
+		// listed records a page of a tenant's resources when set, otherwise the final grants page of grant.
+		tenant   string
+		listed   string
+		ids      []string
+		lastPage bool
+		grant    string
+		// permission marks grant as a permission rather than a role.
+		permission bool
+		// complete is whether the summary is logged by this step.
+		complete bool
+	}
+
+	listedTypes := []string{userResourceType.Id, roleResourceType.Id, permissionResourceType.Id}
+	testCases := []struct {
+		name    string
+		tenants []string
+		steps   []step
+		// resumed is the number of resources of each type counted without a listing.
+		resumed map[string]int
+	}{
+		{
+			name:    "ends with the last grants",
+			tenants: []string{"a"},
+			steps: []step{
+				{tenant: "a", listed: userResourceType.Id, lastPage: true},
+				{tenant: "a", listed: roleResourceType.Id, ids: []string{"1"}},
+				{tenant: "a", listed: roleResourceType.Id, ids: []string{"2"}, lastPage: true},
+				{tenant: "a", listed: permissionResourceType.Id, ids: []string{"CompanyFetch"}, lastPage: true},
+				{grant: "1"},
+				{grant: "CompanyFetch", permission: true},
+				{grant: "2", complete: true},
+			},
+		},
+		{
+			name:    "no roles or permissions",
+			tenants: []string{"a"},
+			steps: []step{
+				{tenant: "a", listed: roleResourceType.Id, lastPage: true},
+				{tenant: "a", listed: permissionResourceType.Id, lastPage: true},
+				{tenant: "a", listed: userResourceType.Id, lastPage: true, complete: true},
+			},
+		},
+		{
+			name:    "retried grants count once",
+			tenants: []string{"a"},
+			steps: []step{
+				{tenant: "a", listed: userResourceType.Id, lastPage: true},
+				{tenant: "a", listed: roleResourceType.Id, ids: []string{"1", "2"}, lastPage: true},
+				{tenant: "a", listed: permissionResourceType.Id, lastPage: true},
+				{grant: "1"},
+				{grant: "1"},
+				{grant: "2", complete: true},
+				{grant: "2"},
+			},
+		},
+		{
+			name:    "waits for every tenant",
+			tenants: []string{"a", "b"},
+			steps: []step{
+				{tenant: "a", listed: userResourceType.Id, lastPage: true},
+				{tenant: "a", listed: roleResourceType.Id, lastPage: true},
+				{tenant: "a", listed: permissionResourceType.Id, lastPage: true},
+				{tenant: "b", listed: userResourceType.Id, lastPage: true},
+				{tenant: "b", listed: roleResourceType.Id, ids: []string{"b/1"}, lastPage: true},
+				{tenant: "b", listed: permissionResourceType.Id, lastPage: true},
+				{grant: "b/1", complete: true},
+			},
+		},
+		{
+			name:    "resumed after the listings",
+			tenants: []string{"a"},
+			steps: []step{
+				{grant: "1"},
+				{grant: "2"},
+				{grant: "CompanyFetch", permission: true},
+			},
+			resumed: map[string]int{roleResourceType.Id: 2, permissionResourceType.Id: 1},
+		},
+		{
+			name:    "resumed during the listings",
+			tenants: []string{"a"},
+			steps: []step{
+				{tenant: "a", listed: permissionResourceType.Id, ids: []string{"CompanyFetch"}, lastPage: true},
+				{grant: "CompanyFetch", permission: true},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			completed := 0
+			p := newSyncProgress(func(context.Context) { completed++ }, tc.tenants, listedTypes, roleResourceType.Id, permissionResourceType.Id)
+
+			for i, s := range tc.steps {
+				before := completed
+				if s.listed != "" {
+					p.resourcesListed(ctx, s.tenant, s.listed, s.ids, s.lastPage)
+				} else {
+					resourceType := roleResourceType.Id
+					if s.permission {
+						resourceType = permissionResourceType.Id
+					}
+					p.grantsListed(ctx, resourceType, s.grant)
+				}
+				if (completed > before) != s.complete {
+					t.Fatalf("Step %d: expected complete to be %v, got %v", i, s.complete, completed > before)
+				}
+			}
+
+			resumed := tc.resumed
+			if resumed == nil {
+				resumed = map[string]int{}
+			}
+			if !reflect.DeepEqual(p.resumed, resumed) {
+				t.Errorf("Expected resumed counts %v, got %v", resumed, p.resumed)
+			}
+		})
+	}
+}
+
+func TestValidate_SyncSummary(t *testing.T) {
+	ctx := context.Background()
+	d, err := New(ctx, Config{AccountID: 1}, WithAPI(newFakeAPI()))
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+	summaries := 0
+	d.progress.onComplete = func(context.Context) { summaries++ }
+
+	syncers := make(map[string]connectorbuilder.ResourceSyncer)
+	for _, syncer := range d.ResourceSyncers(ctx) {
+		syncers[syncer.ResourceType(ctx).Id] = syncer
+	}
+
+	// The fake API has roles but no permissions, and each sync starts with Validate.
+	for sync := 1; sync <= 2; sync++ {
+		_, err := d.Validate(ctx)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		var roles []*v2.Resource
+		for _, resourceType := range []string{userResourceType.Id, roleResourceType.Id, permissionResourceType.Id} {
+			resources, _, _, err := syncers[resourceType].List(ctx, nil, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if resourceType == roleResourceType.Id {
+				roles = resources
+			}
+		}
+		if len(roles) != 2 {
+			t.Fatalf("Expected 2 roles, got %d", len(roles))
+		}
+
+		for _, role := range roles {
+			if summaries != sync-1 {
+				t.Fatalf("Expected %d summaries before the grants of every role were listed, got %d", sync-1, summaries)
+			}
+			_, _, _, err := syncers[roleResourceType.Id].Grants(ctx, role, nil)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		}
+		if summaries != sync {
+			t.Errorf("Expected %d summaries after sync %d, got %d", sync, sync, summaries)
+		}
+	}
+}
+
+// probeAPI answers probes of the endpoints in failures with their result, and every other probe with OK.
+type probeAPI struct {
+	*fakeAPI
+	ping         avalaraclient.PingResponse
+	securityRole string
+	failures     map[string]*avalaraclient.ProbeResult
+	pingErr      error
+}
+
+func (p *probeAPI) Probe(ctx context.Context, endpoint string, result interface{}) (*avalaraclient.ProbeResult, error) {
+	if endpoint == "/api/v2/utilities/ping" && p.pingErr != nil {
+		return nil, p.pingErr
+	}
+	if failure, ok := p.failures[endpoint]; ok {
+		return failure, nil
+	}
+
+	switch result := result.(type) {
+	case *avalaraclient.PingResponse:
+		*result = p.ping
+	case *avalaraclient.UserModel:
+		result.SecurityRoleID = p.securityRole
+	case *avalaraclient.EntitlementResponse:
+		result.AccessLevel = accessLevelSingleAccount
+	}
+	return &avalaraclient.ProbeResult{StatusCode: http.StatusOK, CorrelationID: "correlation"}, nil
+}
+
+func TestDiagnose(t *testing.T) {
+	authenticated := avalaraclient.PingResponse{Authenticated: true, AuthenticatedAccountID: 1, AuthenticatedUserID: 10, AuthenticatedUserName: "admin"}
+
+	testCases := []struct {
+		name                   string
+		api                    *probeAPI
+		expectedChecks         string
+		expectedDetail         string
+		expectedRecommendation string
+	}{
+		{
+			name:                   "ping fails",
+			api:                    &probeAPI{pingErr: errors.New("connection refused")},
+			expectedChecks:         "ping=error",
+			expectedDetail:         "connection refused",
+			expectedRecommendation: "Check the username, password and environment",
+		},
+		{
+			name:                   "not authenticated",
+			api:                    &probeAPI{},
+			expectedChecks:         "ping=forbidden",
+			expectedDetail:         "the credentials were not authenticated",
+			expectedRecommendation: "Check the username, password and environment",
+		},
+		{
+			name:                   "account admin",
+			api:                    &probeAPI{ping: authenticated, securityRole: provisionSecurityRole},
+			expectedChecks:         "ping=OK users=OK accounts=OK user=OK roles=OK permissions=OK entitlements=OK companies=OK audit=OK",
+			expectedRecommendation: "The AccountAdmin security role can sync and provision role changes",
+		},
+		{
+			name: "forbidden audit log",
+			api: &probeAPI{
+				ping:         authenticated,
+				securityRole: syncSecurityRole,
+				failures: map[string]*avalaraclient.ProbeResult{
+					"/api/v2/accounts/1/auditevents": {StatusCode: http.StatusForbidden, CorrelationID: "denied"},
+				},
+			},
+			expectedChecks:         "ping=OK users=OK accounts=OK user=OK roles=OK permissions=OK entitlements=OK companies=OK audit=forbidden",
+			expectedDetail:         "Forbidden",
+			expectedRecommendation: "Assign the AccountAdmin security role to read audit events, which needs audit. The current security role can sync",
+		},
+		{
+			name: "forbidden entitlements",
+			api: &probeAPI{
+				ping:         authenticated,
+				securityRole: "CompanyUser",
+				failures: map[string]*avalaraclient.ProbeResult{
+					"/api/v2/users": {StatusCode: http.StatusForbidden},
+					"/api/v2/accounts/1/users/10/entitlements": {StatusCode: http.StatusForbidden},
+				},
+			},
+			expectedChecks:         "ping=OK users=forbidden accounts=OK user=OK roles=OK permissions=OK entitlements=forbidden companies=OK audit=OK",
+			expectedDetail:         "Forbidden",
+			expectedRecommendation: "Assign the AccountUser security role to sync, which needs users, entitlements",
+		},
+		{
+			name: "forbidden entitlements and audit log",
+			api: &probeAPI{
+				ping:         authenticated,
+				securityRole: "CompanyUser",
+				failures: map[string]*avalaraclient.ProbeResult{
+					"/api/v2/accounts/1/users/10/entitlements": {StatusCode: http.StatusForbidden},
+					"/api/v2/accounts/1/auditevents":           {StatusCode: http.StatusForbidden},
+				},
+			},
+			expectedChecks:         "ping=OK users=OK accounts=OK user=OK roles=OK permissions=OK entitlements=forbidden companies=OK audit=forbidden",
+			expectedDetail:         "Forbidden",
+			expectedRecommendation: "Assign the AccountUser security role to sync, which needs entitlements. Assign the AccountAdmin security role to read audit events, which needs audit",
+		},
+		{
+			name: "server error",
+			api: &probeAPI{
+				ping:         authenticated,
+				securityRole: syncSecurityRole,
+				failures: map[string]*avalaraclient.ProbeResult{
+					"/api/v2/companies": {
+						StatusCode: http.StatusInternalServerError,
+						Error:      &avalaraclient.AvalaraError{Code: "ServerError", Message: "boom"},
+					},
+				},
+			},
+			expectedChecks:         "ping=OK users=OK accounts=OK user=OK roles=OK permissions=OK entitlements=OK companies=error audit=OK",
+			expectedDetail:         "ServerError: boom",
+			expectedRecommendation: "Some endpoints failed for reasons other than permissions",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			tc.api.fakeAPI = newFakeAPI()
+			d, err := New(ctx, Config{}, WithAPI(tc.api))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+
+			diagnoses := d.Diagnose(ctx)
+			if len(diagnoses) != 1 {
+				t.Fatalf("Expected 1 diagnosis, got %d", len(diagnoses))
+			}
+			diagnosis := diagnoses[0]
+
+			var checks []string
+			var detail string
+			for _, check := range diagnosis.Checks {
+				checks = append(checks, check.Endpoint+"="+check.Result)
+				if check.Result != CheckOK {
+					detail = check.Detail
+				}
+			}
+			if strings.Join(checks, " ") != tc.expectedChecks {
+				t.Errorf("Expected checks %s, got %s", tc.expectedChecks, strings.Join(checks, " "))
+			}
+			if detail != tc.expectedDetail {
+				t.Errorf("Expected detail %q, got %q", tc.expectedDetail, detail)
+			}
+			if !strings.HasPrefix(diagnosis.Recommendation, tc.expectedRecommendation) {
+				t.Errorf("Expected recommendation %q, got %q", tc.expectedRecommendation, diagnosis.Recommendation)
+			}
+		})
+	}
+
+	// The home account and role found by a successful diagnosis are reported with it.
+	api := &probeAPI{fakeAPI: newFakeAPI(), ping: authenticated, securityRole: syncSecurityRole}
+	d, err := New(context.Background(), Config{}, WithAPI(api))
+	if err != nil {
+		t.Fatalf("Expected to create the connector, got %v", err)
+	}
+	diagnosis := d.Diagnose(context.Background())[0]
+	if diagnosis.AccountID != 1 || diagnosis.UserName != "admin" || diagnosis.SecurityRole != syncSecurityRole || diagnosis.AccessLevel != accessLevelSingleAccount {
+		t.Errorf("Unexpected diagnosis details: %+v", diagnosis)
+	}
+	if diagnosis.Checks[1].CorrelationID != "correlation" {
+		t.Errorf("Expected the correlation ID to be reported, got %q", diagnosis.Checks[1].CorrelationID)
+	}
+}
+
+// privilegeAPI authenticates as user 10 of account 1, and answers entitlement requests with entitlements or fails them with err.
+type privilegeAPI struct {
+	*fakeAPI
+	entitlements *avalaraclient.EntitlementResponse
+	err          error
+}
+
+func (p *privilegeAPI) Ping(ctx context.Context) (*avalaraclient.PingResponse, error) {
+	return &avalaraclient.PingResponse{Authenticated: true, AuthenticatedAccountID: 1, AuthenticatedUserID: 10}, nil
+}
+
+func (p *privilegeAPI) GetUserEntitlements(ctx context.Context, accountID, userID int) (*avalaraclient.EntitlementResponse, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.entitlements, nil
+}
+
+func TestTenant_CheckPrivilege(t *testing.T) {
+	testCases := []struct {
+		name             string
+		cfg              Config
+		userID           int
+		accessLevel      string
+		companies        []int
+		entitlementsErr  error
+		expectedErr      string
+		expectedRole     string
+		expectedWarnings []string
+	}{
+		{
+			name:             "unknown user",
+			cfg:              Config{AccountID: 1},
+			accessLevel:      accessLevelAllAccounts,
+			expectedWarnings: []string{"the authenticated user is unknown"},
+		},
+		{
+			name:             "unreadable entitlements",
+			cfg:              Config{AccountID: 1},
+			userID:           10,
+			entitlementsErr:  errors.New("forbidden"),
+			expectedWarnings: []string{"the entitlements of the authenticated user could not be read"},
+		},
+		{
+			name:             "unreadable security role",
+			cfg:              Config{AccountID: 1},
+			userID:           99,
+			accessLevel:      accessLevelAllAccounts,
+			expectedWarnings: []string{"the security role of the authenticated user could not be read"},
+		},
+		{
+			name:         "all accounts",
+			cfg:          Config{AccountID: 1, IncludeAccountIDs: []int{1, 2}},
+			userID:       10,
+			accessLevel:  accessLevelAllAccounts,
+			expectedRole: "AccountAdmin",
+		},
+		{
+			name:         "firm managed accounts",
+			cfg:          Config{AccountID: 1, IncludeAccountIDs: []int{1, 2}},
+			userID:       10,
+			accessLevel:  accessLevelFirmManagedAccounts,
+			expectedRole: "AccountAdmin",
+		},
+		{
+			name:         "single account",
+			cfg:          Config{AccountID: 1},
+			userID:       10,
+			accessLevel:  accessLevelSingleAccount,
+			expectedRole: "AccountAdmin",
+		},
+		{
+			name:             "single account with other accounts included",
+			cfg:              Config{AccountID: 1, IncludeAccountIDs: []int{1, 2}},
+			userID:           10,
+			accessLevel:      accessLevelSingleAccount,
+			expectedRole:     "AccountAdmin",
+			expectedWarnings: []string{"account 2 is included, but the credentials can only list users of account 1"},
+		},
+		{
+			name:        "single company without included companies",
+			cfg:         Config{AccountID: 1},
+			userID:      10,
+			accessLevel: accessLevelSingleCompany,
+			companies:   []int{100},
+			expectedErr: "can only list users of companies [100]",
+		},
+		{
+			name:         "single company with its companies included",
+			cfg:          Config{AccountID: 1, IncludeCompanyIDs: []int{100}},
+			userID:       10,
+			accessLevel:  accessLevelSingleCompany,
+			companies:    []int{100, 200},
+			expectedRole: "AccountAdmin",
+		},
+		{
+			name:        "single company with another company included",
+			cfg:         Config{AccountID: 1, IncludeCompanyIDs: []int{100, 300}},
+			userID:      10,
+			accessLevel: accessLevelSingleCompany,
+			companies:   []int{100, 200},
+			expectedErr: "cannot list users of company 300",
+		},
+		{
+			name:        "no access",
+			cfg:         Config{AccountID: 1},
+			userID:      10,
+			accessLevel: accessLevelNone,
+			expectedErr: "has no access to users",
+		},
+		{
+			name:             "unknown access level",
+			cfg:              Config{AccountID: 1},
+			userID:           10,
+			accessLevel:      "Reseller",
+			expectedRole:     "AccountAdmin",
+			expectedWarnings: []string{`unknown access level "Reseller"`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			api := &privilegeAPI{
+				fakeAPI:      newFakeAPI(),
+				entitlements: &avalaraclient.EntitlementResponse{AccessLevel: tc.accessLevel, Companies: tc.companies},
+				err:          tc.entitlementsErr,
+			}
+			d, err := New(ctx, tc.cfg, WithAPI(api))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+
+			ping := &avalaraclient.PingResponse{Authenticated: true, AuthenticatedAccountID: 1, AuthenticatedUserID: tc.userID}
+			p, err := d.tenants.tenants[0].checkPrivilege(ctx, ping)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("Expected an error containing %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if p.securityRole != tc.expectedRole {
+				t.Errorf("Expected security role %q, got %q", tc.expectedRole, p.securityRole)
+			}
+			if tc.entitlementsErr == nil && tc.userID != 0 && p.accessLevel != tc.accessLevel {
+				t.Errorf("Expected access level %q, got %q", tc.accessLevel, p.accessLevel)
+			}
+			if len(p.warnings) != len(tc.expectedWarnings) {
+				t.Fatalf("Expected warnings %v, got %v", tc.expectedWarnings, p.warnings)
+			}
+			for i, warning := range tc.expectedWarnings {
+				if !strings.HasPrefix(p.warnings[i], warning) {
+					t.Errorf("Expected warning %q, got %q", warning, p.warnings[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidate_Privilege(t *testing.T) {
+	testCases := []struct {
+		name             string
+		cfg              Config
+		accessLevel      string
+		expectedErr      bool
+		expectedWarnings int
+	}{
+		{name: "enough privilege", cfg: Config{}, accessLevel: accessLevelSingleAccount},
+		{name: "partial sync", cfg: Config{IncludeAccountIDs: []int{1, 2}}, accessLevel: accessLevelSingleAccount, expectedWarnings: 1},
+		{name: "no access", cfg: Config{}, accessLevel: accessLevelNone, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			api := &privilegeAPI{
+				fakeAPI:      newFakeAPI(),
+				entitlements: &avalaraclient.EntitlementResponse{AccessLevel: tc.accessLevel},
+			}
+			d, err := New(ctx, tc.cfg, WithAPI(api))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+
+			annos, err := d.Validate(ctx)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if len(annos) != 1 {
+				t.Fatalf("Expected 1 annotation, got %d", len(annos))
+			}
+			annotation := &structpb.Struct{}
+			if err := annos[0].UnmarshalTo(annotation); err != nil {
+				t.Fatalf("Expected a privilege annotation, got %v", err)
+			}
+			fields := annotation.AsMap()
+			if fields["accessLevel"] != tc.accessLevel || fields["securityRole"] != "AccountAdmin" {
+				t.Errorf("Expected access level %s and role AccountAdmin, got %v", tc.accessLevel, fields)
+			}
+			if warnings := fields["warnings"].([]interface{}); len(warnings) != tc.expectedWarnings {
+				t.Errorf("Expected %d warnings, got %v", tc.expectedWarnings, warnings)
+			}
+		})
+	}
+}
+
+// metadataAPI answers Ping and GetAccount with fixed responses, or fails them.
+type metadataAPI struct {
+	*fakeAPI
+	pingErr    error
+	accountErr error
+}
+
+func (m *metadataAPI) Ping(ctx context.Context) (*avalaraclient.PingResponse, error) {
+	if m.pingErr != nil {
+		return nil, m.pingErr
+	}
+	return &avalaraclient.PingResponse{Authenticated: true, Version: "24.6.0", AuthenticatedAccountID: 1}, nil
+}
+
+func (m *metadataAPI) GetAccount(ctx context.Context, accountID int) (*avalaraclient.AccountModel, error) {
+	if m.accountErr != nil {
+		return nil, m.accountErr
+	}
+	return &avalaraclient.AccountModel{ID: accountID, Name: fmt.Sprintf("Account %d", accountID)}, nil
+}
+
+func TestMetadata(t *testing.T) {
+	testCases := []struct {
+		name                string
+		cfg                 Config
+		api                 *metadataAPI
+		expectedTenants     []map[string]interface{}
+		expectedDescription string
+	}{
+		{
+			name: "account details",
+			cfg:  Config{Environment: "sandbox"},
+			api:  &metadataAPI{},
+			expectedTenants: []map[string]interface{}{
+				{"name": "default", "environment": "sandbox", "apiVersion": "24.6.0", "accountId": float64(1), "accountName": "Account 1"},
+			},
+			expectedDescription: "Syncs users, security roles and API permissions from Avalara (Account 1), along with the users that hold each role and permission. Security role membership can be provisioned.",
+		},
+		{
+			name: "unreachable API",
+			cfg:  Config{BaseURL: "http://localhost:8080", DryRun: true},
+			api:  &metadataAPI{pingErr: errors.New("connection refused")},
+			expectedTenants: []map[string]interface{}{
+				{"name": "default", "environment": "production", "baseUrl": "http://localhost:8080"},
+			},
+			expectedDescription: "Syncs users, security roles and API permissions from Avalara, along with the users that hold each role and permission. Security role membership can be provisioned, but provisioning requests are logged rather than sent.",
+		},
+		{
+			name: "unreadable account",
+			cfg:  Config{Tenants: []TenantConfig{{Name: "parent", Environment: "production", AccountID: 5}}},
+			api:  &metadataAPI{accountErr: errors.New("forbidden")},
+			expectedTenants: []map[string]interface{}{
+				{"name": "parent", "environment": "production", "apiVersion": "24.6.0", "accountId": float64(5)},
+			},
+			expectedDescription: "Syncs users, security roles and API permissions from Avalara, along with the users that hold each role and permission. Security role membership can be provisioned.",
+		},
+		{
+			name: "several tenants",
+			cfg:  Config{Tenants: []TenantConfig{{Name: "parent", AccountID: 1}, {Name: "subsidiary", AccountID: 2}}},
+			api:  &metadataAPI{},
+			expectedTenants: []map[string]interface{}{
+				{"name": "parent", "environment": "production", "apiVersion": "24.6.0", "accountId": float64(1), "accountName": "Account 1"},
+				{"name": "subsidiary", "environment": "production", "apiVersion": "24.6.0", "accountId": float64(2), "accountName": "Account 2"},
+			},
+			expectedDescription: "Syncs users, security roles and API permissions from Avalara (Account 1, Account 2), along with the users that hold each role and permission. Security role membership can be provisioned.",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			tc.api.fakeAPI = newFakeAPI()
+			d, err := New(ctx, tc.cfg, WithAPI(tc.api))
+			if err != nil {
+				t.Fatalf("Expected to create the connector, got %v", err)
+			}
+
+			metadata, err := d.Metadata(ctx)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if metadata.Description != tc.expectedDescription {
+				t.Errorf("Expected description %q, got %q", tc.expectedDescription, metadata.Description)
+			}
+
+			profile := metadata.Profile.AsMap()
+			schema, _ := profile["accountCreationSchema"].(map[string]interface{})
+			fieldMap, _ := schema["fieldMap"].(map[string]interface{})
+			for _, name := range []string{"userName", "email", "firstName", "lastName", "securityRoleId", "companyId"} {
+				if _, ok := fieldMap[name]; !ok {
+					t.Errorf("Expected the account creation schema to have field %s, got %v", name, fieldMap)
+				}
+			}
+			role, _ := fieldMap["securityRoleId"].(map[string]interface{})
+			expectedRole := map[string]interface{}{
+				"displayName": "Security role",
+				"description": "The security role the user is created with",
+				"required":    true,
+				"order":       float64(5),
+				"stringField": map[string]interface{}{"defaultValue": fallbackSecurityRole},
+			}
+			if !reflect.DeepEqual(role, expectedRole) {
+				t.Errorf("Expected the security role field %v, got %v", expectedRole, role)
+			}
+			tenants, _ := profile["tenants"].([]interface{})
+			if len(tenants) != len(tc.expectedTenants) {
+				t.Fatalf("Expected %d tenants, got %v", len(tc.expectedTenants), tenants)
+			}
+			for i, expected := range tc.expectedTenants {
+				if !reflect.DeepEqual(tenants[i], expected) {
+					t.Errorf("Expected tenant %v, got %v", expected, tenants[i])
+				}
+			}
+		})
+	}
+}
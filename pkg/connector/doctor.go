@@ -0,0 +1,200 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+)
+
+// Results of an endpoint check.
+const (
+	CheckOK        = "OK"
+	CheckForbidden = "forbidden"
+	CheckError     = "error"
+)
+
+const (
+	// syncSecurityRole is the least privileged security role that can read every user of an account.
+	syncSecurityRole = "AccountUser"
+	// provisionSecurityRole is the least privileged security role that can also change users' security roles.
+	provisionSecurityRole = "AccountAdmin"
+	// auditSecurityRole is the least privileged security role that can read an account's audit events.
+	auditSecurityRole = "AccountAdmin"
+)
+
+// endpointNeed is the least privileged security role that can use a probed endpoint, and what the connector uses it for.
+type endpointNeed struct {
+	role    string
+	purpose string
+}
+
+// endpointNeeds holds the need of every endpoint probed after the ping.
+var endpointNeeds = map[string]endpointNeed{
+	"users":        {syncSecurityRole, "sync"},
+	"accounts":     {syncSecurityRole, "sync"},
+	"user":         {syncSecurityRole, "sync"},
+	"roles":        {syncSecurityRole, "sync"},
+	"permissions":  {syncSecurityRole, "sync"},
+	"entitlements": {syncSecurityRole, "sync"},
+	"companies":    {syncSecurityRole, "sync"},
+	"audit":        {auditSecurityRole, "read audit events"},
+}
+
+// EndpointCheck is the result of probing one Avalara API endpoint the connector depends on.
+type EndpointCheck struct {
+	Endpoint      string
+	Path          string
+	Result        string
+	StatusCode    int
+	CorrelationID string
+	Detail        string
+}
+
+// Diagnosis describes what a tenant's credentials can access.
+type Diagnosis struct {
+	Tenant       string
+	AccountID    int
+	UserName     string
+	SecurityRole string
+	AccessLevel  string
+	Checks       []EndpointCheck
+	// Recommendation names the minimum security role the credentials need.
+	Recommendation string
+}
+
+// Diagnose pings the Avalara API with each tenant's credentials and probes every endpoint the connector uses.
+func (d *Avalara) Diagnose(ctx context.Context) []*Diagnosis {
+	rv := make([]*Diagnosis, 0, len(d.tenants.tenants))
+	for _, t := range d.tenants.tenants {
+		rv = append(rv, t.diagnose(ctx))
+	}
+	return rv
+}
+
+func (t *tenant) diagnose(ctx context.Context) *Diagnosis {
+	diagnosis := &Diagnosis{Tenant: t.name}
+
+	var ping avalaraclient.PingResponse
+	check := probeEndpoint(ctx, t.client, "ping", "/api/v2/utilities/ping", &ping)
+	if check.Result == CheckOK && !ping.Authenticated {
+		check.Result = CheckForbidden
+		check.Detail = "the credentials were not authenticated"
+	}
+	diagnosis.Checks = append(diagnosis.Checks, check)
+	if check.Result != CheckOK {
+		diagnosis.Recommendation = "Check the username, password and environment. No other endpoints were probed"
+		return diagnosis
+	}
+
+	t.discoverHomeAccount(ctx, &ping)
+	accountID := t.scope.homeAccount()
+	diagnosis.AccountID = accountID
+	diagnosis.UserName = ping.AuthenticatedUserName
+
+	var user avalaraclient.UserModel
+	var entitlements avalaraclient.EntitlementResponse
+	endpoints := []struct {
+		name   string
+		path   string
+		result interface{}
+	}{
+		{"users", "/api/v2/users", nil},
+		{"accounts", fmt.Sprintf("/api/v2/accounts/%d", accountID), nil},
+		{"user", fmt.Sprintf("/api/v2/accounts/%d/users/%d", accountID, ping.AuthenticatedUserID), &user},
+		{"roles", "/api/v2/definitions/securityroles", nil},
+		{"permissions", "/api/v2/definitions/permissions", nil},
+		{"entitlements", fmt.Sprintf("/api/v2/accounts/%d/users/%d/entitlements", accountID, ping.AuthenticatedUserID), &entitlements},
+		{"companies", "/api/v2/companies", nil},
+		{"audit", fmt.Sprintf("/api/v2/accounts/%d/auditevents", accountID), nil},
+	}
+	for _, endpoint := range endpoints {
+		diagnosis.Checks = append(diagnosis.Checks, probeEndpoint(ctx, t.client, endpoint.name, endpoint.path, endpoint.result))
+	}
+
+	diagnosis.SecurityRole = user.SecurityRoleID
+	diagnosis.AccessLevel = entitlements.AccessLevel
+	diagnosis.Recommendation = recommendSecurityRole(diagnosis)
+
+	return diagnosis
+}
+
+func probeEndpoint(ctx context.Context, client avalaraclient.AvalaraAPI, name, path string, result interface{}) EndpointCheck {
+	check := EndpointCheck{
+		Endpoint: name,
+		Path:     path,
+	}
+
+	probe, err := client.Probe(ctx, path, result)
+	if err != nil {
+		check.Result = CheckError
+		check.Detail = err.Error()
+		return check
+	}
+
+	check.StatusCode = probe.StatusCode
+	check.CorrelationID = probe.CorrelationID
+
+	switch {
+	case probe.StatusCode == http.StatusUnauthorized, probe.StatusCode == http.StatusForbidden:
+		check.Result = CheckForbidden
+	case probe.StatusCode < 200 || probe.StatusCode >= 300, probe.Error != nil:
+		check.Result = CheckError
+	default:
+		check.Result = CheckOK
+	}
+
+	if probe.Error != nil {
+		check.Detail = probe.Error.Code
+		if probe.Error.Message != "" {
+			check.Detail += ": " + probe.Error.Message
+		}
+	} else if check.Result != CheckOK {
+		check.Detail = http.StatusText(probe.StatusCode)
+	}
+
+	return check
+}
+
+// recommendSecurityRole names the security role needed for each use of the endpoints that
+// were forbidden, so that credentials are not granted more than those uses need.
+func recommendSecurityRole(diagnosis *Diagnosis) string {
+	var needs []endpointNeed
+	forbidden := make(map[endpointNeed][]string)
+	var failed bool
+	for _, check := range diagnosis.Checks {
+		switch check.Result {
+		case CheckForbidden:
+			need := endpointNeeds[check.Endpoint]
+			if _, ok := forbidden[need]; !ok {
+				needs = append(needs, need)
+			}
+			forbidden[need] = append(forbidden[need], check.Endpoint)
+		case CheckError:
+			failed = true
+		}
+	}
+
+	if len(needs) > 0 {
+		recommendations := make([]string, 0, len(needs)+1)
+		for _, need := range needs {
+			recommendations = append(recommendations, fmt.Sprintf("Assign the %s security role to %s, which needs %s",
+				need.role, need.purpose, strings.Join(forbidden[need], ", ")))
+		}
+		if _, ok := forbidden[endpointNeeds["users"]]; !ok {
+			recommendations = append(recommendations, "The current security role can sync")
+		}
+		return strings.Join(recommendations, ". ")
+	}
+
+	switch {
+	case failed:
+		return "Some endpoints failed for reasons other than permissions. Retry, and share the correlation IDs with Avalara support if they keep failing"
+	case diagnosis.SecurityRole == provisionSecurityRole:
+		return fmt.Sprintf("The %s security role can sync and provision role changes", provisionSecurityRole)
+	default:
+		return fmt.Sprintf("The current security role can sync. Assign %s to also provision role changes", provisionSecurityRole)
+	}
+}
@@ -0,0 +1,222 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultEntitlementConcurrency = 8
+	maxEntitlementRetries         = 5
+	initialRateLimitBackoff       = time.Second
+	maxRateLimitBackoff           = 30 * time.Second
+)
+
+// userEntitlementFetcher fetches per-user entitlements in parallel with a bounded number of workers.
+// When any worker is rate limited, every worker pauses until the shared backoff has elapsed.
+type userEntitlementFetcher struct {
+	client         avalaraclient.AvalaraAPI
+	scope          *syncScope
+	concurrency    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu         sync.Mutex
+	pauseUntil time.Time
+	backoff    time.Duration
+}
+
+func newUserEntitlementFetcher(client avalaraclient.AvalaraAPI, scope *syncScope, concurrency int) *userEntitlementFetcher {
+	if concurrency < 1 {
+		concurrency = defaultEntitlementConcurrency
+	}
+
+	return &userEntitlementFetcher{
+		client:         client,
+		scope:          scope,
+		concurrency:    concurrency,
+		initialBackoff: initialRateLimitBackoff,
+		maxBackoff:     maxRateLimitBackoff,
+	}
+}
+
+// fetch returns the entitlements of each user, keyed by user ID. Users that no longer exist,
+// such as ones deleted since they were listed, are logged and left out. Any other error
+// cancels the remaining fetches.
+func (f *userEntitlementFetcher) fetch(ctx context.Context, users []avalaraclient.UserModel) (map[int]*avalaraclient.EntitlementResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan avalaraclient.UserModel)
+	results := make(map[int]*avalaraclient.EntitlementResponse, len(users))
+
+	var (
+		wg       sync.WaitGroup
+		resultMu sync.Mutex
+		firstErr error
+	)
+
+	workers := f.concurrency
+	if workers > len(users) {
+		workers = len(users)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range jobs {
+				entitlements, err := f.fetchUser(ctx, &user)
+				if isNotFound(err) {
+					ctxzap.Extract(ctx).Warn(
+						"avalara-connector: skipping entitlements of a user that no longer exists",
+						zap.Int("user_id", user.ID),
+						zap.Error(err),
+					)
+					continue
+				}
+
+				resultMu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				} else {
+					results[user.ID] = entitlements
+				}
+				resultMu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, user := range users {
+		select {
+		case jobs <- user:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (f *userEntitlementFetcher) fetchUser(ctx context.Context, user *avalaraclient.UserModel) (*avalaraclient.EntitlementResponse, error) {
+	// Entitlements are nested under the user's account, which defaults to the home account when the API omits it.
+	accountID := user.AccountID
+	if accountID == 0 {
+		accountID = f.scope.homeAccount()
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := f.waitForBackoff(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		entitlements, err := f.client.GetUserEntitlements(ctx, accountID, user.ID)
+		if err == nil {
+			f.resetBackoff()
+			return entitlements, nil
+		}
+
+		if !isRateLimited(err) || attempt >= maxEntitlementRetries {
+			return nil, fmt.Errorf("avalara-connector: failed to get entitlements for user %d: %w", user.ID, err)
+		}
+
+		f.client.RecordRetry(ctx, "/api/v2/accounts/{id}/users/{id}/entitlements")
+		delay := f.increaseBackoff()
+		ctxzap.Extract(ctx).Debug(
+			"avalara-connector: rate limited fetching user entitlements, backing off",
+			zap.Int("user_id", user.ID),
+			zap.Duration("delay", delay),
+		)
+	}
+}
+
+// waitForBackoff blocks until the shared backoff has elapsed or the context is done.
+func (f *userEntitlementFetcher) waitForBackoff(ctx context.Context) error {
+	f.mu.Lock()
+	wait := time.Until(f.pauseUntil)
+	f.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// increaseBackoff doubles the shared backoff and pauses every worker for that long.
+func (f *userEntitlementFetcher) increaseBackoff() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.backoff == 0 {
+		f.backoff = f.initialBackoff
+	} else {
+		f.backoff = min(f.backoff*2, f.maxBackoff)
+	}
+
+	pauseUntil := time.Now().Add(f.backoff)
+	if pauseUntil.After(f.pauseUntil) {
+		f.pauseUntil = pauseUntil
+	}
+
+	return f.backoff
+}
+
+func (f *userEntitlementFetcher) resetBackoff() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.backoff = 0
+}
+
+// isRateLimited reports whether the API asked us to slow down. uhttp maps 429 and 503 responses to Unavailable.
+func isRateLimited(err error) bool {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return false
+	}
+
+	code := grpcErr.GRPCStatus().Code()
+	return code == codes.Unavailable || code == codes.ResourceExhausted
+}
+
+// isNotFound reports whether the API no longer has what was requested, which a retry cannot change.
+func isNotFound(err error) bool {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return false
+	}
+
+	return grpcErr.GRPCStatus().Code() == codes.NotFound
+}
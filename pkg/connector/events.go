@@ -0,0 +1,353 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-sdk/pkg/annotations"
+	"github.com/conductorone/baton-sdk/pkg/pagination"
+	"github.com/conductorone/baton-sdk/pkg/types/entitlement"
+	"github.com/conductorone/baton-sdk/pkg/types/grant"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// eventCursor is the position in a tenant's audit log that the next ListEvents call resumes from.
+type eventCursor struct {
+	Timestamp string `json:"timestamp"`
+	ID        int    `json:"id"`
+}
+
+// eventCursors holds the event cursor of each tenant by name.
+type eventCursors struct {
+	Tenants map[string]eventCursor `json:"tenants"`
+}
+
+// parseEventCursors decodes a stream cursor. Cursors saved before tenants were supported
+// hold a single position, which belongs to the default tenant.
+func parseEventCursors(value string) (*eventCursors, error) {
+	cursors := &eventCursors{}
+	err := json.Unmarshal([]byte(value), cursors)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: invalid event cursor: %w", err)
+	}
+	if cursors.Tenants != nil {
+		return cursors, nil
+	}
+
+	cursors.Tenants = make(map[string]eventCursor)
+	legacy := eventCursor{}
+	err = json.Unmarshal([]byte(value), &legacy)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: invalid event cursor: %w", err)
+	}
+	if legacy.Timestamp != "" {
+		cursors.Tenants[defaultTenantName] = legacy
+	}
+	return cursors, nil
+}
+
+// ListEvents returns events from the Avalara audit log of each tenant, oldest first within a tenant.
+// Logins become usage events and security role changes become grant and revoke events.
+func (d *Avalara) ListEvents(
+	ctx context.Context,
+	earliestEvent *timestamppb.Timestamp,
+	pToken *pagination.StreamToken,
+) ([]*v2.Event, *pagination.StreamState, annotations.Annotations, error) {
+	cursors := &eventCursors{Tenants: make(map[string]eventCursor)}
+	if pToken != nil && pToken.Cursor != "" {
+		var err error
+		cursors, err = parseEventCursors(pToken.Cursor)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	var size int
+	if pToken != nil {
+		size = pToken.Size
+	}
+
+	var rv []*v2.Event
+	hasMore := false
+	for _, t := range d.tenants.tenants {
+		// Tenants without a cursor, including ones added since the last call, start at the earliest event.
+		cursor, ok := cursors.Tenants[t.name]
+		if !ok && earliestEvent != nil {
+			cursor.Timestamp = earliestEvent.AsTime().UTC().Format(avalaraclient.AvalaraTimeLayout)
+		}
+
+		events, next, more, err := d.listTenantEvents(ctx, t, cursor, size)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		rv = append(rv, events...)
+		if next.Timestamp != "" {
+			cursors.Tenants[t.name] = next
+		}
+		hasMore = hasMore || more
+	}
+
+	cursorBytes, err := json.Marshal(cursors)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("avalara-connector: failed to encode event cursor: %w", err)
+	}
+
+	streamState := &pagination.StreamState{
+		Cursor:  string(cursorBytes),
+		HasMore: hasMore,
+	}
+
+	return rv, streamState, nil, nil
+}
+
+// listTenantEvents returns a page of a tenant's audit log after cursor, the cursor to resume from and whether more events remain.
+func (d *Avalara) listTenantEvents(ctx context.Context, t *tenant, cursor eventCursor, size int) ([]*v2.Event, eventCursor, bool, error) {
+	accountID, err := t.homeAccountID(ctx)
+	if err != nil {
+		return nil, cursor, false, err
+	}
+
+	// The audit log belongs to the home account, so there is nothing to report when it is out of scope.
+	if !t.scope.includesAccount(accountID) {
+		return nil, cursor, false, nil
+	}
+
+	options := &avalaraclient.PaginationOptions{
+		OrderBy: "timestamp ASC, id ASC",
+		Top:     size,
+	}
+	if cursor.Timestamp != "" {
+		// Events sharing the cursor's timestamp are only skipped up to the last ID already returned.
+		timestamp := odataString(cursor.Timestamp)
+		options.Filter = fmt.Sprintf("timestamp gt %s or (timestamp eq %s and id gt %d)", timestamp, timestamp, cursor.ID)
+	}
+
+	auditEvents, nextOptions, err := t.client.GetAuditEvents(ctx, accountID, options)
+	if err != nil {
+		return nil, cursor, false, fmt.Errorf("avalara-connector: failed to list audit events for tenant %s: %w", t.name, err)
+	}
+
+	roleIDs, err := t.roles.get(ctx, t)
+	if err != nil {
+		return nil, cursor, false, err
+	}
+
+	var rv []*v2.Event
+	refreshed := false
+	for _, auditEvent := range auditEvents.Value {
+		events, err := auditEventToEvents(t, &auditEvent, roleIDs)
+		if errors.Is(err, errUnknownRole) && !refreshed {
+			// The role may have been created since the roles were listed.
+			refreshed = true
+			roleIDs, err = t.roles.refresh(ctx, t)
+			if err != nil {
+				return nil, cursor, false, err
+			}
+			events, err = auditEventToEvents(t, &auditEvent, roleIDs)
+		}
+		if err != nil {
+			// Events for a role that is still unknown, such as one deleted since, are skipped like
+			// any other event that cannot be reported, so the cursor moves past them.
+			ctxzap.Extract(ctx).Warn(
+				"avalara-connector: skipping audit event",
+				zap.String("tenant", t.name),
+				zap.Int("id", auditEvent.ID),
+				zap.Error(err),
+			)
+		}
+		rv = append(rv, events...)
+
+		cursor = eventCursor{Timestamp: auditEvent.Timestamp, ID: auditEvent.ID}
+	}
+
+	return rv, cursor, nextOptions != nil && nextOptions.PageToken != "", nil
+}
+
+// errUnknownRole is returned for audit events that refer to a security role the tenant did not list.
+var errUnknownRole = errors.New("unknown security role")
+
+// roleIndex caches the role resource IDs of a tenant by security role name, which is how audit
+// events refer to roles. It is filled on first use and cleared when a sync lists the roles again.
+type roleIndex struct {
+	mu      sync.Mutex
+	roleIDs map[string]string
+}
+
+// get returns the cached role IDs, listing the roles if they have not been listed since the last reset.
+func (r *roleIndex) get(ctx context.Context, t *tenant) (map[string]string, error) {
+	r.mu.Lock()
+	roleIDs := r.roleIDs
+	r.mu.Unlock()
+	if roleIDs != nil {
+		return roleIDs, nil
+	}
+	return r.refresh(ctx, t)
+}
+
+// refresh lists the roles again and caches them.
+func (r *roleIndex) refresh(ctx context.Context, t *tenant) (map[string]string, error) {
+	roleIDs, err := roleIDsByDescription(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.roleIDs = roleIDs
+	r.mu.Unlock()
+	return roleIDs, nil
+}
+
+// reset drops the cached role IDs.
+func (r *roleIndex) reset() {
+	r.mu.Lock()
+	r.roleIDs = nil
+	r.mu.Unlock()
+}
+
+// roleIDsByDescription maps security role names, which audit events refer to, onto role resource IDs.
+func roleIDsByDescription(ctx context.Context, t *tenant) (map[string]string, error) {
+	roleIDs := make(map[string]string)
+	options := &avalaraclient.PaginationOptions{}
+
+	for {
+		roles, nextOptions, err := t.client.GetUserRoles(ctx, options)
+		if err != nil {
+			return nil, fmt.Errorf("avalara-connector: failed to list roles: %w", err)
+		}
+
+		for _, role := range roles.Value {
+			roleIDs[role.Description] = t.resourceID(strconv.Itoa(role.ID))
+		}
+
+		if nextOptions == nil || nextOptions.PageToken == "" {
+			return roleIDs, nil
+		}
+		options = &avalaraclient.PaginationOptions{PageToken: nextOptions.PageToken}
+	}
+}
+
+func auditEventToEvents(t *tenant, auditEvent *avalaraclient.AuditEventModel, roleIDs map[string]string) ([]*v2.Event, error) {
+	occurredAt, err := parseAuditTimestamp(auditEvent.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	actor := eventUserResource(t, auditEvent.UserID, auditEvent.UserName)
+	target := eventUserResource(t, auditEvent.TargetUserID, auditEvent.TargetUserName)
+	id := strconv.Itoa(auditEvent.ID)
+
+	var grantedRole, revokedRole string
+	switch auditEvent.EventType {
+	case avalaraclient.AuditEventUserLogin:
+		return []*v2.Event{
+			{
+				Id:         id,
+				OccurredAt: occurredAt,
+				Event: &v2.Event_UsageEvent{
+					UsageEvent: &v2.UsageEvent{
+						TargetResource: actor,
+						ActorResource:  actor,
+					},
+				},
+			},
+		}, nil
+	case avalaraclient.AuditEventUserCreated:
+		grantedRole = auditEvent.SecurityRoleID
+	case avalaraclient.AuditEventUserDeleted:
+		revokedRole = auditEvent.SecurityRoleID
+		if revokedRole == "" {
+			revokedRole = auditEvent.PreviousSecurityRoleID
+		}
+	case avalaraclient.AuditEventUserUpdated, avalaraclient.AuditEventSecurityRoleChanged:
+		if auditEvent.PreviousSecurityRoleID == auditEvent.SecurityRoleID {
+			return nil, nil
+		}
+		grantedRole = auditEvent.SecurityRoleID
+		revokedRole = auditEvent.PreviousSecurityRoleID
+	default:
+		return nil, nil
+	}
+
+	var rv []*v2.Event
+	if revokedRole != "" {
+		role, err := eventRoleResource(t, revokedRole, roleIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, &v2.Event{
+			Id:         id + ":revoke",
+			OccurredAt: occurredAt,
+			Event: &v2.Event_RevokeEvent{
+				RevokeEvent: &v2.RevokeEvent{
+					Entitlement: entitlement.NewAssignmentEntitlement(role, RoleMemberEntitlement, entitlement.WithGrantableTo(userResourceType)),
+					Principal:   target,
+				},
+			},
+		})
+	}
+
+	if grantedRole != "" {
+		role, err := eventRoleResource(t, grantedRole, roleIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, &v2.Event{
+			Id:         id + ":grant",
+			OccurredAt: occurredAt,
+			Event: &v2.Event_GrantEvent{
+				GrantEvent: &v2.GrantEvent{
+					Grant: grant.NewGrant(role, RoleMemberEntitlement, target.Id),
+				},
+			},
+		})
+	}
+
+	return rv, nil
+}
+
+func parseAuditTimestamp(timestamp string) (*timestamppb.Timestamp, error) {
+	t, err := parseAvalaraTime(timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit event timestamp: %w", err)
+	}
+
+	return timestamppb.New(t), nil
+}
+
+func eventUserResource(t *tenant, userID int, userName string) *v2.Resource {
+	return &v2.Resource{
+		Id: &v2.ResourceId{
+			ResourceType: userResourceType.Id,
+			Resource:     t.resourceID(strconv.Itoa(userID)),
+		},
+		ParentResourceId: t.accountResourceID(),
+		DisplayName:      userName,
+	}
+}
+
+func eventRoleResource(t *tenant, description string, roleIDs map[string]string) (*v2.Resource, error) {
+	roleID, ok := roleIDs[description]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownRole, description)
+	}
+
+	return &v2.Resource{
+		Id: &v2.ResourceId{
+			ResourceType: roleResourceType.Id,
+			Resource:     roleID,
+		},
+		ParentResourceId: t.accountResourceID(),
+		DisplayName:      description,
+	}, nil
+}
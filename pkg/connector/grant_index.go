@@ -0,0 +1,131 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	"github.com/conductorone/baton-sdk/pkg/pagination"
+)
+
+// grantIndex holds the IDs of a tenant's users in scope by security role and by permission.
+// The users are listed once per sync for the grants of every role, and their entitlements are
+// fetched once per sync for the grants of every permission, rather than once for each of them.
+type grantIndex struct {
+	mu sync.Mutex
+	// users is nil until the users have been listed since the last reset.
+	users       []avalaraclient.UserModel
+	roleMembers map[string][]int
+	// permissionHolders is nil until the entitlements have been fetched since the last reset.
+	permissionHolders map[string][]int
+}
+
+// reset drops the index, so the next sync lists the users and fetches their entitlements again.
+func (g *grantIndex) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.users = nil
+	g.roleMembers = nil
+	g.permissionHolders = nil
+}
+
+// membersOf returns the IDs of the users holding a security role.
+func (g *grantIndex) membersOf(ctx context.Context, t *tenant, role string) ([]int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err := g.listUsers(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	return g.roleMembers[role], nil
+}
+
+// holdersOf returns the IDs of the users holding a permission.
+func (g *grantIndex) holdersOf(ctx context.Context, t *tenant, permission string) ([]int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err := g.listUsers(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.permissionHolders == nil {
+		entitlements, err := t.entitlementFetcher.fetch(ctx, g.users)
+		if err != nil {
+			return nil, err
+		}
+
+		holders := make(map[string][]int)
+		for _, user := range g.users {
+			if userEntitlements, ok := entitlements[user.ID]; ok {
+				for _, p := range userEntitlements.Permissions {
+					holders[p] = append(holders[p], user.ID)
+				}
+			}
+		}
+		g.permissionHolders = holders
+	}
+	return g.permissionHolders[permission], nil
+}
+
+// listUsers lists the tenant's users in scope unless they were listed since the last reset. It must be called with the lock held.
+func (g *grantIndex) listUsers(ctx context.Context, t *tenant) error {
+	if g.users != nil {
+		return nil
+	}
+
+	users := []avalaraclient.UserModel{}
+	members := make(map[string][]int)
+	options := &avalaraclient.PaginationOptions{
+		Filter: t.scope.userFilter(),
+	}
+
+	for {
+		resp, nextOptions, err := t.client.GetUsers(ctx, options)
+		if err != nil {
+			return fmt.Errorf("avalara-connector: failed to list users: %w", err)
+		}
+
+		for _, user := range resp.Value {
+			if t.scope.includesUser(&user) {
+				users = append(users, user)
+				members[user.SecurityRoleID] = append(members[user.SecurityRoleID], user.ID)
+			}
+		}
+
+		if nextOptions == nil || nextOptions.PageToken == "" {
+			break
+		}
+		options = &avalaraclient.PaginationOptions{PageToken: nextOptions.PageToken}
+	}
+
+	g.users = users
+	g.roleMembers = members
+	return nil
+}
+
+// pageOfUserIDs returns the page of userIDs a grants page token starts at, and the token of the next page.
+func pageOfUserIDs(userIDs []int, pToken *pagination.Token) ([]int, string, error) {
+	offset := 0
+	if pToken != nil && pToken.Token != "" {
+		var err error
+		offset, err = strconv.Atoi(strings.TrimPrefix(pToken.Token, cachedUsersTokenPrefix))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid page token: %w", err)
+		}
+	}
+	offset = min(offset, len(userIDs))
+	end := min(offset+avalaraclient.DefaultPageSize, len(userIDs))
+
+	var nextPageToken string
+	if end < len(userIDs) {
+		nextPageToken = cachedUsersTokenPrefix + strconv.Itoa(end)
+	}
+	return userIDs[offset:end], nextPageToken, nil
+}
@@ -1,8 +1,14 @@
 package connector
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 	"github.com/conductorone/baton-sdk/pkg/annotations"
+	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
 )
 
 func annotationsForUserResourceType() annotations.Annotations {
@@ -10,3 +16,46 @@ func annotationsForUserResourceType() annotations.Annotations {
 	annos.Update(&v2.SkipEntitlementsAndGrants{})
 	return annos
 }
+
+// annotationsForAccountResourceType marks accounts as having no entitlements or grants of their own,
+// since they only group the resources of a tenant.
+func annotationsForAccountResourceType() annotations.Annotations {
+	annos := annotations.Annotations{}
+	annos.Update(&v2.SkipEntitlementsAndGrants{})
+	return annos
+}
+
+// accountIDFromUserResource reads the Avalara account ID from a user resource's profile.
+func accountIDFromUserResource(user *v2.Resource) (int, error) {
+	userTrait, err := rs.GetUserTrait(user)
+	if err != nil {
+		return 0, fmt.Errorf("avalara-connector: failed to get user trait: %w", err)
+	}
+
+	accountID, ok := rs.GetProfileInt64Value(userTrait.Profile, "accountId")
+	if !ok {
+		return 0, fmt.Errorf("avalara-connector: failed to get account id from user profile")
+	}
+
+	return int(accountID), nil
+}
+
+// parseAvalaraTime parses an AvaTax date, with or without a zone offset.
+func parseAvalaraTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.Parse(avalaraclient.AvalaraTimeLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: %w", value, err)
+	}
+
+	return t, nil
+}
+
+// odataString quotes a value for use as a string literal in an OData $filter.
+func odataString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,119 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+// accountCreationField describes a field needed to create an Avalara user.
+type accountCreationField struct {
+	name         string
+	displayName  string
+	description  string
+	placeholder  string
+	required     bool
+	defaultValue string
+}
+
+// accountCreationFields are the fields needed to create an Avalara user, in the order they are shown.
+var accountCreationFields = []accountCreationField{
+	{name: "userName", displayName: "Username", description: "The name the user signs in with", placeholder: "jdoe", required: true},
+	{name: "email", displayName: "Email", description: "The email address invitations and password resets are sent to", placeholder: "jdoe@example.com", required: true},
+	{name: "firstName", displayName: "First name", required: true},
+	{name: "lastName", displayName: "Last name", required: true},
+	{
+		name:         "securityRoleId",
+		displayName:  "Security role",
+		description:  "The security role the user is created with",
+		required:     true,
+		defaultValue: fallbackSecurityRole,
+	},
+	{
+		name:        "companyId",
+		displayName: "Company",
+		description: "The ID of the company the user is limited to. Users without a company can access the whole account",
+	},
+}
+
+// accountCreationSchema describes the fields needed to create an Avalara user. The baton-sdk
+// release this connector is built with has no AccountCreationSchema in its connector metadata,
+// so the schema is published in the metadata profile instead, in the JSON form of the SDK's
+// ConnectorAccountCreationSchema so that it can move there unchanged once the SDK is upgraded.
+func accountCreationSchema() map[string]interface{} {
+	fieldMap := make(map[string]interface{}, len(accountCreationFields))
+	for i, f := range accountCreationFields {
+		stringField := map[string]interface{}{}
+		if f.defaultValue != "" {
+			stringField["defaultValue"] = f.defaultValue
+		}
+		field := map[string]interface{}{
+			"displayName": f.displayName,
+			"required":    f.required,
+			"order":       i + 1,
+			"stringField": stringField,
+		}
+		if f.description != "" {
+			field["description"] = f.description
+		}
+		if f.placeholder != "" {
+			field["placeholder"] = f.placeholder
+		}
+		fieldMap[f.name] = field
+	}
+	return map[string]interface{}{"fieldMap": fieldMap}
+}
+
+// metadata describes a tenant's account, environment and API version. Details that cannot be looked
+// up are left out, so that metadata is still returned when the API is unreachable.
+func (t *tenant) metadata(ctx context.Context) map[string]interface{} {
+	l := ctxzap.Extract(ctx)
+	details := map[string]interface{}{
+		"name":        t.name,
+		"environment": t.environment,
+	}
+	if t.baseURL != "" {
+		details["baseUrl"] = t.baseURL
+	}
+
+	ping, err := t.client.Ping(ctx)
+	if err != nil {
+		l.Warn("avalara-connector: failed to ping for metadata", zap.String("tenant", t.name), zap.Error(err))
+		return details
+	}
+	t.discoverHomeAccount(ctx, ping)
+	details["apiVersion"] = ping.Version
+
+	accountID := t.scope.homeAccount()
+	if accountID == 0 {
+		return details
+	}
+	details["accountId"] = accountID
+
+	account, err := t.client.GetAccount(ctx, accountID)
+	if err != nil {
+		l.Warn("avalara-connector: failed to get account for metadata", zap.String("tenant", t.name), zap.Error(err))
+		return details
+	}
+	details["accountName"] = account.Name
+
+	return details
+}
+
+// description summarizes what the connector syncs and provisions.
+func (d *Avalara) description(accountNames []string) string {
+	var b strings.Builder
+	b.WriteString("Syncs users, security roles and API permissions from Avalara")
+	if len(accountNames) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(accountNames, ", "))
+	}
+	b.WriteString(", along with the users that hold each role and permission. Security role membership can be provisioned")
+	if d.dryRun {
+		b.WriteString(", but provisioning requests are logged rather than sent")
+	}
+	b.WriteString(".")
+	return b.String()
+}
@@ -0,0 +1,72 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	"github.com/conductorone/baton-sdk/pkg/uhttp"
+)
+
+// Option customizes how the connector reaches the Avalara API.
+type Option func(*options)
+
+type options struct {
+	roundTripper http.RoundTripper
+	api          avalaraclient.AvalaraAPI
+}
+
+// WithRoundTripper sends the requests of every tenant through roundTripper, in place of the
+// transport built from the proxy and TLS settings.
+func WithRoundTripper(roundTripper http.RoundTripper) Option {
+	return func(o *options) {
+		o.roundTripper = roundTripper
+	}
+}
+
+// WithAPI syncs every tenant through api rather than an Avalara API client. The client
+// settings in Config, such as the page size and dry run, are not applied to it.
+func WithAPI(api avalaraclient.AvalaraAPI) Option {
+	return func(o *options) {
+		o.api = api
+	}
+}
+
+// newAPI creates the API a tenant is synced through.
+func (o *options) newAPI(ctx context.Context, tc TenantConfig, cfg *Config) (avalaraclient.AvalaraAPI, error) {
+	if o.api != nil {
+		return o.api, nil
+	}
+
+	environment := tc.Environment
+	if tc.BaseURL != "" {
+		environment = strings.TrimSuffix(tc.BaseURL, "/")
+	}
+
+	var client *avalaraclient.AvalaraClient
+	if o.roundTripper != nil {
+		client = avalaraclient.NewAvalaraClient(environment, uhttp.NewBaseHttpClient(&http.Client{Transport: o.roundTripper}))
+		client.AddCredentials(tc.Username, tc.Password)
+	} else {
+		var err error
+		client, err = avalaraclient.GetAvalaraClientWithTransport(ctx, environment, tc.Username, tc.Password, avalaraclient.TransportConfig{
+			ProxyURL:       cfg.ProxyURL,
+			CABundlePath:   cfg.CABundlePath,
+			ClientCertPath: cfg.ClientCertPath,
+			ClientKeyPath:  cfg.ClientKeyPath,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client.SetDryRun(cfg.DryRun)
+	client.SetPageSize(cfg.PageSize, cfg.AdaptivePageSize)
+	client.SetAllowedHosts(cfg.AllowedHosts)
+	if cfg.MetricsHandler != nil {
+		client.SetMetricsHandler(cfg.MetricsHandler.WithTags(map[string]string{"tenant": tc.Name}))
+	}
+
+	return client, nil
+}
@@ -0,0 +1,138 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-sdk/pkg/annotations"
+	"github.com/conductorone/baton-sdk/pkg/pagination"
+	"github.com/conductorone/baton-sdk/pkg/types/entitlement"
+	"github.com/conductorone/baton-sdk/pkg/types/grant"
+	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
+)
+
+const PermissionAssignedEntitlement = "assigned"
+
+type permissionBuilder struct {
+	resourceType *v2.ResourceType
+	tenants      *tenantSet
+	progress     *syncProgress
+}
+
+func (p *permissionBuilder) ResourceType(ctx context.Context) *v2.ResourceType {
+	return p.resourceType
+}
+
+// List returns all the permissions of a tenant's account from the Avalara API as resource objects.
+func (p *permissionBuilder) List(
+	ctx context.Context,
+	parentResourceID *v2.ResourceId,
+	pToken *pagination.Token,
+) ([]*v2.Resource, string, annotations.Annotations, error) {
+	t, ok := p.tenants.forParent(parentResourceID)
+	if !ok {
+		return nil, "", nil, nil
+	}
+
+	var rv []*v2.Resource
+
+	options := &avalaraclient.PaginationOptions{}
+
+	if pToken != nil && pToken.Token != "" {
+		options.PageToken = pToken.Token
+	} else {
+		// Permissions are listed before any of their grants, so entitlements from the previous sync are dropped here.
+		t.grants.reset()
+	}
+
+	permissions, nextOptions, err := t.client.GetPermissions(ctx, options)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("avalara-connector: failed to list permissions: %w", err)
+	}
+
+	for _, permission := range permissions.Value {
+		resource, err := rs.NewResource(
+			permission,
+			permissionResourceType,
+			t.resourceID(permission),
+			rs.WithParentResourceID(t.accountResourceID()),
+		)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("avalara-connector: failed to create permission resource: %w", err)
+		}
+
+		rv = append(rv, resource)
+	}
+
+	var nextPageToken string
+	if nextOptions != nil && nextOptions.PageToken != "" {
+		nextPageToken = nextOptions.PageToken
+	}
+
+	p.progress.resourcesListed(ctx, t.name, p.resourceType.Id, resourceIDs(rv), nextPageToken == "")
+	return rv, nextPageToken, nil, nil
+}
+
+func (p *permissionBuilder) Entitlements(
+	_ context.Context,
+	resource *v2.Resource,
+	_ *pagination.Token,
+) ([]*v2.Entitlement, string, annotations.Annotations, error) {
+	entitlementOptions := []entitlement.EntitlementOption{
+		entitlement.WithGrantableTo(userResourceType),
+		entitlement.WithDisplayName(fmt.Sprintf("%s Permission", resource.DisplayName)),
+		entitlement.WithDescription(fmt.Sprintf("Avalara %s permission", resource.DisplayName)),
+	}
+
+	return []*v2.Entitlement{
+		entitlement.NewPermissionEntitlement(resource, PermissionAssignedEntitlement, entitlementOptions...),
+	}, "", nil, nil
+}
+
+// Grants returns the users that hold a permission. The users' entitlements are fetched in
+// parallel the first time any permission needs them in a sync, and later permissions reuse
+// them, so each user's entitlements are requested once per sync.
+func (p *permissionBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken *pagination.Token) ([]*v2.Grant, string, annotations.Annotations, error) {
+	var rv []*v2.Grant
+
+	t, permission, err := p.tenants.forResource(resource.Id)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	holders, err := t.grants.holdersOf(ctx, t, permission)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	page, nextPageToken, err := pageOfUserIDs(holders, pToken)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	for _, id := range page {
+		userID, err := rs.NewResourceID(userResourceType, t.resourceID(strconv.Itoa(id)))
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("avalara-connector: failed to create user resource id: %w", err)
+		}
+
+		rv = append(rv, grant.NewGrant(resource, PermissionAssignedEntitlement, userID))
+	}
+
+	if nextPageToken == "" {
+		p.progress.grantsListed(ctx, p.resourceType.Id, resource.Id.Resource)
+	}
+
+	return rv, nextPageToken, nil, nil
+}
+
+func newPermissionBuilder(tenants *tenantSet, progress *syncProgress) *permissionBuilder {
+	return &permissionBuilder{
+		resourceType: permissionResourceType,
+		tenants:      tenants,
+		progress:     progress,
+	}
+}
@@ -0,0 +1,119 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Access levels reported by the entitlements of an Avalara user.
+const (
+	accessLevelNone                = "None"
+	accessLevelSingleCompany       = "SingleCompany"
+	accessLevelSingleAccount       = "SingleAccount"
+	accessLevelFirmManagedAccounts = "FirmManagedAccounts"
+	accessLevelAllAccounts         = "AllAccounts"
+)
+
+// privilege is the access the credentials of a tenant sync with.
+type privilege struct {
+	securityRole string
+	accessLevel  string
+	companies    []int
+	// warnings describe data the sync will miss, or checks that could not be made.
+	warnings []string
+}
+
+// checkPrivilege looks up the security role and entitlements of the authenticated user, and fails
+// when they cannot list the users in scope. Gaps that leave the sync partial are reported as warnings.
+func (t *tenant) checkPrivilege(ctx context.Context, ping *avalaraclient.PingResponse) (*privilege, error) {
+	p := &privilege{}
+
+	accountID := t.scope.homeAccount()
+	if ping.AuthenticatedUserID == 0 || accountID == 0 {
+		p.warnings = append(p.warnings, "the authenticated user is unknown, so its privilege was not checked")
+		return p, nil
+	}
+
+	entitlements, err := t.client.GetUserEntitlements(ctx, accountID, ping.AuthenticatedUserID)
+	if err != nil {
+		p.warnings = append(p.warnings, fmt.Sprintf("the entitlements of the authenticated user could not be read: %v", err))
+		return p, nil
+	}
+	p.accessLevel = entitlements.AccessLevel
+	p.companies = entitlements.Companies
+
+	user, err := t.client.GetUser(ctx, accountID, ping.AuthenticatedUserID)
+	if err != nil {
+		p.warnings = append(p.warnings, fmt.Sprintf("the security role of the authenticated user could not be read: %v", err))
+	} else {
+		p.securityRole = user.SecurityRoleID
+	}
+
+	switch p.accessLevel {
+	case accessLevelAllAccounts, accessLevelFirmManagedAccounts:
+	case accessLevelSingleAccount:
+		for _, includedAccountID := range t.scope.includeAccountIDs {
+			if includedAccountID != accountID {
+				p.warnings = append(p.warnings, fmt.Sprintf("account %d is included, but the credentials can only list users of account %d", includedAccountID, accountID))
+			}
+		}
+	case accessLevelSingleCompany:
+		// A company-level credential is only enough when the sync is limited to the companies it can see.
+		if len(t.scope.includeCompanyIDs) == 0 {
+			return nil, fmt.Errorf(
+				"avalara-connector: tenant %s can only list users of companies %v, assign the %s security role or set include-company-ids",
+				t.name, p.companies, syncSecurityRole,
+			)
+		}
+		for _, companyID := range t.scope.includeCompanyIDs {
+			if !slices.Contains(p.companies, companyID) {
+				return nil, fmt.Errorf("avalara-connector: tenant %s cannot list users of company %d", t.name, companyID)
+			}
+		}
+	case accessLevelNone:
+		return nil, fmt.Errorf("avalara-connector: tenant %s has no access to users, assign the %s security role", t.name, syncSecurityRole)
+	default:
+		p.warnings = append(p.warnings, fmt.Sprintf("unknown access level %q", p.accessLevel))
+	}
+
+	return p, nil
+}
+
+// log reports the privilege of a tenant's credentials.
+func (p *privilege) log(ctx context.Context, t *tenant) {
+	l := ctxzap.Extract(ctx)
+	l.Info(
+		"avalara-connector: syncing with access level",
+		zap.String("tenant", t.name),
+		zap.String("access_level", p.accessLevel),
+		zap.String("security_role", p.securityRole),
+	)
+	for _, warning := range p.warnings {
+		l.Warn("avalara-connector: sync may be partial", zap.String("tenant", t.name), zap.String("warning", warning))
+	}
+}
+
+// annotation describes the privilege of a tenant's credentials in the Validate response.
+func (p *privilege) annotation(t *tenant) (*structpb.Struct, error) {
+	warnings := make([]interface{}, 0, len(p.warnings))
+	for _, warning := range p.warnings {
+		warnings = append(warnings, warning)
+	}
+
+	annotation, err := structpb.NewStruct(map[string]interface{}{
+		"tenant":       t.name,
+		"accessLevel":  p.accessLevel,
+		"securityRole": p.securityRole,
+		"warnings":     warnings,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to create privilege annotation: %w", err)
+	}
+	return annotation, nil
+}
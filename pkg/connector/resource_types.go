@@ -4,6 +4,14 @@ import (
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 )
 
+// The account resource type is the parent of the resources synced with one tenant's credentials.
+var accountResourceType = &v2.ResourceType{
+	Id:          "account",
+	DisplayName: "Account",
+	Description: "Represents an Avalara account and the credentials it is synced with",
+	Annotations: annotationsForAccountResourceType(),
+}
+
 // The user resource type is for all user objects from the database.
 var userResourceType = &v2.ResourceType{
 	Id:          "user",
@@ -18,3 +26,9 @@ var roleResourceType = &v2.ResourceType{
 	Description: "Represents an Avalara security role",
 	Traits:      []v2.ResourceType_Trait{v2.ResourceType_TRAIT_ROLE},
 }
+
+var permissionResourceType = &v2.ResourceType{
+	Id:          "permission",
+	DisplayName: "Permission",
+	Description: "Represents an Avalara API permission",
+}
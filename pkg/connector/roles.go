@@ -18,34 +18,46 @@ const (
 	RoleMemberEntitlement = "member"
 	RoleType              = "role"
 	EntitlementType       = "entitlement"
+
+	// Avalara requires every user to hold exactly one security role, so revoking a
+	// role falls back to the least privileged one.
+	fallbackSecurityRole = "CompanyUser"
 )
 
 type roleBuilder struct {
-	client       *avalaraclient.AvalaraClient
 	resourceType *v2.ResourceType
+	tenants      *tenantSet
+	progress     *syncProgress
 }
 
 func (r *roleBuilder) ResourceType(ctx context.Context) *v2.ResourceType {
 	return r.resourceType
 }
 
-// List returns all the roles from the Avalara API as resource objects.
+// List returns all the roles of a tenant's account from the Avalara API as resource objects.
 func (r *roleBuilder) List(
 	ctx context.Context,
 	parentResourceID *v2.ResourceId,
 	pToken *pagination.Token,
 ) ([]*v2.Resource, string, annotations.Annotations, error) {
+	t, ok := r.tenants.forParent(parentResourceID)
+	if !ok {
+		return nil, "", nil, nil
+	}
+
 	var rv []*v2.Resource
 
-	options := &avalaraclient.PaginationOptions{
-		Top: 100,
-	}
+	options := &avalaraclient.PaginationOptions{}
 
 	if pToken != nil && pToken.Token != "" {
-		options.NextLink = pToken.Token
+		options.PageToken = pToken.Token
+	} else {
+		// Each sync lists the roles again, so events resolve against roles no older than the last sync.
+		t.roles.reset()
+		t.grants.reset()
 	}
 
-	roles, nextOptions, err := r.client.GetUserRoles(ctx, options)
+	roles, nextOptions, err := t.client.GetUserRoles(ctx, options)
 	if err != nil {
 		return nil, "", nil, fmt.Errorf("avalara-connector: failed to list roles: %w", err)
 	}
@@ -54,14 +66,14 @@ func (r *roleBuilder) List(
 		resource, err := rs.NewRoleResource(
 			role.Description,
 			roleResourceType,
-			strconv.Itoa(role.ID),
+			t.resourceID(strconv.Itoa(role.ID)),
 			[]rs.RoleTraitOption{
 				rs.WithRoleProfile(map[string]interface{}{
 					"id":          strconv.Itoa(role.ID),
 					"description": role.Description,
 				}),
 			},
-			rs.WithParentResourceID(parentResourceID),
+			rs.WithParentResourceID(t.accountResourceID()),
 		)
 		if err != nil {
 			return nil, "", nil, fmt.Errorf("avalara-connector: failed to create role resource: %w", err)
@@ -71,25 +83,32 @@ func (r *roleBuilder) List(
 	}
 
 	var nextPageToken string
-	if nextOptions != nil && nextOptions.NextLink != "" {
-		nextPageToken = nextOptions.NextLink
+	if nextOptions != nil && nextOptions.PageToken != "" {
+		nextPageToken = nextOptions.PageToken
 	}
 
+	r.progress.resourcesListed(ctx, t.name, r.resourceType.Id, resourceIDs(rv), nextPageToken == "")
 	return rv, nextPageToken, nil, nil
 }
 
-func newRoleBuilder(client *avalaraclient.AvalaraClient) *roleBuilder {
+func newRoleBuilder(tenants *tenantSet, progress *syncProgress) *roleBuilder {
 	return &roleBuilder{
-		client:       client,
 		resourceType: roleResourceType,
+		tenants:      tenants,
+		progress:     progress,
 	}
 }
 
 // Grants returns all the grants for a given role.
-// For Avalara, we'll check users to see if they have the specified role.
+// For Avalara, these are the users whose security role it is.
 func (r *roleBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken *pagination.Token) ([]*v2.Grant, string, annotations.Annotations, error) {
 	var rv []*v2.Grant
 
+	t, _, err := r.tenants.forResource(resource.Id)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
 	roleTrait, err := rs.GetRoleTrait(resource)
 	if err != nil {
 		return nil, "", nil, fmt.Errorf("avalara-connector: failed to get role trait: %w", err)
@@ -100,33 +119,28 @@ func (r *roleBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken
 		return nil, "", nil, fmt.Errorf("avalara-connector: failed to get role description from profile")
 	}
 
-	options := &avalaraclient.PaginationOptions{
-		Top: 100,
-	}
-
-	if pToken != nil && pToken.Token != "" {
-		options.NextLink = pToken.Token
+	// The members of every role come from one listing of the users per sync.
+	members, err := t.grants.membersOf(ctx, t, roleDescription)
+	if err != nil {
+		return nil, "", nil, err
 	}
 
-	users, nextOptions, err := r.client.GetUsers(ctx, options)
+	page, nextPageToken, err := pageOfUserIDs(members, pToken)
 	if err != nil {
-		return nil, "", nil, fmt.Errorf("avalara-connector: failed to list users: %w", err)
+		return nil, "", nil, err
 	}
 
-	for _, user := range users.Value {
-		if user.SecurityRoleID == roleDescription {
-			userID, err := rs.NewResourceID(userResourceType, strconv.Itoa(user.ID))
-			if err != nil {
-				return nil, "", nil, fmt.Errorf("avalara-connector: failed to create user resource id: %w", err)
-			}
-
-			rv = append(rv, grant.NewGrant(resource, RoleMemberEntitlement, userID))
+	for _, id := range page {
+		userID, err := rs.NewResourceID(userResourceType, t.resourceID(strconv.Itoa(id)))
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("avalara-connector: failed to create user resource id: %w", err)
 		}
+
+		rv = append(rv, grant.NewGrant(resource, RoleMemberEntitlement, userID))
 	}
 
-	var nextPageToken string
-	if nextOptions != nil && nextOptions.NextLink != "" {
-		nextPageToken = nextOptions.NextLink
+	if nextPageToken == "" {
+		r.progress.grantsListed(ctx, r.resourceType.Id, resource.Id.Resource)
 	}
 
 	return rv, nextPageToken, nil, nil
@@ -149,3 +163,128 @@ func (r *roleBuilder) Entitlements(
 
 	return rv, "", nil, nil
 }
+
+// Grant assigns the role to a user by updating the user's security role.
+// The user is re-read first so retried grants don't issue redundant updates.
+func (r *roleBuilder) Grant(ctx context.Context, principal *v2.Resource, entitlement *v2.Entitlement) (annotations.Annotations, error) {
+	if principal.Id.ResourceType != userResourceType.Id {
+		return nil, fmt.Errorf("avalara-connector: only users can be granted role membership")
+	}
+
+	roleDescription, err := roleDescriptionFromResource(entitlement.Resource)
+	if err != nil {
+		return nil, err
+	}
+
+	t, accountID, user, err := r.getPrincipalUser(ctx, principal, entitlement.Resource)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to grant role %s: %w", roleDescription, err)
+	}
+
+	if user.SecurityRoleID == roleDescription {
+		annos := annotations.Annotations{}
+		annos.Update(&v2.GrantAlreadyExists{})
+		return annos, nil
+	}
+
+	user.SecurityRoleID = roleDescription
+	_, err = t.client.UpdateUser(ctx, accountID, user.ID, user)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to grant role %s: %w", roleDescription, err)
+	}
+
+	return nil, nil
+}
+
+// Revoke removes the role from a user by moving the user to the fallback security role.
+// The user is re-read first so retried revokes don't issue redundant updates.
+func (r *roleBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations.Annotations, error) {
+	principal := grant.Principal
+	if principal.Id.ResourceType != userResourceType.Id {
+		return nil, fmt.Errorf("avalara-connector: only users can have role membership revoked")
+	}
+
+	roleDescription, err := roleDescriptionFromResource(grant.Entitlement.Resource)
+	if err != nil {
+		return nil, err
+	}
+
+	if roleDescription == fallbackSecurityRole {
+		return nil, fmt.Errorf("avalara-connector: cannot revoke %s, every user must hold a security role", fallbackSecurityRole)
+	}
+
+	t, accountID, user, err := r.getPrincipalUser(ctx, principal, grant.Entitlement.Resource)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to revoke role %s: %w", roleDescription, err)
+	}
+
+	if user.SecurityRoleID != roleDescription {
+		annos := annotations.Annotations{}
+		annos.Update(&v2.GrantAlreadyRevoked{})
+		return annos, nil
+	}
+
+	user.SecurityRoleID = fallbackSecurityRole
+	_, err = t.client.UpdateUser(ctx, accountID, user.ID, user)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to revoke role %s: %w", roleDescription, err)
+	}
+
+	return nil, nil
+}
+
+// getPrincipalUser reads the current state of the user behind a principal resource.
+// The user must belong to the same tenant as the role.
+func (r *roleBuilder) getPrincipalUser(ctx context.Context, principal *v2.Resource, role *v2.Resource) (*tenant, int, *avalaraclient.UserModel, error) {
+	t, id, err := r.tenants.forResource(principal.Id)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	roleTenant, _, err := r.tenants.forResource(role.Id)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if roleTenant != t {
+		return nil, 0, nil, fmt.Errorf("avalara-connector: user %s belongs to tenant %s, not %s", principal.Id.Resource, t.name, roleTenant.name)
+	}
+
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid user id %q: %w", principal.Id.Resource, err)
+	}
+
+	// Users synced without an account ID belong to the home account.
+	accountID, err := accountIDFromUserResource(principal)
+	if err != nil || accountID == 0 {
+		accountID = t.scope.homeAccount()
+	}
+	if accountID == 0 {
+		if err == nil {
+			err = fmt.Errorf("avalara-connector: user %d has no account id", userID)
+		}
+		return nil, 0, nil, err
+	}
+
+	user, err := t.client.GetUser(ctx, accountID, userID)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return t, accountID, user, nil
+}
+
+func roleDescriptionFromResource(resource *v2.Resource) (string, error) {
+	roleTrait, err := rs.GetRoleTrait(resource)
+	if err == nil {
+		if description, ok := rs.GetProfileStringValue(roleTrait.Profile, "description"); ok {
+			return description, nil
+		}
+	}
+
+	if resource.DisplayName == "" {
+		return "", fmt.Errorf("avalara-connector: failed to get role description for role %s", resource.Id.Resource)
+	}
+
+	return resource.DisplayName, nil
+}
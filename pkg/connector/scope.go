@@ -0,0 +1,138 @@
+package connector
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+)
+
+// syncScope limits the accounts, companies and users that are synced. Without account
+// include lists, only the home account is synced once it is known. It is applied
+// server-side through OData filters, and client-side wherever users come from somewhere
+// other than a filtered API call.
+type syncScope struct {
+	mu sync.RWMutex
+	// homeAccountID is the configured account ID, or else the account the credentials authenticate to.
+	homeAccountID int
+
+	includeAccountIDs []int
+	excludeAccountIDs []int
+	includeCompanyIDs []int
+	excludeCompanyIDs []int
+	inactiveUsers     bool
+	deletedUsers      bool
+}
+
+func (s *syncScope) setHomeAccount(accountID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.homeAccountID = accountID
+}
+
+// homeAccount returns the home account ID, or 0 before it is known.
+func (s *syncScope) homeAccount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.homeAccountID
+}
+
+// accountIDs returns the accounts to include, which default to the home account.
+func (s *syncScope) accountIDs() []int {
+	if len(s.includeAccountIDs) > 0 {
+		return s.includeAccountIDs
+	}
+	if accountID := s.homeAccount(); accountID != 0 {
+		return []int{accountID}
+	}
+	return nil
+}
+
+// organizationFilter restricts users to the accounts and companies in scope.
+func (s *syncScope) organizationFilter() string {
+	return odataAnd(
+		odataIn("accountId", s.accountIDs()),
+		odataNotIn("accountId", s.excludeAccountIDs),
+		odataIn("companyId", s.includeCompanyIDs),
+		odataNotIn("companyId", s.excludeCompanyIDs),
+	)
+}
+
+// userFilter restricts users to those in scope.
+func (s *syncScope) userFilter() string {
+	var active, deleted string
+	if !s.inactiveUsers {
+		active = "isActive eq true"
+	}
+	if !s.deletedUsers {
+		deleted = "isDeleted eq false"
+	}
+
+	return odataAnd(s.organizationFilter(), active, deleted)
+}
+
+func (s *syncScope) includesAccount(accountID int) bool {
+	if accountIDs := s.accountIDs(); len(accountIDs) > 0 && !slices.Contains(accountIDs, accountID) {
+		return false
+	}
+	return !slices.Contains(s.excludeAccountIDs, accountID)
+}
+
+func (s *syncScope) includesCompany(companyID int) bool {
+	if len(s.includeCompanyIDs) > 0 && !slices.Contains(s.includeCompanyIDs, companyID) {
+		return false
+	}
+	return !slices.Contains(s.excludeCompanyIDs, companyID)
+}
+
+func (s *syncScope) includesUser(user *avalaraclient.UserModel) bool {
+	switch {
+	case !s.includesAccount(user.AccountID), !s.includesCompany(user.CompanyID):
+		return false
+	case !user.IsActive && !s.inactiveUsers:
+		return false
+	case user.IsDeleted && !s.deletedUsers:
+		return false
+	}
+	return true
+}
+
+// odataAnd joins the non-empty clauses with "and", parenthesising any that contain "or".
+func odataAnd(clauses ...string) string {
+	var parts []string
+	for _, clause := range clauses {
+		if clause == "" {
+			continue
+		}
+		if strings.Contains(clause, " or ") {
+			clause = "(" + clause + ")"
+		}
+		parts = append(parts, clause)
+	}
+	return strings.Join(parts, " and ")
+}
+
+func odataIn(field string, ids []int) string {
+	if len(ids) == 0 {
+		return ""
+	}
+
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, strconv.Itoa(id))
+	}
+	return fmt.Sprintf("%s in (%s)", field, strings.Join(values, ", "))
+}
+
+func odataNotIn(field string, ids []int) string {
+	clauses := make([]string, 0, len(ids))
+	for _, id := range ids {
+		clauses = append(clauses, fmt.Sprintf("%s ne %d", field, id))
+	}
+	return odataAnd(clauses...)
+}
@@ -0,0 +1,135 @@
+package connector
+
+import (
+	"context"
+	"sync"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+// syncProgress detects the end of a sync so that the request summary can be logged. The SDK
+// runs the connector in a subprocess that exits without notice, validates the connector at the
+// start of every sync and lists grants last. A sync is therefore over once every tenant has
+// listed all of its listed types and each listed resource of the granted types has had its
+// final page of grants. A tenant without any such resources is done when its listing ends.
+//
+// A sync resumed from a checkpoint past the listings never lists resources in this process, and
+// the grants synced before the restart are never requested again, so its end cannot be told.
+// Its summary is not logged. The resources whose grants it lists are counted by type and
+// logged at debug level instead.
+type syncProgress struct {
+	mu           sync.Mutex
+	tenants      []string
+	listedTypes  []string
+	grantedTypes map[string]bool
+	// listed holds the tenants and resource types whose last page has been listed.
+	listed map[progressKey]bool
+	// pending holds the resources of the granted types that are waiting for their final page of grants.
+	pending map[progressKey]bool
+	// resumed counts the resources of each type whose grants were listed without any listing before them.
+	resumed    map[string]int
+	done       bool
+	onComplete func(ctx context.Context)
+}
+
+// progressKey identifies a resource type of a tenant, or a resource of a type.
+type progressKey struct {
+	scope        string
+	resourceType string
+}
+
+// newSyncProgress tracks the listings of listedTypes and the grants of grantedTypes for each tenant.
+func newSyncProgress(onComplete func(ctx context.Context), tenants []string, listedTypes []string, grantedTypes ...string) *syncProgress {
+	p := &syncProgress{
+		tenants:      tenants,
+		listedTypes:  listedTypes,
+		grantedTypes: make(map[string]bool, len(grantedTypes)),
+		onComplete:   onComplete,
+	}
+	for _, resourceType := range grantedTypes {
+		p.grantedTypes[resourceType] = true
+	}
+	p.begin()
+	return p
+}
+
+// begin starts tracking a new sync.
+func (p *syncProgress) begin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.listed = make(map[progressKey]bool)
+	p.pending = make(map[progressKey]bool)
+	p.resumed = make(map[string]int)
+	p.done = false
+}
+
+// resourcesListed records a page of a tenant's resources. lastPage marks the end of the resource type's listing.
+func (p *syncProgress) resourcesListed(ctx context.Context, tenantName, resourceType string, resourceIDs []string, lastPage bool) {
+	p.mu.Lock()
+	if p.grantedTypes[resourceType] {
+		for _, id := range resourceIDs {
+			p.pending[progressKey{scope: id, resourceType: resourceType}] = true
+		}
+	}
+	if lastPage {
+		p.listed[progressKey{scope: tenantName, resourceType: resourceType}] = true
+	}
+	complete := p.complete()
+	p.mu.Unlock()
+
+	if complete {
+		p.onComplete(ctx)
+	}
+}
+
+// grantsListed records the final page of grants for a resource. Repeated calls for the same resource count once.
+func (p *syncProgress) grantsListed(ctx context.Context, resourceType, resourceID string) {
+	p.mu.Lock()
+	if len(p.listed) == 0 && len(p.pending) == 0 {
+		p.resumed[resourceType]++
+		count := p.resumed[resourceType]
+		p.mu.Unlock()
+
+		ctxzap.Extract(ctx).Debug(
+			"avalara-connector: grants listed in a resumed sync",
+			zap.String("resource_type", resourceType),
+			zap.Int("resources", count),
+		)
+		return
+	}
+	delete(p.pending, progressKey{scope: resourceID, resourceType: resourceType})
+	complete := p.complete()
+	p.mu.Unlock()
+
+	if complete {
+		p.onComplete(ctx)
+	}
+}
+
+// complete reports whether the sync has just ended. It must be called with the lock held.
+func (p *syncProgress) complete() bool {
+	if p.done || len(p.pending) > 0 {
+		return false
+	}
+	for _, tenantName := range p.tenants {
+		for _, resourceType := range p.listedTypes {
+			if !p.listed[progressKey{scope: tenantName, resourceType: resourceType}] {
+				return false
+			}
+		}
+	}
+	p.done = true
+	return true
+}
+
+// resourceIDs returns the IDs of resources, for recording them in the sync progress.
+func resourceIDs(resources []*v2.Resource) []string {
+	ids := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		ids = append(ids, resource.Id.Resource)
+	}
+	return ids
+}
@@ -0,0 +1,251 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultTenantName names the tenant configured without a tenants list.
+	defaultTenantName = "default"
+
+	tenantIDSeparator = "/"
+)
+
+// TenantConfig is one named set of Avalara credentials.
+type TenantConfig struct {
+	Name        string
+	Environment string
+	// BaseURL replaces the environment's API URL when set.
+	BaseURL  string
+	Username string
+	Password string
+	// AccountID overrides the home account discovered from the credentials.
+	AccountID int
+}
+
+// tenant is one set of credentials and the state synced with them. The resources of a tenant
+// from a tenants list are children of its account resource.
+type tenant struct {
+	name string
+	// environment and baseURL are reported in the connector metadata.
+	environment string
+	baseURL     string
+	// namespace prefixes the IDs of the tenant's resources so they are unique across tenants.
+	// It is empty for the default tenant, whose resource IDs are the plain Avalara IDs.
+	namespace string
+	client    avalaraclient.AvalaraAPI
+	// accountID is the configured home account. It is discovered through Ping when zero.
+	accountID          int
+	scope              *syncScope
+	roles              *roleIndex
+	grants             *grantIndex
+	entitlementFetcher *userEntitlementFetcher
+	// userSyncState is set when incremental user sync is enabled.
+	userSyncState *userSyncState
+	// fullSyncUsers collects users during a full sync. They replace the sync state once the last page is listed.
+	fullSyncUsers map[string]avalaraclient.UserModel
+}
+
+func newTenant(ctx context.Context, tc TenantConfig, namespaced bool, cfg *Config, opts *options) (*tenant, error) {
+	client, err := opts.newAPI(ctx, tc, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: tenant %s: %w", tc.Name, err)
+	}
+
+	scope := &syncScope{
+		includeAccountIDs: cfg.IncludeAccountIDs,
+		excludeAccountIDs: cfg.ExcludeAccountIDs,
+		includeCompanyIDs: cfg.IncludeCompanyIDs,
+		excludeCompanyIDs: cfg.ExcludeCompanyIDs,
+		inactiveUsers:     cfg.SyncInactiveUsers,
+		deletedUsers:      cfg.SyncDeletedUsers,
+	}
+	scope.setHomeAccount(tc.AccountID)
+
+	t := &tenant{
+		name:               tc.Name,
+		environment:        tc.Environment,
+		baseURL:            tc.BaseURL,
+		client:             client,
+		accountID:          tc.AccountID,
+		scope:              scope,
+		roles:              &roleIndex{},
+		grants:             &grantIndex{},
+		entitlementFetcher: newUserEntitlementFetcher(client, scope, cfg.EntitlementConcurrency),
+	}
+	if namespaced {
+		t.namespace = tc.Name
+	}
+	if t.environment == "" {
+		t.environment = "production"
+	}
+
+	// Incremental user sync is only enabled when there is somewhere to keep state between syncs.
+	if cfg.UserSyncStatePath != "" {
+		t.userSyncState, err = loadUserSyncState(t.userSyncStatePath(cfg.UserSyncStatePath), cfg.FullSyncInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// userSyncStatePath gives each namespaced tenant its own state file next to the configured one.
+func (t *tenant) userSyncStatePath(path string) string {
+	if t.namespace == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + t.namespace + ext
+}
+
+// resourceID namespaces an Avalara ID.
+func (t *tenant) resourceID(id string) string {
+	if t.namespace == "" {
+		return id
+	}
+	return t.namespace + tenantIDSeparator + id
+}
+
+// accountResourceID is the ID of the account resource the tenant's resources belong to, named after
+// its home account, or after the tenant until the home account is known. Without a tenants list
+// the resources are listed at the top level, as they were before tenants were supported, so there is none.
+func (t *tenant) accountResourceID() *v2.ResourceId {
+	if t.namespace == "" {
+		return nil
+	}
+
+	id := t.name
+	if accountID := t.scope.homeAccount(); accountID != 0 {
+		id = strconv.Itoa(accountID)
+	}
+	return &v2.ResourceId{
+		ResourceType: accountResourceType.Id,
+		Resource:     id,
+	}
+}
+
+// discoverHomeAccount scopes the sync to the account the credentials authenticate to, unless an account was configured.
+func (t *tenant) discoverHomeAccount(ctx context.Context, ping *avalaraclient.PingResponse) {
+	if t.accountID != 0 || ping.AuthenticatedAccountID == 0 {
+		return
+	}
+
+	if t.scope.homeAccount() != ping.AuthenticatedAccountID {
+		ctxzap.Extract(ctx).Info(
+			"avalara-connector: discovered home account",
+			zap.String("tenant", t.name),
+			zap.Int("account_id", ping.AuthenticatedAccountID),
+			zap.Int("company_id", ping.AuthenticatedCompanyID),
+		)
+	}
+	t.scope.setHomeAccount(ping.AuthenticatedAccountID)
+}
+
+// homeAccountID returns the home account, discovering it if Validate has not done so yet.
+func (t *tenant) homeAccountID(ctx context.Context) (int, error) {
+	if accountID := t.scope.homeAccount(); accountID != 0 {
+		return accountID, nil
+	}
+
+	ping, err := t.client.Ping(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("avalara-connector: failed to look up account for tenant %s: %w", t.name, err)
+	}
+	t.discoverHomeAccount(ctx, ping)
+
+	if ping.AuthenticatedAccountID == 0 {
+		return 0, fmt.Errorf("avalara-connector: the credentials of tenant %s are not associated with an account, set its account ID", t.name)
+	}
+	return ping.AuthenticatedAccountID, nil
+}
+
+// tenantSet holds the configured tenants in configuration order.
+type tenantSet struct {
+	tenants []*tenant
+	byName  map[string]*tenant
+}
+
+func newTenantSet(tenants []*tenant) *tenantSet {
+	s := &tenantSet{
+		tenants: tenants,
+		byName:  make(map[string]*tenant, len(tenants)),
+	}
+	for _, t := range tenants {
+		s.byName[t.name] = t
+	}
+	return s
+}
+
+// namespaced reports whether the tenants come from a tenants list, in which case each tenant's
+// resources are listed under its account resource.
+func (s *tenantSet) namespaced() bool {
+	return len(s.tenants) > 0 && s.tenants[0].namespace != ""
+}
+
+// forParent returns the tenant whose resources are listed under a parent. That is the default
+// tenant for no parent, or the tenant of an account resource when there is a tenants list.
+func (s *tenantSet) forParent(parentResourceID *v2.ResourceId) (*tenant, bool) {
+	if !s.namespaced() {
+		if parentResourceID != nil || len(s.tenants) == 0 {
+			return nil, false
+		}
+		return s.tenants[0], true
+	}
+
+	if parentResourceID == nil || parentResourceID.ResourceType != accountResourceType.Id {
+		return nil, false
+	}
+	for _, t := range s.tenants {
+		if t.accountResourceID().Resource == parentResourceID.Resource {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// checkAccounts returns an error when two tenants have the same home account, since their
+// account resources would have the same ID.
+func (s *tenantSet) checkAccounts() error {
+	if !s.namespaced() {
+		return nil
+	}
+
+	seen := make(map[int]string, len(s.tenants))
+	for _, t := range s.tenants {
+		accountID := t.scope.homeAccount()
+		if accountID == 0 {
+			continue
+		}
+		if other, ok := seen[accountID]; ok {
+			return fmt.Errorf("avalara-connector: tenants %s and %s are both for account %d", other, t.name, accountID)
+		}
+		seen[accountID] = t.name
+	}
+	return nil
+}
+
+// forResource returns the tenant a resource belongs to, and the Avalara ID of the resource.
+func (s *tenantSet) forResource(resourceID *v2.ResourceId) (*tenant, string, error) {
+	if t, ok := s.byName[defaultTenantName]; ok && t.namespace == "" {
+		return t, resourceID.Resource, nil
+	}
+
+	namespace, id, ok := strings.Cut(resourceID.Resource, tenantIDSeparator)
+	if ok {
+		if t, ok := s.byName[namespace]; ok {
+			return t, id, nil
+		}
+	}
+	return nil, "", fmt.Errorf("avalara-connector: %s %q does not belong to a configured tenant", resourceID.ResourceType, resourceID.Resource)
+}
@@ -0,0 +1,144 @@
+package connector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
+)
+
+// userSyncState is persisted between syncs so users can be synced incrementally.
+// It holds every user seen so far and the newest modifiedDate among them.
+type userSyncState struct {
+	path             string
+	fullSyncInterval time.Duration
+
+	// Scope is the user filter of the last full sync. Changing the sync scope forces a full sync.
+	Scope         string                             `json:"scope"`
+	HighWaterMark string                             `json:"highWaterMark"`
+	LastFullSync  time.Time                          `json:"lastFullSync"`
+	Users         map[string]avalaraclient.UserModel `json:"users"`
+}
+
+// loadUserSyncState reads the state file at path. A missing file yields an empty state,
+// which forces the next sync to be a full one.
+func loadUserSyncState(path string, fullSyncInterval time.Duration) (*userSyncState, error) {
+	state := &userSyncState{
+		path:             path,
+		fullSyncInterval: fullSyncInterval,
+		Users:            make(map[string]avalaraclient.UserModel),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to read user sync state: %w", err)
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("avalara-connector: failed to parse user sync state %s: %w", path, err)
+	}
+	if state.Users == nil {
+		state.Users = make(map[string]avalaraclient.UserModel)
+	}
+
+	return state, nil
+}
+
+// fullSyncDue reports whether the next sync must list every user, which is the only way to notice hard deletes.
+// scope is the current user filter.
+func (s *userSyncState) fullSyncDue(now time.Time, scope string) bool {
+	return s.HighWaterMark == "" || s.LastFullSync.IsZero() || now.Sub(s.LastFullSync) >= s.fullSyncInterval ||
+		s.Scope != scope
+}
+
+// replace swaps in the result of a full sync made with the scope user filter.
+func (s *userSyncState) replace(users map[string]avalaraclient.UserModel, now time.Time, scope string) {
+	s.Users = users
+	s.Scope = scope
+	s.LastFullSync = now
+	s.HighWaterMark = ""
+	for _, user := range users {
+		s.advanceHighWaterMark(user.ModifiedDate)
+	}
+}
+
+// merge applies users modified since the last sync.
+func (s *userSyncState) merge(users []avalaraclient.UserModel) {
+	for _, user := range users {
+		s.Users[strconv.Itoa(user.ID)] = user
+		s.advanceHighWaterMark(user.ModifiedDate)
+	}
+}
+
+func (s *userSyncState) advanceHighWaterMark(modifiedDate string) {
+	if modifiedDate == "" {
+		return
+	}
+
+	modified, err := parseAvalaraTime(modifiedDate)
+	if err != nil {
+		return
+	}
+
+	if s.HighWaterMark != "" {
+		current, err := parseAvalaraTime(s.HighWaterMark)
+		if err == nil && !modified.After(current) {
+			return
+		}
+	}
+
+	s.HighWaterMark = modifiedDate
+}
+
+// sortedUsers returns the stored users ordered by ID, so pages are stable across List calls.
+func (s *userSyncState) sortedUsers() []avalaraclient.UserModel {
+	users := make([]avalaraclient.UserModel, 0, len(s.Users))
+	for _, user := range s.Users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users
+}
+
+// save writes the state atomically so an interrupted sync never leaves a truncated file behind.
+func (s *userSyncState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("avalara-connector: failed to encode user sync state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("avalara-connector: failed to write user sync state: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("avalara-connector: failed to write user sync state: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("avalara-connector: failed to write user sync state: %w", err)
+	}
+
+	return nil
+}
@@ -3,6 +3,9 @@ package connector
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	avalaraclient "github.com/conductorone/baton-avalara/pkg/client"
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
@@ -11,41 +14,169 @@ import (
 	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
 )
 
+// cachedUsersTokenPrefix marks page tokens that page through users held in the sync state
+// rather than through the Avalara API.
+const cachedUsersTokenPrefix = "cached:"
+
 type userBuilder struct {
-	client       *avalaraclient.AvalaraClient
 	resourceType *v2.ResourceType
+	tenants      *tenantSet
+	progress     *syncProgress
 }
 
 func (o *userBuilder) ResourceType(ctx context.Context) *v2.ResourceType {
 	return o.resourceType
 }
 
-// List returns all the users from the Avalara API as resource objects.
+// List returns all the users of a tenant's account from the Avalara API as resource objects.
 // Users include a UserTrait because they are the 'shape' of a standard user.
 func (o *userBuilder) List(
 	ctx context.Context,
 	parentResourceID *v2.ResourceId,
 	pToken *pagination.Token,
 ) ([]*v2.Resource, string, annotations.Annotations, error) {
-	pageSize := 100
+	t, ok := o.tenants.forParent(parentResourceID)
+	if !ok {
+		return nil, "", nil, nil
+	}
+
+	users, nextPageToken, annos, err := o.list(ctx, t, pToken)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	o.progress.resourcesListed(ctx, t.name, o.resourceType.Id, nil, nextPageToken == "")
+	return users, nextPageToken, annos, nil
+}
+
+// list returns a page of a tenant's users, from the sync state when incremental user sync is enabled and no full sync is due.
+func (o *userBuilder) list(
+	ctx context.Context,
+	t *tenant,
+	pToken *pagination.Token,
+) ([]*v2.Resource, string, annotations.Annotations, error) {
+	if t.userSyncState != nil {
+		if pToken == nil || pToken.Token == "" {
+			if !t.userSyncState.fullSyncDue(time.Now(), t.scope.userFilter()) {
+				err := o.syncModifiedUsers(ctx, t)
+				if err != nil {
+					return nil, "", nil, err
+				}
+				return o.listCachedUsers(ctx, t, 0)
+			}
+			t.fullSyncUsers = make(map[string]avalaraclient.UserModel)
+		} else if strings.HasPrefix(pToken.Token, cachedUsersTokenPrefix) {
+			offset, err := strconv.Atoi(strings.TrimPrefix(pToken.Token, cachedUsersTokenPrefix))
+			if err != nil {
+				return nil, "", nil, fmt.Errorf("invalid page token: %w", err)
+			}
+			return o.listCachedUsers(ctx, t, offset)
+		}
+	}
+
 	var users []*v2.Resource
 
 	options := &avalaraclient.PaginationOptions{
-		Top:  pageSize,
-		Skip: 0,
+		Filter: t.scope.userFilter(),
 	}
 
 	if pToken != nil && pToken.Token != "" {
-		options.NextLink = pToken.Token
+		options.PageToken = pToken.Token
 	}
 
-	resp, nextOptions, err := o.client.GetUsers(ctx, options)
+	resp, nextOptions, err := t.client.GetUsers(ctx, options)
 	if err != nil {
 		return nil, "", nil, fmt.Errorf("failed to get users: %w", err)
 	}
 
 	for _, user := range resp.Value {
-		resource, err := userResource(ctx, &user, parentResourceID)
+		if !t.scope.includesUser(&user) {
+			continue
+		}
+
+		resource, err := userResource(ctx, t, &user)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("failed to create user resource: %w", err)
+		}
+		users = append(users, resource)
+
+		if t.fullSyncUsers != nil {
+			t.fullSyncUsers[strconv.Itoa(user.ID)] = user
+		}
+	}
+
+	var nextPageToken string
+	if nextOptions != nil && nextOptions.PageToken != "" {
+		nextPageToken = nextOptions.PageToken
+	}
+
+	// A full sync resumed part way through never saw the earlier pages, so it is not saved.
+	if nextPageToken == "" && t.fullSyncUsers != nil {
+		t.userSyncState.replace(t.fullSyncUsers, time.Now(), t.scope.userFilter())
+		t.fullSyncUsers = nil
+		err := t.userSyncState.save()
+		if err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	return users, nextPageToken, nil, nil
+}
+
+// syncModifiedUsers merges users modified since the previous sync into the sync state.
+func (o *userBuilder) syncModifiedUsers(ctx context.Context, t *tenant) error {
+	// Only the organization filter is applied, so users who were deactivated or deleted
+	// since the last sync are still merged, and then left out when the cache is listed.
+	// modifiedDate has whole seconds, so users modified in the same second as the high-water
+	// mark are listed again rather than missed; merging them twice changes nothing.
+	options := &avalaraclient.PaginationOptions{
+		Filter: odataAnd(
+			fmt.Sprintf("modifiedDate ge %s", odataString(t.userSyncState.HighWaterMark)),
+			t.scope.organizationFilter(),
+		),
+	}
+
+	for {
+		resp, nextOptions, err := t.client.GetUsers(ctx, options)
+		if err != nil {
+			return fmt.Errorf("failed to get modified users: %w", err)
+		}
+
+		t.userSyncState.merge(resp.Value)
+
+		if nextOptions == nil || nextOptions.PageToken == "" {
+			break
+		}
+		options = &avalaraclient.PaginationOptions{PageToken: nextOptions.PageToken}
+	}
+
+	return t.userSyncState.save()
+}
+
+// listCachedUsers returns a page of the users held in the sync state, starting at offset.
+func (o *userBuilder) listCachedUsers(
+	ctx context.Context,
+	t *tenant,
+	offset int,
+) ([]*v2.Resource, string, annotations.Annotations, error) {
+	var cached []avalaraclient.UserModel
+	for _, user := range t.userSyncState.sortedUsers() {
+		if t.scope.includesUser(&user) {
+			cached = append(cached, user)
+		}
+	}
+	if offset > len(cached) {
+		offset = len(cached)
+	}
+
+	end := offset + avalaraclient.DefaultPageSize
+	if end > len(cached) {
+		end = len(cached)
+	}
+
+	var users []*v2.Resource
+	for _, user := range cached[offset:end] {
+		resource, err := userResource(ctx, t, &user)
 		if err != nil {
 			return nil, "", nil, fmt.Errorf("failed to create user resource: %w", err)
 		}
@@ -53,8 +184,8 @@ func (o *userBuilder) List(
 	}
 
 	var nextPageToken string
-	if nextOptions != nil && nextOptions.NextLink != "" {
-		nextPageToken = nextOptions.NextLink
+	if end < len(cached) {
+		nextPageToken = cachedUsersTokenPrefix + strconv.Itoa(end)
 	}
 
 	return users, nextPageToken, nil, nil
@@ -78,14 +209,15 @@ func (o *userBuilder) Grants(
 	return nil, "", nil, nil
 }
 
-func newUserBuilder(client *avalaraclient.AvalaraClient) *userBuilder {
+func newUserBuilder(tenants *tenantSet, progress *syncProgress) *userBuilder {
 	return &userBuilder{
-		client:       client,
 		resourceType: userResourceType,
+		tenants:      tenants,
+		progress:     progress,
 	}
 }
 
-func userResource(ctx context.Context, user *avalaraclient.UserModel, parent *v2.ResourceId) (*v2.Resource, error) {
+func userResource(ctx context.Context, t *tenant, user *avalaraclient.UserModel) (*v2.Resource, error) {
 	profile := map[string]interface{}{
 		"id":                   user.ID,
 		"firstName":            user.FirstName,
@@ -114,9 +246,9 @@ func userResource(ctx context.Context, user *avalaraclient.UserModel, parent *v2
 	resource, err := rs.NewUserResource(
 		user.UserName,
 		userResourceType,
-		user.ID,
+		t.resourceID(strconv.Itoa(user.ID)),
 		userTraitOptions,
-		rs.WithParentResourceID(parent),
+		rs.WithParentResourceID(t.accountResourceID()),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user resource: %w", err)